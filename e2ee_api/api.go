@@ -2,15 +2,113 @@ package e2ee_api
 
 import (
 	"encoding/json"
+	"sort"
+	"time"
 
 	x3dh_core "tux.tech/x3dh/core"
 )
 
+// Protocol spoken over the websocket, bumped when requests are added or
+// changed. A connection uses the highest version both sides speak.
+const (
+	ProtocolVersion    = 4
+	MinProtocolVersion = 1
+)
+
+// X25519 key agreement, AES-256-GCM with PBKDF2-SHA256 derived keys (x3dh_core)
+const CipherSuiteX25519AESGCM = "x3dh-x25519-aes256gcm-sha256"
+
+// Frame encodings
+const EncodingJSON = "json"
+
+// Protocol version each request was introduced in. A request can only be used
+// on a connection that negotiated at least that version.
+var MethodVersions = map[string]int{
+	"hello":              1,
+	"get_bundle":         1,
+	"upload_bundle":      1,
+	"send_message":       1,
+	"receive_message":    1,
+	"receive_messages":   1,
+	"subscribe_messages": 1,
+	"ack_message":        1,
+	"status":             1,
+	"upload_new_otps":    1,
+	"lookup_user":        1,
+	"rotate_identity":    1,
+	"identity_history":   1,
+	"delete_account":     1,
+	"set_presence":       2,
+	"subscribe_presence": 2,
+	"signal_ephemeral":   3,
+	"subscribe_receipts": 4,
+	"send_read_receipt":  4,
+}
+
+// Requests available at a protocol version, sorted
+func MethodsForVersion(version int) []string {
+	methods := make([]string, 0, len(MethodVersions))
+	for method, introduced := range MethodVersions {
+		if introduced <= version {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Highest version in both ranges, false if they do not overlap
+func NegotiateVersion(clientVersion, clientMinVersion int) (int, bool) {
+	version := min(clientVersion, ProtocolVersion)
+	if version < max(clientMinVersion, MinProtocolVersion) {
+		return 0, false
+	}
+	return version, true
+}
+
+// Why a request failed
+const (
+	ErrCodeRecipientNotFound = "recipient_not_found"
+	ErrCodeQueueFull         = "queue_full"
+	ErrCodeMessageTooLarge   = "message_too_large"
+	ErrCodeMessageExpired    = "message_expired"
+	ErrCodeForbidden         = "forbidden"
+	ErrCodeInvalidBundle     = "invalid_bundle"
+	ErrCodeIdentityTaken     = "identity_taken"
+	ErrCodeInvalidRotation   = "invalid_rotation"
+	ErrCodeInvalidPassword   = "invalid_password"
+	ErrCodeNotRegistered     = "not_registered"
+	ErrCodeNotConfirmed      = "not_confirmed"
+	ErrCodeInvalidRequest    = "invalid_request"
+	ErrCodeUnknownMethod     = "unknown_method"
+	ErrCodeHelloRequired     = "hello_required"
+	ErrCodeIncompatible      = "incompatible_client"
+	ErrCodeRateLimited       = "rate_limited"
+	ErrCodeShuttingDown      = "shutting_down"
+	ErrCodeInternal          = "internal_error"
+)
+
+// Request from a client. A request with an ID is answered with an
+// OutboundMessage carrying the same ID, requests without one are answered
+// with an empty ID.
 type InboundMessage struct {
+	ID     string          `json:"id,omitempty"`
 	Method string          `json:"method"`
 	Params json.RawMessage `json:"params"`
 }
 
+// First request on every connection, nothing else is accepted before it
+type RequestHello struct {
+	// Newest and oldest protocol version the client speaks
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version"`
+	// Supported cipher suites and encodings, preferred first
+	CipherSuites []string `json:"cipher_suites"`
+	Encodings    []string `json:"encodings"`
+	// Client name and version, for the server log
+	Client string `json:"client,omitempty"`
+}
+
 type RequestUploadOTPs struct {
 	OTPs []x3dh_core.X3DHPublicOTP `json:"otps"`
 }
@@ -34,9 +132,137 @@ type RequestSendMsg struct {
 
 type RequestReceiveMsg struct{}
 
+type RequestReceiveMsgs struct {
+	// Only messages queued after this one, empty for the start of the queue
+	AfterID string `json:"after_id,omitempty"`
+	// Maximum number of messages, server default if zero
+	Limit int `json:"limit,omitempty"`
+}
+
+// Push queued and new messages as notify_message instead of notify_new_message
+type RequestSubscribeMsgs struct {
+	Push bool `json:"push"`
+}
+
+type RequestAckMsg struct {
+	MessageID string `json:"message_id"`
+}
+
+type RequestLookupUser struct {
+	UserID string `json:"user_id"`
+}
+
+type RequestRotateIdentity struct {
+	Bundle   x3dh_core.X3DHClientBundle     `json:"bundle"`
+	Rotation x3dh_core.X3DHIdentityRotation `json:"rotation"`
+	// Account password, required for unsigned resets
+	Password string `json:"password,omitempty"`
+}
+
+type RequestIdentityHistory struct {
+	UserID string `json:"user_id"`
+}
+
+// Who may see whether this user is online. Presence is hidden by default.
+type RequestSetPresence struct {
+	// x3dh_core.PresenceNobody, PresenceContacts or PresenceEveryone
+	Visibility string `json:"visibility"`
+	// Also show when the user was last online
+	ShareLastSeen bool `json:"share_last_seen"`
+	// Usernames allowed to see presence with PresenceContacts
+	Contacts []string `json:"contacts,omitempty"`
+}
+
+// Replaces the users this connection watches. Changes are sent as
+// notify_presence.
+type RequestSubscribePresence struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// Relayed to the live connections of the recipient as notify_signal, never
+// stored. Dropped if the recipient is offline.
+type RequestSignalEphemeral struct {
+	RecipientID string                    `json:"recipient_id"`
+	Signal      x3dh_core.EphemeralSignal `json:"signal"`
+}
+
+// Returns the receipts kept while this user was offline and sends new ones
+// to this connection as notify_receipt
+type RequestSubscribeReceipts struct{}
+
+// Tell the sender of messages that they were read. The signal is end-to-end
+// encrypted, the server only relays it. It is only accepted for a message the
+// recipient sent to this user and this user acknowledged, once per message.
+type RequestSendReadReceipt struct {
+	RecipientID string `json:"recipient_id"`
+	// Acknowledged message the receipt is for
+	MessageID string                    `json:"message_id"`
+	Signal    x3dh_core.EphemeralSignal `json:"signal"`
+}
+
+// Deletes the account and everything stored for it. The username must be
+// repeated as confirmation.
+type RequestDeleteAccount struct {
+	Password        string `json:"password"`
+	ConfirmUsername string `json:"confirm_username"`
+}
+
+// Response (ID of the request) or notification (no ID, method notify_*).
+// A failed request is answered with Error instead of Params.
 type OutboundMessage struct {
+	ID     string          `json:"id,omitempty"`
 	Method string          `json:"method"`
-	Params json.RawMessage `json:"params"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+}
+
+type Error struct {
+	// One of the ErrCode constants
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The same request may succeed later
+	Retryable bool `json:"retryable"`
+}
+
+// Failures caused by load or the server, not by the request
+var retryableCodes = map[string]bool{
+	ErrCodeQueueFull:    true,
+	ErrCodeRateLimited:  true,
+	ErrCodeShuttingDown: true,
+	ErrCodeInternal:     true,
+}
+
+func NewError(code string, message string) *Error {
+	return &Error{
+		Code:      code,
+		Message:   message,
+		Retryable: retryableCodes[code],
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Limits enforced by the server, 0 if disabled
+type ServerLimits struct {
+	MaxMessageSize    int   `json:"max_message_size"`
+	MaxQueuedMessages int   `json:"max_queued_messages"`
+	MaxStoredOTPs     int   `json:"max_stored_otps"`
+	MessageTTLSeconds int64 `json:"message_ttl_seconds"`
+	MaxMessageBatch   int   `json:"max_message_batch"`
+	MaxSignalSize     int   `json:"max_signal_size"`
+}
+
+type ResponseHello struct {
+	Success bool `json:"success"`
+	// Negotiated for this connection
+	ProtocolVersion int    `json:"protocol_version"`
+	CipherSuite     string `json:"cipher_suite"`
+	Encoding        string `json:"encoding"`
+	// Requests available at the negotiated version
+	Methods []string     `json:"methods"`
+	Limits  ServerLimits `json:"limits"`
 }
 
 type ResponseUserBundle struct {
@@ -48,22 +274,177 @@ type ResponseUploadBundle struct {
 	Success bool `json:"success"`
 }
 
+// Why an uploaded one time pre key was not stored: malformed, duplicate
+// (within the upload), reused (ID used before) or limit (too many stored)
+type OTPRejection struct {
+	ID     int    `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type ResponseUploadOTPs struct {
+	Success  bool           `json:"success"`
+	Accepted []int          `json:"accepted"`
+	Rejected []OTPRejection `json:"rejected"`
+}
+
 type ResponseUserStatus struct {
 	Success bool `json:"success"`
 }
 
 type ResponseSendMsg struct {
-	Success bool `json:"success"`
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id,omitempty"`
 }
 
+// Oldest unacknowledged message. It is delivered again until acknowledged.
 type ResponseReceiveMsg struct {
 	Success     bool                     `json:"success"`
+	MessageID   string                   `json:"message_id,omitempty"`
+	Timestamp   time.Time                `json:"timestamp,omitempty"`
 	SenderID    string                   `json:"sender_id"`
 	MessageData x3dh_core.InitialMessage `json:"message"`
 }
 
+type QueuedMessage struct {
+	MessageID   string                   `json:"message_id"`
+	Timestamp   time.Time                `json:"timestamp"`
+	SenderID    string                   `json:"sender_id"`
+	MessageData x3dh_core.InitialMessage `json:"message"`
+}
+
+// Messages are delivered again until acknowledged
+type ResponseReceiveMsgs struct {
+	Success  bool            `json:"success"`
+	Messages []QueuedMessage `json:"messages"`
+	// after_id for the next batch
+	Cursor string `json:"cursor"`
+	More   bool   `json:"more"`
+}
+
+type ResponseSubscribeMsgs struct {
+	Success bool `json:"success"`
+	Push    bool `json:"push"`
+}
+
+type ResponseAckMsg struct {
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id"`
+}
+
+type ResponseLookupUser struct {
+	Success     bool                   `json:"success"`
+	UserID      string                 `json:"user_id"`
+	IdentityKey x3dh_core.X3DHPublicIK `json:"identity_key"`
+}
+
+type ResponseRotateIdentity struct {
+	Success bool `json:"success"`
+}
+
+type ResponseIdentityHistory struct {
+	Success   bool                             `json:"success"`
+	UserID    string                           `json:"user_id"`
+	Rotations []x3dh_core.X3DHIdentityRotation `json:"rotations"`
+}
+
+type ResponseSetPresence struct {
+	Success bool `json:"success"`
+}
+
+// Presence status
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+	// Hidden by the user, or no such user
+	StatusUnknown = "unknown"
+)
+
+type Presence struct {
+	UserID string `json:"user_id"`
+	Status string `json:"status"`
+	// Only for offline users sharing it
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Current presence of every watched user
+type ResponseSubscribePresence struct {
+	Success  bool       `json:"success"`
+	Presence []Presence `json:"presence"`
+}
+
+// Success does not mean the signal reached anyone, that would reveal
+// whether the recipient is online
+type ResponseSignalEphemeral struct {
+	Success bool `json:"success"`
+}
+
+// Receipt for messages this user sent
+type Receipt struct {
+	// x3dh_core.ReceiptDelivered or ReceiptRead
+	Type string `json:"type"`
+	// Recipient of the message
+	UserID string `json:"user_id"`
+	// Delivered or read message
+	MessageID string `json:"message_id,omitempty"`
+	// Encrypted by the recipient (read receipts)
+	Signal    *x3dh_core.EphemeralSignal `json:"signal,omitempty"`
+	Timestamp time.Time                  `json:"timestamp"`
+}
+
+type ResponseSubscribeReceipts struct {
+	Success  bool      `json:"success"`
+	Receipts []Receipt `json:"receipts"`
+}
+
+type ResponseSendReadReceipt struct {
+	Success bool `json:"success"`
+}
+
+type ResponseDeleteAccount struct {
+	Success bool `json:"success"`
+}
+
 type NotifyLowOTP struct{}
 
 type NotifyNewMessage struct {
 	SenderID string `json:"sender_id"`
 }
+
+// Pushed message, must be acknowledged like received ones
+type NotifyMessage struct {
+	QueuedMessage
+}
+
+// Sent to the sender when a message is purged before it was acknowledged
+type NotifyMessageExpired struct {
+	MessageID   string `json:"message_id"`
+	RecipientID string `json:"recipient_id"`
+	Error       string `json:"error"`
+}
+
+type NotifyIdentityChanged struct {
+	UserID   string                         `json:"user_id"`
+	Rotation x3dh_core.X3DHIdentityRotation `json:"rotation"`
+}
+
+// A watched user came online, went offline or changed visibility
+type NotifyPresence struct {
+	Presence
+}
+
+// Ephemeral signal from another user, only sent while connected
+type NotifySignal struct {
+	SenderID string                    `json:"sender_id"`
+	Signal   x3dh_core.EphemeralSignal `json:"signal"`
+}
+
+// Receipt for a message this user sent, only sent to connections that
+// subscribed to receipts
+type NotifyReceipt struct {
+	Receipt
+}
+
+// Account deleted by its owner or expired for inactivity
+type NotifyIdentityDeleted struct {
+	UserID string `json:"user_id"`
+}
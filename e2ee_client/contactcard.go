@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	neturl "net/url"
+	"os"
+
+	"github.com/mdp/qrterminal/v3"
+	"go.step.sm/crypto/x25519"
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+// ================================== CONTACT CARDS ===========================
+// A contact card is a compact URI that carries everything needed to add a contact:
+//
+//	e2ee://contact?v=1&u=<username>&k=<identity key>&s=<server>&c=<checksum>
+//
+// The identity key is unpadded base64url, the server is optional and the checksum
+// is the first 4 bytes (hex) of SHA-256 over the other fields. The checksum only
+// catches typos and truncated pastes, it does not authenticate the card.
+const contactCardScheme = "e2ee"
+const contactCardHost = "contact"
+const contactCardVersion = "1"
+
+func contactCardChecksum(version, username, key, server string) string {
+	digest := sha256.Sum256([]byte(version + "|" + username + "|" + key + "|" + server))
+	return hex.EncodeToString(digest[:4])
+}
+
+// Encode the contact as a contact card URI. Server may be empty.
+func (c Contact) ContactCardURI(server string) string {
+	key := base64.RawURLEncoding.EncodeToString(c.PublicKey.IdentityKey[:])
+	query := neturl.Values{}
+	query.Set("v", contactCardVersion)
+	query.Set("u", c.Username)
+	query.Set("k", key)
+	if server != "" {
+		query.Set("s", server)
+	}
+	query.Set("c", contactCardChecksum(contactCardVersion, c.Username, key, server))
+	card := neturl.URL{
+		Scheme:   contactCardScheme,
+		Host:     contactCardHost,
+		RawQuery: query.Encode(),
+	}
+	return card.String()
+}
+
+// Render the contact card as a QR code in the terminal
+func (c Contact) PrintContactCardQR(server string) {
+	qrterminal.GenerateHalfBlock(c.ContactCardURI(server), qrterminal.L, os.Stdout)
+}
+
+// Parse a contact card URI. Returns the contact and the server it was issued for (may be empty).
+func ParseContactCard(uri string) (*Contact, string, error) {
+	card, err := neturl.Parse(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	if card.Scheme != contactCardScheme || card.Host != contactCardHost {
+		return nil, "", fmt.Errorf("not a contact card")
+	}
+	query := card.Query()
+	version := query.Get("v")
+	if version != contactCardVersion {
+		return nil, "", fmt.Errorf("unsupported contact card version %q", version)
+	}
+	username := query.Get("u")
+	key := query.Get("k")
+	server := query.Get("s")
+	if username == "" || key == "" {
+		return nil, "", fmt.Errorf("incomplete contact card")
+	}
+	// Check for typos or truncation
+	if query.Get("c") != contactCardChecksum(version, username, key, server) {
+		return nil, "", fmt.Errorf("contact card checksum mismatch")
+	}
+	// Decode identity key
+	rawKey, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rawKey) != x25519.PublicKeySize {
+		return nil, "", fmt.Errorf("invalid identity key length")
+	}
+	return &Contact{
+		Username: username,
+		PublicKey: x3dh_core.X3DHPublicIK{
+			IdentityKey: x25519.PublicKey(rawKey),
+		},
+	}, server, nil
+}
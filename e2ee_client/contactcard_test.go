@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+func testContact(t *testing.T, username string) Contact {
+	t.Helper()
+	ik, err := x3dh_core.GenerateFullIK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Contact{Username: username, PublicKey: *ik.PublicIK()}
+}
+
+func TestParseContactCard(t *testing.T) {
+	contact := testContact(t, "alice")
+	for _, server := range []string{"", "wss://chat.example:8765"} {
+		uri := contact.ContactCardURI(server)
+		parsed, parsedServer, err := ParseContactCard(uri)
+		if err != nil {
+			t.Fatalf("ParseContactCard(%q) = %v; want nil", uri, err)
+		}
+		if parsed.Username != contact.Username || !parsed.PublicKey.IdentityKey.Equal(contact.PublicKey.IdentityKey) || parsedServer != server {
+			t.Fatalf("ParseContactCard(%q) = %+v, %q; want %+v, %q", uri, parsed, parsedServer, contact, server)
+		}
+		// Never trusted just because it parsed, the caller decides
+		if parsed.Unverified {
+			t.Fatalf("ParseContactCard set Unverified; the caller decides")
+		}
+	}
+
+	uri := contact.ContactCardURI("")
+	other := testContact(t, "mallory")
+	bad := map[string]string{
+		"not a uri":      "::",
+		"other scheme":   strings.Replace(uri, "e2ee://", "https://", 1),
+		"other version":  strings.Replace(uri, "v=1", "v=2", 1),
+		"truncated":      uri[:len(uri)-3],
+		"typo":           strings.Replace(uri, "u=alice", "u=alise", 1),
+		"swapped key":    strings.Replace(uri, "k="+keyParam(t, uri), "k="+keyParam(t, other.ContactCardURI("")), 1),
+		"missing fields": "e2ee://contact?v=1&u=alice",
+	}
+	for name, uri := range bad {
+		if _, _, err := ParseContactCard(uri); err == nil {
+			t.Errorf("ParseContactCard with %s = nil; want an error", name)
+		}
+	}
+}
+
+// Encoded identity key of a card
+func keyParam(t *testing.T, uri string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(uri, "k=")
+	if !ok {
+		t.Fatalf("no key in %q", uri)
+	}
+	key, _, _ := strings.Cut(rest, "&")
+	return key
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice := testContact(t, "alice").PublicKey.IdentityKey
+	bob := testContact(t, "bob").PublicKey.IdentityKey
+	carol := testContact(t, "carol").PublicKey.IdentityKey
+
+	number := SafetyNumber(alice, bob)
+	// Both sides compute the same number
+	if SafetyNumber(bob, alice) != number {
+		t.Fatalf("SafetyNumber depends on the argument order")
+	}
+	groups := strings.Split(number, " ")
+	if len(groups) != 12 {
+		t.Fatalf("SafetyNumber has %d groups; want 12", len(groups))
+	}
+	for _, group := range groups {
+		if len(group) != 5 || strings.Trim(group, "0123456789") != "" {
+			t.Fatalf("SafetyNumber group %q is not 5 digits", group)
+		}
+	}
+	if SafetyNumber(alice, carol) == number {
+		t.Fatalf("SafetyNumber is the same for a different key")
+	}
+}
@@ -18,13 +18,16 @@ require (
 	github.com/oklog/ulid v1.3.1 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	go.mongodb.org/mongo-driver v1.16.0 // indirect
-	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/term v0.21.0 // indirect
+	rsc.io/qr v0.2.0 // indirect
 )
 
 require tux.tech/x3dh/client v0.0.0-00010101000000-000000000000
 
 require (
 	github.com/jedib0t/go-pretty v4.3.0+incompatible
+	github.com/mdp/qrterminal/v3 v3.2.1
 	tux.tech/e2ee/api v0.0.0-00010101000000-000000000000
 	tux.tech/x3dh/core v0.0.0-00010101000000-000000000000
 )
@@ -32,6 +35,6 @@ require (
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/gorilla/websocket v1.5.3
-	go.step.sm/crypto v0.47.1 // indirect
+	go.step.sm/crypto v0.47.1
 	golang.org/x/crypto v0.24.0 // indirect
 )
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+	"github.com/jedib0t/go-pretty/text"
+	x3dh_client "tux.tech/x3dh/client"
+)
+
+// ================================== HISTORY ===========================
+const (
+	DirectionIncoming = "in"
+	DirectionOutgoing = "out"
+)
+
+// Status of outgoing messages, in the order they are reached
+const (
+	MessageSent      = "sent"
+	MessageDelivered = "delivered"
+	MessageRead      = "read"
+)
+
+var messageStatusOrder = map[string]int{
+	MessageSent:      1,
+	MessageDelivered: 2,
+	MessageRead:      3,
+}
+
+type HistoryEntry struct {
+	Direction string `json:"direction"`
+	Peer      string `json:"peer"`
+	Text      string `json:"text"`
+	// Server assigned, used to drop redelivered messages
+	MessageID string    `json:"message_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Outgoing messages only, empty for entries older than receipts
+	Status string `json:"status,omitempty"`
+}
+
+type History []HistoryEntry
+
+func (h *History) Append(direction, peer, message, messageID string) {
+	status := ""
+	if direction == DirectionOutgoing {
+		status = MessageSent
+	}
+	*h = append(*h, HistoryEntry{
+		Direction: direction,
+		Peer:      peer,
+		Text:      message,
+		MessageID: messageID,
+		Timestamp: time.Now(),
+		Status:    status,
+	})
+}
+
+// Advance the status of a message sent to peer. Receipts can arrive out of
+// order, a status is never set back. Returns whether it changed.
+func (h History) SetStatus(peer, messageID, status string) bool {
+	for i := range h {
+		entry := &h[i]
+		if entry.Direction != DirectionOutgoing || entry.MessageID != messageID || entry.Peer != peer {
+			continue
+		}
+		if messageStatusOrder[status] <= messageStatusOrder[entry.Status] {
+			return false
+		}
+		entry.Status = status
+		return true
+	}
+	return false
+}
+
+// Whether an incoming message was already recorded
+func (h History) HasMessage(messageID string) bool {
+	if messageID == "" {
+		return false
+	}
+	for _, entry := range h {
+		if entry.Direction == DirectionIncoming && entry.MessageID == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+func SaveHistory(history *History, filename string) error {
+	// Marshal the history to JSON
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	// Write the data to the file
+	return x3dh_client.WriteFileAtomic(filename, data, 0600)
+}
+
+func LoadHistory(filename string) (*History, error) {
+	// Start empty if there is no history yet
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &History{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unmarshal the data
+	var history History
+	err = json.Unmarshal(data, &history)
+	if err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+func (h History) PrettyPrint() {
+	prettyTitle("=== History ===")
+	if len(h) == 0 {
+		prettyLogInfo("No messages")
+		return
+	}
+
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Time", "", "Contact", "Message", "Status"})
+
+	for _, entry := range h {
+		arrow := "<-"
+		if entry.Direction == DirectionOutgoing {
+			arrow = "->"
+		}
+		t.AppendRow([]interface{}{
+			entry.Timestamp.Format("2006-01-02 15:04"),
+			arrow,
+			entry.Peer,
+			entry.Text,
+			entry.Status,
+		})
+	}
+
+	t.SetStyle(table.StyleColoredBright)
+	t.Style().Format.Header = text.FormatDefault
+	t.Render()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ================================== PROFILE LOCK ===========================
+// Exclusive lock held for as long as a client runs on a profile, so two
+// processes never read and write the same keys and OTP counter.
+type ProfileLock struct {
+	file *os.File
+}
+
+func AcquireProfileLock(path string) (*ProfileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("profile is in use by another process")
+	}
+	// Record owner for debugging
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return &ProfileLock{
+		file: file,
+	}, nil
+}
+
+func (l *ProfileLock) Release() error {
+	err := unlockFile(l.file)
+	l.file.Close()
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Without flock a marker file is used instead. A crashed client leaves the
+// marker behind, and it has to be removed by hand.
+func lockFile(file *os.File) error {
+	marker, err := os.OpenFile(file.Name()+".held", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.New("lock held")
+	}
+	return marker.Close()
+}
+
+func unlockFile(file *os.File) error {
+	return os.Remove(file.Name() + ".held")
+}
@@ -1,28 +1,68 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/jedib0t/go-pretty/table"
 	"github.com/jedib0t/go-pretty/text"
+	"go.step.sm/crypto/x25519"
 	e2ee_api "tux.tech/e2ee/api"
 	x3dh_client "tux.tech/x3dh/client"
 	x3dh_core "tux.tech/x3dh/core"
 )
 
 // ================================== CONFIG ===========================
-var url = "wss://localhost:8765/ws"
-var contacts_filename = "contacts.json"
+// Set from the selected profile (see UseProfile)
+var url string
+var ca_cert_filename string
+var contacts_filename string
 var secrets_filename string
+var history_filename string
+
+// Receive messages pushed by the server (see UseProfile)
+var push_messages bool
+
+// Presence visibility of this profile (see UseProfile)
+var presence_visibility string
+var share_last_seen bool
+
+// Profile in use, for settings changed from the menu
+var active_profile *Profile
+
+// Guards key-changing operations on the client and writes of its state
+var clientMu sync.Mutex
+
+// Guards the history, written by the menu and by pushed messages
+var historyMu sync.Mutex
+
+// Serializes writes to the connection (gorilla allows one writer at a time)
+var wsWriteMu sync.Mutex
+
+// One OTP upload at a time, see APIUploadNewOTPs
+var otpUploadMu sync.Mutex
+
+const receiveBatchSize = 50
+
+// Negotiated with the server when connecting, see APIHello
+var serverHello e2ee_api.ResponseHello
+
+// Sent in hello for the server log
+const clientName = "e2ee_client"
 
 // ================================== PRETTY PRINT ===========================
 func prettyAskString(question string) string {
@@ -55,6 +95,15 @@ func prettyTitle(title string) {
 type Contact struct {
 	Username  string
 	PublicKey x3dh_core.X3DHPublicIK
+	// Set for keys pinned on first use (server lookup) until safety numbers are compared
+	Unverified bool `json:",omitempty"`
+}
+
+func (c Contact) VerifiedLabel() string {
+	if c.Unverified {
+		return "No"
+	}
+	return "Yes"
 }
 
 func (c Contact) PrettyPrint() {
@@ -67,6 +116,7 @@ func (c Contact) PrettyPrint() {
 	t.AppendRows([]table.Row{
 		{"Username", c.Username},
 		{"Public Key", base64.StdEncoding.EncodeToString(c.PublicKey.IdentityKey[:])},
+		{"Verified", c.VerifiedLabel()},
 	})
 
 	// Customize table appearance
@@ -83,6 +133,7 @@ func (c Contact) DebugPrint() {
 	fmt.Println("=== Contact ===")
 	fmt.Println("Username:", c.Username)
 	fmt.Println("Public Key:", base64.StdEncoding.EncodeToString(c.PublicKey.IdentityKey[:]))
+	fmt.Println("Verified:", c.VerifiedLabel())
 	fmt.Println("===============")
 }
 
@@ -147,6 +198,80 @@ func (c Contacts) FindContactByUsername(username string) *Contact {
 	return nil
 }
 
+func (c *Contacts) MarkVerified(id int) {
+	(*c)[id].Unverified = false
+}
+
+func (c *Contacts) UpdateIdentityKey(id int, key x25519.PublicKey, unverified bool) {
+	(*c)[id].PublicKey = x3dh_core.X3DHPublicIK{IdentityKey: key}
+	(*c)[id].Unverified = unverified
+}
+
+func (c Contacts) FindContactIDByUsername(username string) int {
+	for i, contact := range c {
+		if contact.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returned when the server holds a different identity key than the pinned one
+type IdentityChangedError struct {
+	Username       string
+	NewIdentityKey x25519.PublicKey
+}
+
+func (e *IdentityChangedError) Error() string {
+	return "identity key of " + e.Username + " does not match the pinned key"
+}
+
+// Returned when the server answers a request with an error
+type APIError struct {
+	Code    string
+	Message string
+	// The same request may succeed later
+	Retryable bool
+}
+
+func (e *APIError) Error() string {
+	switch e.Code {
+	case e2ee_api.ErrCodeRecipientNotFound:
+		return "recipient is not registered"
+	case e2ee_api.ErrCodeQueueFull:
+		return "recipient has too many pending messages, try again later"
+	case e2ee_api.ErrCodeMessageTooLarge:
+		return "message is too large"
+	case e2ee_api.ErrCodeInvalidBundle:
+		return "server rejected the key bundle signature"
+	case e2ee_api.ErrCodeIdentityTaken:
+		return "the server has a different identity key for this user, an identity reset is required"
+	case e2ee_api.ErrCodeInvalidRotation:
+		return "server rejected the identity change"
+	case e2ee_api.ErrCodeInvalidPassword:
+		return "wrong password"
+	case e2ee_api.ErrCodeNotConfirmed:
+		return "confirmation does not match the username"
+	case e2ee_api.ErrCodeInvalidRequest:
+		return "server could not parse the request"
+	case e2ee_api.ErrCodeUnknownMethod:
+		return "server does not support this request"
+	case e2ee_api.ErrCodeHelloRequired:
+		return "server expected a handshake first"
+	case e2ee_api.ErrCodeRateLimited:
+		return "too many requests, try again later"
+	case e2ee_api.ErrCodeShuttingDown:
+		return "server is shutting down, reconnect later"
+	case e2ee_api.ErrCodeIncompatible:
+		return "client is not compatible with the server: " + e.Message
+	default:
+		if e.Message != "" {
+			return "server error (" + e.Code + "): " + e.Message
+		}
+		return "server error (" + e.Code + ")"
+	}
+}
+
 func InitContacts() *Contacts {
 	return &Contacts{}
 }
@@ -158,7 +283,7 @@ func SaveContacts(contacts *Contacts, filename string) error {
 		return err
 	}
 	// Write the data to the file
-	err = os.WriteFile(filename, data, 0644)
+	err = x3dh_client.WriteFileAtomic(filename, data, 0644)
 	if err != nil {
 		return err
 	}
@@ -190,6 +315,28 @@ func GetMyContact(client *x3dh_client.X3DHClient) Contact {
 	}
 }
 
+// Safety number shared by two identity keys. Both sides compute the same digits,
+// so users can compare them in person or over a trusted channel.
+func SafetyNumber(a, b x25519.PublicKey) string {
+	// Order keys so both sides hash the same input
+	first, second := a, b
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	data := []byte{}
+	data = append(data, first[:]...)
+	data = append(data, second[:]...)
+	digest := sha512.Sum512(data)
+	// 12 groups of 5 digits, each taken from 5 bytes of the digest
+	groups := make([]string, 0, 12)
+	for i := 0; i < 12; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], digest[i*5:i*5+5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
 // ================================== CLIENT MANAGER ===========================
 func GetMyClient() (*x3dh_client.X3DHClient, error) {
 	// Check if secrets file exists
@@ -247,6 +394,13 @@ func GetMyContacts() (*Contacts, error) {
 }
 
 func SaveMyClient(client *x3dh_client.X3DHClient) error {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return saveMyClientLocked(client)
+}
+
+// Caller must hold clientMu
+func saveMyClientLocked(client *x3dh_client.X3DHClient) error {
 	// Save secrets to file
 	//fmt.Println("Saved client")
 	err := client.SaveClient(secrets_filename)
@@ -256,6 +410,15 @@ func SaveMyClient(client *x3dh_client.X3DHClient) error {
 	return nil
 }
 
+func SaveMyHistory(history *History) error {
+	// Save history to file
+	err := SaveHistory(history, history_filename)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func SaveMyContacts(contacts *Contacts) error {
 	// Save contacts to file
 	//fmt.Println("Saved contacts")
@@ -293,13 +456,15 @@ func MenuListContacts(contacts *Contacts) {
 
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"#", "Username", "Public Key"})
+	t.AppendHeader(table.Row{"#", "Username", "Public Key", "Verified", "Presence"})
 
 	for i, contact := range *contacts {
 		t.AppendRow([]interface{}{
 			i,
 			contact.Username,
 			base64.StdEncoding.EncodeToString(contact.PublicKey.IdentityKey[:]),
+			contact.VerifiedLabel(),
+			contactPresence.Label(contact.Username),
 		})
 	}
 
@@ -311,14 +476,58 @@ func MenuListContacts(contacts *Contacts) {
 
 }
 
-func MenuAddContact(client *x3dh_client.X3DHClient, contacts *Contacts) {
-	// Read contact from file
-	filename := prettyAskString("Enter contact file: ")
-
-	contact, err := ImportContactFromFile(filename)
-	if err != nil {
-		prettyLogRisky("Could not import contact from file")
-		//fmt.Println("Could not import contact from file:", err)
+func MenuAddContact(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.Conn) {
+	// Select source
+	var contact *Contact
+	var err error
+	source := prettyAskInt("Add contact from (1) file, (2) username or (3) contact card: ")
+	switch source {
+	case 1:
+		// Read contact from file
+		filename := prettyAskString("Enter contact file: ")
+
+		contact, err = ImportContactFromFile(filename)
+		if err != nil {
+			prettyLogRisky("Could not import contact from file")
+			//fmt.Println("Could not import contact from file:", err)
+			return
+		}
+		// Keys exchanged out of band are trusted
+		contact.Unverified = false
+	case 2:
+		// Look up contact on the server
+		username := prettyAskString("Enter username: ")
+		if existing := contacts.FindContactByUsername(username); existing != nil {
+			prettyLogRisky("Contact with that username already exists")
+			return
+		}
+		contact, err = APILookupUser(client, c, username)
+		if err != nil {
+			prettyLogRisky("Could not look up user " + username)
+			//fmt.Println("Could not look up user:", err)
+			return
+		}
+		// Pin key on first use, but flag it until safety numbers are compared
+		contact.Unverified = true
+		prettyLogRisky("Key pinned but not verified. Compare safety numbers with " + username + " (Verify Contact)")
+	case 3:
+		// Parse pasted contact card
+		uri := prettyAskString("Paste contact card: ")
+		var server string
+		contact, server, err = ParseContactCard(uri)
+		if err != nil {
+			prettyLogRisky("Could not import contact card")
+			//fmt.Println("Could not import contact card:", err)
+			return
+		}
+		if server != "" && server != url {
+			prettyLogRisky("Contact card was issued for a different server: " + server)
+		}
+		// Anyone can hand out a card, so it only pins the key like a lookup
+		contact.Unverified = true
+		prettyLogRisky("Key pinned but not verified. Compare safety numbers with " + contact.Username + " (Verify Contact)")
+	default:
+		prettyLogRisky("Invalid choice")
 		return
 	}
 	// Add contact to contacts
@@ -339,6 +548,144 @@ func MenuAddContact(client *x3dh_client.X3DHClient, contacts *Contacts) {
 	//fmt.Println("Contact added")
 }
 
+func MenuVerifyContact(client *x3dh_client.X3DHClient, contacts *Contacts) {
+	// Select contact
+	id := prettyAskInt("Enter contact id: ")
+	if id < 0 || id >= len(*contacts) {
+		prettyLogRisky("Invalid contact id")
+		return
+	}
+	contact := contacts.GetContact(id)
+	// Show safety number
+	prettyTitle("=== Safety Number ===")
+	fmt.Println(SafetyNumber(client.IdentityKey.IdentityKey.PublicKey, contact.PublicKey.IdentityKey))
+	prettyLogInfo("Compare this number with " + contact.Username + " in person or over a trusted channel")
+	// Confirmation
+	confirm := prettyAskString("Enter 'yes' if the numbers match: ")
+	if confirm != "yes" {
+		prettyLogRisky("Contact not verified")
+		return
+	}
+	contacts.MarkVerified(id)
+	// Save contacts
+	err := SaveMyContacts(contacts)
+	if err != nil {
+		prettyLogRisky("Could not save contacts")
+		return
+	}
+	prettyLogInfo("Contact verified")
+}
+
+// Decide whether to move a contact to a new identity key. Signed rotations from
+// the pinned key are followed automatically, anything else needs the user.
+func MenuReviewIdentityChange(c *websocket.Conn, contacts *Contacts, id int, newKey x25519.PublicKey) bool {
+	contact := contacts.GetContact(id)
+	// Follow signed continuity statements
+	rotations, err := APIIdentityHistory(c, contact.Username)
+	if err != nil {
+		prettyLogRisky("Could not get identity history of " + contact.Username)
+		return false
+	}
+	reached := x3dh_core.FollowIdentityRotations(contact.PublicKey.IdentityKey, rotations)
+	if reached.Equal(newKey) {
+		contacts.UpdateIdentityKey(id, newKey, contact.Unverified)
+		err = SaveMyContacts(contacts)
+		if err != nil {
+			prettyLogRisky("Could not save contacts")
+			return false
+		}
+		prettyLogInfo(contact.Username + " rotated their identity key (signed by the previous key). Pinned key updated.")
+		return true
+	}
+	// No signed path from the pinned key
+	prettyLogRisky("The identity key of " + contact.Username + " changed WITHOUT a signature from the key you pinned.")
+	prettyLogRisky("This happens after an identity reset, or if someone is impersonating " + contact.Username + ".")
+	fmt.Println("New key:", base64.StdEncoding.EncodeToString(newKey[:]))
+	confirm := prettyAskString("Enter 'yes' to trust the new key (it will be marked unverified): ")
+	if confirm != "yes" {
+		prettyLogInfo("Pinned key kept")
+		return false
+	}
+	contacts.UpdateIdentityKey(id, newKey, true)
+	err = SaveMyContacts(contacts)
+	if err != nil {
+		prettyLogRisky("Could not save contacts")
+		return false
+	}
+	prettyLogRisky("New key pinned. Compare safety numbers with " + contact.Username + " (Verify Contact)")
+	return true
+}
+
+func MenuRotateIdentity(client *x3dh_client.X3DHClient, c *websocket.Conn) {
+	prettyLogInfo("Rotate: your current identity key signs the new one, contacts follow automatically.")
+	prettyLogInfo("Reset: the new key is not signed (use if the current key is compromised), contacts must re-verify.")
+	mode := prettyAskInt("(1) Rotate or (2) Reset identity key: ")
+	if mode != 1 && mode != 2 {
+		prettyLogRisky("Invalid choice")
+		return
+	}
+	confirm := prettyAskString("Enter 'yes' to replace your identity key: ")
+	if confirm != "yes" {
+		prettyLogInfo("Identity key not changed")
+		return
+	}
+	// Without a signature the server asks for the account password instead
+	password := ""
+	if mode == 2 {
+		password = prettyAskString("Enter password: ")
+	}
+	// Replace keys locally and save before telling the server
+	clientMu.Lock()
+	err := client.RotateIdentity(mode == 1)
+	if err == nil {
+		err = saveMyClientLocked(client)
+	}
+	clientMu.Unlock()
+	if err != nil {
+		prettyLogRisky("Could not generate new identity key")
+		return
+	}
+	// Upload
+	success, err := APIRotateIdentity(client, c, password)
+	var refused *APIError
+	if errors.As(err, &refused) {
+		prettyLogRisky("Could not upload new identity: " + refused.Error() + ". It will be retried on the next connection.")
+		return
+	}
+	if err != nil || !success {
+		prettyLogRisky("Could not upload new identity. It will be retried on the next connection.")
+		return
+	}
+	prettyLogInfo("Identity key changed")
+	// Show the new key
+	GetMyContact(client).PrettyPrint()
+}
+
+// Returns true if the account is gone and the session is over
+func MenuDeleteAccount(client *x3dh_client.X3DHClient, c *websocket.Conn) bool {
+	prettyLogRisky("Deleting your account removes your keys, identity history and pending messages from the server.")
+	prettyLogRisky("Contacts are told your identity is gone. The username can be registered again by anyone.")
+	confirm := prettyAskString("Enter your username to confirm: ")
+	if confirm != client.Username {
+		prettyLogInfo("Account not deleted")
+		return false
+	}
+	password := prettyAskString("Enter password: ")
+	success, err := APIDeleteAccount(c, password, confirm)
+	var refused *APIError
+	if errors.As(err, &refused) {
+		prettyLogRisky("Could not delete account: " + refused.Error())
+		return false
+	}
+	if err != nil || !success {
+		prettyLogRisky("Could not delete account")
+		return false
+	}
+	prettyLogInfo("Account deleted. The server closed the connection.")
+	prettyLogInfo("Local keys, contacts and history are kept, remove them with -delete-profile <name>.")
+	return true
+}
+
 func MenuRemoveContact(contacts *Contacts) {
 	// Read contact id
 	fmt.Println("Enter contact id:")
@@ -365,15 +712,31 @@ func MenuRemoveContact(contacts *Contacts) {
 	fmt.Println("Contact removed")
 }
 
-func MenuChat(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.Conn) {
+func MenuChat(client *x3dh_client.X3DHClient, contacts *Contacts, history *History, c *websocket.Conn) {
 	// Select contact
 	id := prettyAskInt("Enter contact id: ")
 
 	contact := contacts.GetContact(id)
-	// Write message
+	// Write message, the contact sees that we are typing meanwhile
+	stopTyping := StartTyping(client, c, contact)
 	message := prettyAskString("Enter message: ")
+	stopTyping()
 	// Send message
-	success, err := APISendMessage(client, c, contact, []byte(message))
+	messageID, success, err := APISendMessage(client, c, contact, []byte(message))
+	var changed *IdentityChangedError
+	if errors.As(err, &changed) {
+		// Contact changed identity key, follow it or ask the user
+		if !MenuReviewIdentityChange(c, contacts, id, changed.NewIdentityKey) {
+			return
+		}
+		contact = contacts.GetContact(id)
+		messageID, success, err = APISendMessage(client, c, contact, []byte(message))
+	}
+	var refused *APIError
+	if errors.As(err, &refused) {
+		prettyLogRisky("Could not send message: " + refused.Error())
+		return
+	}
 	if err != nil {
 		prettyLogRisky("Could not send message")
 		return
@@ -384,6 +747,14 @@ func MenuChat(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.C
 	}
 	// Success
 	prettyLogInfo("Message sent")
+	// Record in history
+	historyMu.Lock()
+	history.Append(DirectionOutgoing, contact.Username, message, messageID)
+	err = SaveMyHistory(history)
+	historyMu.Unlock()
+	if err != nil {
+		prettyLogRisky("Could not save history")
+	}
 }
 
 func MenuShareMyContact(client *x3dh_client.X3DHClient) {
@@ -391,68 +762,147 @@ func MenuShareMyContact(client *x3dh_client.X3DHClient) {
 	contact := GetMyContact(client)
 	// Pretty print my contact
 	contact.PrettyPrint()
+	// Show my contact card
+	prettyTitle("=== Contact Card ===")
+	fmt.Println(contact.ContactCardURI(url))
+	contact.PrintContactCardQR(url)
 	// Export my contact to file
-	err := contact.ExportToFile("MyContact.json")
+	filename := active_profile.MyContactPath()
+	err := contact.ExportToFile(filename)
 	if err != nil {
 		prettyLogRisky("Could not export contact to file")
 		return
 	}
-	prettyLogInfo("Contact exported to MyContact.json")
+	prettyLogInfo("Contact exported to " + filename)
 }
 
-func MenuReceiveMessages(client *x3dh_client.X3DHClient, c *websocket.Conn, contacts *Contacts) {
+func MenuReceiveMessages(client *x3dh_client.X3DHClient, c *websocket.Conn, contacts *Contacts, history *History) {
+	cursor := ""
 	for {
-		// Receive message
-		message, sender, err := APIReceiveMessage(client, c)
+		// Receive a batch of messages
+		batch, err := APIReceiveMessages(c, cursor, receiveBatchSize)
 		if err != nil {
-			prettyLogRisky("Could not receive message")
-			//fmt.Println("Could not receive message:", err)
+			prettyLogRisky("Could not receive messages")
+			//fmt.Println("Could not receive messages:", err)
 			return
 		}
-		if message == nil {
+		for _, received := range batch.Messages {
+			HandleQueuedMessage(client, c, contacts, history, received)
+		}
+		// Messages that could not be saved stay queued, the cursor skips them
+		cursor = batch.Cursor
+		if !batch.More {
 			prettyLogInfo("No more messages")
+			ForgetRetiredIdentities(client, c)
 			return
 		}
-		// Get contact
-		contact := contacts.FindContactByUsername(sender)
-		if contact == nil {
-			prettyLogRisky("Be cautious, the following message is from an unknown contact: " + sender)
-			//fmt.Println("The following message is from an unknown contact: ", sender)
-		}
-		// Decrypt message
-		plaintext, err := client.RecieveMessage(message)
-		if err != nil {
-			prettyLogRisky("Failed to decrypt message from: " + sender)
-			// Continue to next message
-			continue
-		}
-		// Print message
-		/*
-			fmt.Println("=== Message ===")
-			fmt.Println("Sender:", sender)
-			fmt.Println("Message:", string(plaintext))
-			fmt.Println("===============")
-			fmt.Println()*/
-		// Create and configure the table writer
-		t := table.NewWriter()
-		t.SetOutputMirror(os.Stdout)
-
-		// Add rows to the table
-		t.AppendRows([]table.Row{
-			{"Sender", sender},
-			{"Message", string(plaintext)},
-		})
+	}
+}
 
-		// Customize table appearance
-		t.SetStyle(table.StyleColoredBright)
-		t.Style().Format.Header = text.FormatDefault
-		t.Style().Options.SeparateRows = true
-		t.Style().Options.SeparateColumns = false
+// Drop the keys of identities replaced by a rotation once the server confirmed
+// it and no message is left in the queue, those could still be encrypted for them
+func ForgetRetiredIdentities(client *x3dh_client.X3DHClient, c *websocket.Conn) {
+	clientMu.Lock()
+	retired := len(client.RetiredIdentities) > 0 && client.PendingRotation == nil
+	clientMu.Unlock()
+	if !retired {
+		return
+	}
+	batch, err := APIReceiveMessages(c, "", 1)
+	if err != nil || len(batch.Messages) > 0 {
+		return
+	}
+	// Queued messages are decrypted while holding historyMu
+	historyMu.Lock()
+	clientMu.Lock()
+	dropped := client.ForgetRetiredIdentities()
+	err = saveMyClientLocked(client)
+	clientMu.Unlock()
+	historyMu.Unlock()
+	if err != nil {
+		prettyLogRisky("Could not save client")
+		return
+	}
+	prettyLogInfo(fmt.Sprint("Message queue drained, removed the keys of ", dropped, " previous identities"))
+}
 
-		// Print the title and render the table
-		prettyTitle("=== Message ===")
-		t.Render()
-		fmt.Println()
+// Decrypt, show and record a queued message, then acknowledge it.
+// Called from the menu and for pushed messages.
+func HandleQueuedMessage(client *x3dh_client.X3DHClient, c *websocket.Conn, contacts *Contacts, history *History, received e2ee_api.QueuedMessage) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	message, sender := &received.MessageData, received.SenderID
+	// Redelivered after a lost ack, already shown and saved
+	if history.HasMessage(received.MessageID) {
+		ackReceivedMessage(c, received.MessageID)
+		return
+	}
+	// Get contact
+	contact := contacts.FindContactByUsername(sender)
+	if contact == nil {
+		prettyLogRisky("Be cautious, the following message is from an unknown contact: " + sender)
+		//fmt.Println("The following message is from an unknown contact: ", sender)
+	} else if contact.Unverified {
+		prettyLogRisky("The following message is from an unverified contact: " + sender)
+	}
+	// Sent, no longer typing
+	contactTyping.set(sender, false)
+	// Decrypt message
+	plaintext, err := client.RecieveMessage(message)
+	if err != nil {
+		prettyLogRisky("Failed to decrypt message from: " + sender)
+		// Will never decrypt, drop it
+		ackReceivedMessage(c, received.MessageID)
+		return
+	}
+	// Print message
+	/*
+		fmt.Println("=== Message ===")
+		fmt.Println("Sender:", sender)
+		fmt.Println("Message:", string(plaintext))
+		fmt.Println("===============")
+		fmt.Println()*/
+	// Create and configure the table writer
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+
+	// Add rows to the table
+	t.AppendRows([]table.Row{
+		{"Sender", sender},
+		{"Message", string(plaintext)},
+	})
+
+	// Customize table appearance
+	t.SetStyle(table.StyleColoredBright)
+	t.Style().Format.Header = text.FormatDefault
+	t.Style().Options.SeparateRows = true
+	t.Style().Options.SeparateColumns = false
+
+	// Print the title and render the table
+	prettyTitle("=== Message ===")
+	t.Render()
+	fmt.Println()
+	// Record in history, only then let the server drop it
+	history.Append(DirectionIncoming, sender, string(plaintext), received.MessageID)
+	err = SaveMyHistory(history)
+	if err != nil {
+		prettyLogRisky("Could not save history, message stays queued on the server")
+		return
+	}
+	ackReceivedMessage(c, received.MessageID)
+	// Shown, so read. Unknown senders are not told.
+	if contact != nil {
+		if err := APISendReadReceipt(client, c, *contact, received.MessageID); err != nil {
+			prettyLogRisky("Could not send read receipt")
+		}
+	}
+}
+
+// Acknowledge a handled message so it is not delivered again
+func ackReceivedMessage(c *websocket.Conn, messageID string) {
+	err := APIAckMessage(c, messageID)
+	if err != nil {
+		prettyLogRisky("Could not acknowledge message")
 	}
 }
 
@@ -470,12 +920,24 @@ func MenuHelp() {
 	fmt.Println()
 	fmt.Printf("=== Menu Options ===\n")
 	fmt.Println("List Contacts: List all contacts")
-	fmt.Println("Add Contact: Add a new contact")
+	fmt.Println("Add Contact: Add a new contact from a file, by username or from a contact card")
 	fmt.Println("Remove Contact: Remove a contact")
-	fmt.Println("Send Message: Send a message to a contact")
+	fmt.Println("Send Message: Send a message to a contact, who sees that I am typing meanwhile")
 	fmt.Println("Receive Messages: Receive all messages")
-	fmt.Println("Share My Contact: Export my contact to a file")
+	fmt.Println("Share My Contact: Show my contact card and QR code, and export my contact to a file")
+	fmt.Println("Verify Contact: Compare safety numbers with a contact")
+	fmt.Println("History: Show sent and received messages, and whether sent ones were delivered and read")
+	fmt.Println("Rotate Identity: Replace my identity key (signed rotation or unsigned reset)")
+	fmt.Println("Delete Account: Delete my account and everything the server stores for it")
+	fmt.Println("Presence Settings: Choose who sees when I am online and when I was last seen")
+	fmt.Println("Help: Show this help")
 	fmt.Println("Exit: Exit the program")
+
+	fmt.Println()
+	fmt.Printf("=== Profiles ===\n")
+	fmt.Println("Each profile keeps its own keys, contacts, history and server settings.")
+	fmt.Println("Start with -profile <name> to skip the profile menu,")
+	fmt.Println("-list-profiles to list profiles and -delete-profile <name> to delete one.")
 }
 
 // ================================== User Interface ===========================
@@ -494,8 +956,13 @@ func showMenu() {
 		{4, "Send Message"},
 		{5, "Receive Messages"},
 		{6, "Share My Contact"},
-		{7, "Help"},
-		{8, "Exit"},
+		{7, "Verify Contact"},
+		{8, "History"},
+		{9, "Rotate Identity"},
+		{10, "Delete Account"},
+		{11, "Presence Settings"},
+		{12, "Help"},
+		{13, "Exit"},
 	}
 
 	for _, menuItem := range menuItems {
@@ -510,7 +977,7 @@ func showMenu() {
 	t.Render()
 }
 
-func Menu(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.Conn) {
+func Menu(client *x3dh_client.X3DHClient, contacts *Contacts, history *History, c *websocket.Conn) {
 	for {
 		showMenu()
 		choice := prettyAskInt("Enter choice: ")
@@ -521,18 +988,34 @@ func Menu(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.Conn)
 		case 1:
 			MenuListContacts(contacts)
 		case 2:
-			MenuAddContact(client, contacts)
+			MenuAddContact(client, contacts, c)
+			syncPresenceAfterContactChange(c, contacts)
 		case 3:
 			MenuRemoveContact(contacts)
+			syncPresenceAfterContactChange(c, contacts)
 		case 4:
-			MenuChat(client, contacts, c)
+			MenuChat(client, contacts, history, c)
 		case 5:
-			MenuReceiveMessages(client, c, contacts)
+			MenuReceiveMessages(client, c, contacts, history)
 		case 6:
 			MenuShareMyContact(client)
 		case 7:
-			MenuHelp()
+			MenuVerifyContact(client, contacts)
 		case 8:
+			historyMu.Lock()
+			history.PrettyPrint()
+			historyMu.Unlock()
+		case 9:
+			MenuRotateIdentity(client, c)
+		case 10:
+			if MenuDeleteAccount(client, c) {
+				return
+			}
+		case 11:
+			MenuPresenceSettings(c, contacts)
+		case 12:
+			MenuHelp()
+		case 13:
 			fmt.Println("Exit")
 			return
 		default:
@@ -541,33 +1024,69 @@ func Menu(client *x3dh_client.X3DHClient, contacts *Contacts, c *websocket.Conn)
 	}
 }
 
+// Watch added contacts and share presence with them
+func syncPresenceAfterContactChange(c *websocket.Conn, contacts *Contacts) {
+	if err := SyncPresence(c, contacts); err != nil {
+		prettyLogRisky("Could not update presence of contacts: " + err.Error())
+	}
+}
+
 // ================================== API CALLS ===========================
-func sendAndAwaitWsResponse(c *websocket.Conn, params interface{}, method string) (json.RawMessage, error) {
+// Send a request without waiting for a response
+func writeWsRequest(c *websocket.Conn, params interface{}, method string) error {
+	return writeWsMessage(c, "", params, method)
+}
+
+func writeWsMessage(c *websocket.Conn, id string, params interface{}, method string) error {
 	// Marshal params
 	marshalledParams, err := json.Marshal(params)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	// Build API call
 	api_call := &e2ee_api.InboundMessage{
+		ID:     id,
 		Method: method,
 		Params: marshalledParams,
 	}
 	// Marshal
 	data, err := json.Marshal(api_call)
+	if err != nil {
+		return err
+	}
+	// Send request
+	wsWriteMu.Lock()
+	defer wsWriteMu.Unlock()
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+// Send a request and wait for the response with its ID. Safe to call from
+// several goroutines at once.
+func sendAndAwaitWsResponse(c *websocket.Conn, params interface{}, method string) (json.RawMessage, error) {
+	id, waiting, err := pending.add()
 	if err != nil {
 		return nil, err
 	}
 	// Send request
-	err = c.WriteMessage(websocket.TextMessage, data)
+	err = writeWsMessage(c, id, params, method)
+	if err != nil {
+		pending.remove(id)
+		return nil, err
+	}
+	// Await response from server (routed by ReadIncomingMessages)
+	response, err := pending.await(id, waiting)
 	if err != nil {
 		return nil, err
 	}
-	// Await response from server
-	// (message is in channel incomingResponses)
-	response := <-incomingResponses
 
 	// Check for success
+	if response.Error != nil {
+		return nil, &APIError{
+			Code:      response.Error.Code,
+			Message:   response.Error.Message,
+			Retryable: response.Error.Retryable,
+		}
+	}
 	if response.Method != method {
 		fmt.Println("Received wrong method. Expected:", method, "Received:", response.Method)
 		return nil, fmt.Errorf("received wrong method")
@@ -628,7 +1147,10 @@ func APIGetBundle(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Con
 	}
 	// Validate bundle
 	if !params_response.Bundle.IK.IdentityKey.Equal(contact.PublicKey.IdentityKey) {
-		return nil, fmt.Errorf("bundle identity key does not match contact public key")
+		return nil, &IdentityChangedError{
+			Username:       contact.Username,
+			NewIdentityKey: params_response.Bundle.IK.IdentityKey,
+		}
 	}
 	if !params_response.Bundle.Validate() {
 		return nil, fmt.Errorf("failed to validate bundle")
@@ -637,16 +1159,141 @@ func APIGetBundle(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Con
 	return &params_response.Bundle, nil
 }
 
-func APISendMessage(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Contact, message []byte) (bool, error) {
+func APILookupUser(client *x3dh_client.X3DHClient, c *websocket.Conn, username string) (*Contact, error) {
+	// Build API call
+	params := &e2ee_api.RequestLookupUser{
+		UserID: username,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "lookup_user")
+	if err != nil {
+		return nil, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseLookupUser{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return nil, err
+	}
+	// Success
+	if !params_response.Success {
+		return nil, fmt.Errorf("user not found")
+	}
+	// Return contact
+	return &Contact{
+		Username:  params_response.UserID,
+		PublicKey: params_response.IdentityKey,
+	}, nil
+}
+
+func APIIdentityHistory(c *websocket.Conn, username string) ([]x3dh_core.X3DHIdentityRotation, error) {
+	// Build API call
+	params := &e2ee_api.RequestIdentityHistory{
+		UserID: username,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "identity_history")
+	if err != nil {
+		return nil, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseIdentityHistory{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return nil, err
+	}
+	// Success
+	if !params_response.Success {
+		return nil, fmt.Errorf("user not found")
+	}
+	return params_response.Rotations, nil
+}
+
+// Upload the pending identity change of the client
+// The password is only checked for unsigned resets
+func APIRotateIdentity(client *x3dh_client.X3DHClient, c *websocket.Conn, password string) (bool, error) {
+	// Fresh OTPs for the new identity, saved before upload
+	clientMu.Lock()
+	rotation := client.PendingRotation
+	if rotation == nil {
+		clientMu.Unlock()
+		return false, fmt.Errorf("no pending identity change")
+	}
+	bundle, err := client.GetRotationBundle(5)
+	if err == nil {
+		err = saveMyClientLocked(client)
+	}
+	clientMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	// Build API call
+	params := &e2ee_api.RequestRotateIdentity{
+		Bundle:   *bundle,
+		Rotation: *rotation,
+	}
+	if !rotation.IsSigned() {
+		params.Password = password
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "rotate_identity")
+	if err != nil {
+		return false, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseRotateIdentity{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return false, err
+	}
+	if !params_response.Success {
+		return false, nil
+	}
+	// Confirmed by the server
+	clientMu.Lock()
+	client.ClearPendingRotation()
+	err = saveMyClientLocked(client)
+	clientMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func APIDeleteAccount(c *websocket.Conn, password string, confirmUsername string) (bool, error) {
+	// Build API call
+	params := &e2ee_api.RequestDeleteAccount{
+		Password:        password,
+		ConfirmUsername: confirmUsername,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "delete_account")
+	if err != nil {
+		return false, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseDeleteAccount{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return false, err
+	}
+	return params_response.Success, nil
+}
+
+func APISendMessage(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Contact, message []byte) (string, bool, error) {
 	// Get contact bundle
 	bundle, err := APIGetBundle(client, c, contact)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 	// Encrypt message
 	x3dhMessage, err := client.BuildMessage(bundle, message)
 	if err != nil {
-		return false, err
+		return "", false, err
+	}
+	// The server would refuse it
+	if limit := serverHello.Limits.MaxMessageSize; limit > 0 && x3dhMessage.Size() > limit {
+		return "", false, &APIError{Code: e2ee_api.ErrCodeMessageTooLarge}
 	}
 	// Build API call
 	params := &e2ee_api.RequestSendMsg{
@@ -656,36 +1303,70 @@ func APISendMessage(client *x3dh_client.X3DHClient, c *websocket.Conn, contact C
 	// Send And Await Response
 	response, err := sendAndAwaitWsResponse(c, params, "send_message")
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 	// Parse params
 	params_response := &e2ee_api.ResponseSendMsg{}
 	err = json.Unmarshal(response, params_response)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 	// Return status
-	return params_response.Success, nil
+	return params_response.MessageID, params_response.Success, nil
 }
 
-func APIReceiveMessage(client *x3dh_client.X3DHClient, c *websocket.Conn) (*x3dh_core.InitialMessage, string, error) {
+// Next batch of queued messages after cursor (from the start if empty).
+// The server keeps them until they are acknowledged with APIAckMessage.
+func APIReceiveMessages(c *websocket.Conn, cursor string, limit int) (*e2ee_api.ResponseReceiveMsgs, error) {
+	// Build API call
+	params := &e2ee_api.RequestReceiveMsgs{
+		AfterID: cursor,
+		Limit:   limit,
+	}
 	// Send And Await Response
-	response, err := sendAndAwaitWsResponse(c, e2ee_api.RequestReceiveMsg{}, "receive_message")
+	response, err := sendAndAwaitWsResponse(c, params, "receive_messages")
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	// Parse params
-	params_response := &e2ee_api.ResponseReceiveMsg{}
+	params_response := &e2ee_api.ResponseReceiveMsgs{}
 	err = json.Unmarshal(response, params_response)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
-	// End of queue
 	if !params_response.Success {
-		return nil, "", nil
+		return nil, fmt.Errorf("server could not list messages")
+	}
+	return params_response, nil
+}
+
+// Ask the server to push queued and new messages as notify_message
+func APISubscribeMessages(c *websocket.Conn, push bool) (bool, error) {
+	// Build API call
+	params := &e2ee_api.RequestSubscribeMsgs{
+		Push: push,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "subscribe_messages")
+	if err != nil {
+		return false, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseSubscribeMsgs{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return false, err
 	}
-	// Return message data
-	return &params_response.MessageData, params_response.SenderID, nil
+	return params_response.Success, nil
+}
+
+// Fire-and-forget: the response is dropped by ReadIncomingMessages. A lost ack
+// only means the message is delivered again and skipped by ID.
+func APIAckMessage(c *websocket.Conn, messageID string) error {
+	params := &e2ee_api.RequestAckMsg{
+		MessageID: messageID,
+	}
+	return writeWsRequest(c, params, "ack_message")
 }
 
 func APIGetStatus(client *x3dh_client.X3DHClient, c *websocket.Conn) (bool, error) {
@@ -706,14 +1387,47 @@ func APIGetStatus(client *x3dh_client.X3DHClient, c *websocket.Conn) (bool, erro
 	return params_response.Success, nil
 }
 
+// Negotiate the protocol, must be the first request on a connection
+func APIHello(c *websocket.Conn) (*e2ee_api.ResponseHello, error) {
+	// Build API call
+	params := &e2ee_api.RequestHello{
+		ProtocolVersion:    e2ee_api.ProtocolVersion,
+		MinProtocolVersion: e2ee_api.MinProtocolVersion,
+		CipherSuites:       []string{e2ee_api.CipherSuiteX25519AESGCM},
+		Encodings:          []string{e2ee_api.EncodingJSON},
+		Client:             clientName,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "hello")
+	if err != nil {
+		return nil, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseHello{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return nil, err
+	}
+	if !params_response.Success {
+		return nil, fmt.Errorf("server refused the handshake")
+	}
+	return params_response, nil
+}
+
 // ================================== CONNECTION ===========================
 // Setup channels for incoming messages
-var incomingResponses = make(chan e2ee_api.OutboundMessage)
 var incomingNotifications = make(chan e2ee_api.OutboundMessage)
 
 func ReadIncomingMessages(c *websocket.Conn) {
+	// Requests still waiting will never be answered
+	defer pending.closeAll()
 	for {
 		mt, message, err := c.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			fmt.Println()
+			prettyLogRisky("Server is shutting down, restart the client to reconnect")
+			return
+		}
 		if err != nil {
 			return
 		}
@@ -726,22 +1440,31 @@ func ReadIncomingMessages(c *websocket.Conn) {
 				continue
 			}
 			// Check if message is a notification (Method starts with notify_)
-			if strings.HasPrefix(response.Method, "notify_") {
+			if response.ID == "" && strings.HasPrefix(response.Method, "notify_") {
 				incomingNotifications <- *response
-			} else {
-				incomingResponses <- *response
+			} else if !pending.deliver(*response) {
+				// Requests sent without ID (acks) or timed out
+				continue
 			}
 		}
 	}
 }
 
-func APIUploadNewOTPs(client *x3dh_client.X3DHClient, c *websocket.Conn) (bool, error) {
-	// Get OTPs
+// Generate, save and upload new OTPs and wait for the server to list which
+// were stored. Uploads are serialized so IDs reach the server in order.
+func APIUploadNewOTPs(client *x3dh_client.X3DHClient, c *websocket.Conn) (*e2ee_api.ResponseUploadOTPs, error) {
+	otpUploadMu.Lock()
+	defer otpUploadMu.Unlock()
+	// Get OTPs and save client before they leave this machine
+	// (an OTP on the server without its private key can never be decrypted)
+	clientMu.Lock()
 	otps, err := client.BatchGenerateOTPs(5)
-	// Save client after generating OTPs
-	SaveMyClient(client)
+	if err == nil {
+		err = saveMyClientLocked(client)
+	}
+	clientMu.Unlock()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// Build API call
@@ -749,34 +1472,20 @@ func APIUploadNewOTPs(client *x3dh_client.X3DHClient, c *websocket.Conn) (bool,
 		OTPs: otps,
 	}
 
-	// Marshal params
-	marshalledParams, err := json.Marshal(params)
-	if err != nil {
-		return false, err
-	}
-
-	// Build API call
-	api_call := &e2ee_api.InboundMessage{
-		Method: "upload_new_otps",
-		Params: marshalledParams,
-	}
-
-	// Marshal
-	data, err := json.Marshal(api_call)
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "upload_new_otps")
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	// Send request
-	err = c.WriteMessage(websocket.TextMessage, data)
+	params_response := &e2ee_api.ResponseUploadOTPs{}
+	err = json.Unmarshal(response, params_response)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	return true, nil
+	return params_response, nil
 }
 
-func HandleNotifications(client *x3dh_client.X3DHClient, c *websocket.Conn) {
+func HandleNotifications(client *x3dh_client.X3DHClient, contacts *Contacts, history *History, c *websocket.Conn) {
 	for {
 		// Wait for notification
 		notification := <-incomingNotifications
@@ -785,12 +1494,84 @@ func HandleNotifications(client *x3dh_client.X3DHClient, c *websocket.Conn) {
 		case "notify_low_otp":
 			fmt.Println()
 			prettyLogInfo("Low OTP. Sending more.")
-			APIUploadNewOTPs(client, c)
 			fmt.Println()
+			// Awaits its response, do not block other notifications meanwhile
+			go func() {
+				result, err := APIUploadNewOTPs(client, c)
+				if err != nil {
+					prettyLogRisky("Could not upload new OTPs")
+					return
+				}
+				if len(result.Rejected) > 0 {
+					prettyLogRisky(fmt.Sprint("Server rejected ", len(result.Rejected), " new OTPs"))
+				}
+			}()
 		case "notify_new_message":
 			fmt.Println()
 			prettyLogInfo("<New message pending>")
 			fmt.Println()
+		case "notify_message_expired":
+			params := &e2ee_api.NotifyMessageExpired{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			fmt.Println()
+			prettyLogRisky("<A message to " + params.RecipientID + " expired before it was received>")
+			fmt.Println()
+		case "notify_message":
+			params := &e2ee_api.NotifyMessage{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			fmt.Println()
+			HandleQueuedMessage(client, c, contacts, history, params.QueuedMessage)
+		case "notify_identity_changed":
+			params := &e2ee_api.NotifyIdentityChanged{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			// Only relevant for contacts pinned to the old key
+			contact := contacts.FindContactByUsername(params.UserID)
+			if contact == nil || !contact.PublicKey.IdentityKey.Equal(params.Rotation.OldIdentityKey) {
+				continue
+			}
+			fmt.Println()
+			if params.Rotation.Verify() {
+				prettyLogInfo("<" + params.UserID + " rotated their identity key. It will be followed on the next message.>")
+			} else {
+				prettyLogRisky("<" + params.UserID + " reset their identity key without a signature. You will be asked before the next message.>")
+			}
+			fmt.Println()
+		case "notify_signal":
+			params := &e2ee_api.NotifySignal{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			HandleSignal(client, contacts, params)
+		case "notify_receipt":
+			params := &e2ee_api.NotifyReceipt{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			HandleReceipt(client, contacts, history, params.Receipt)
+		case "notify_presence":
+			params := &e2ee_api.NotifyPresence{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			contactPresence.set(params.Presence)
+		case "notify_identity_deleted":
+			params := &e2ee_api.NotifyIdentityDeleted{}
+			if json.Unmarshal(notification.Params, params) != nil {
+				continue
+			}
+			// Only relevant for contacts
+			if contacts.FindContactByUsername(params.UserID) == nil {
+				continue
+			}
+			fmt.Println()
+			prettyLogRisky("<" + params.UserID + " deleted their account. If the username is registered again it will have a new identity key.>")
+			fmt.Println()
 		default:
 			fmt.Println()
 			prettyLogRisky("Unknown notification")
@@ -799,7 +1580,7 @@ func HandleNotifications(client *x3dh_client.X3DHClient, c *websocket.Conn) {
 	}
 }
 
-func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts) {
+func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts, history *History) {
 	// Set username as header
 	header := http.Header{}
 	header.Add("User", client.Username)
@@ -809,9 +1590,10 @@ func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts) {
 	header.Add("Password", password)
 
 	// Load the server's certificate
-	caCert, err := ioutil.ReadFile("../certs/server.crt")
+	caCert, err := ioutil.ReadFile(ca_cert_filename)
 	if err != nil {
 		fmt.Println("Error reading CA certificate:", err)
+		fmt.Println("Copy the server certificate to", ca_cert_filename, "or set ca_cert_file in", active_profile.ServerSettingsPath())
 		return
 	}
 
@@ -851,8 +1633,22 @@ func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts) {
 		//fmt.Println("Saved client and contacts")
 	}()
 
+	// Negotiate the protocol before anything else
+	hello, err := APIHello(c)
+	var incompatible *APIError
+	if errors.As(err, &incompatible) {
+		prettyLogRisky("Server refused the connection: " + incompatible.Error())
+		return
+	}
+	if err != nil {
+		prettyLogRisky("Handshake with server failed")
+		fmt.Println("Handshake with server failed:", err)
+		return
+	}
+	serverHello = *hello
+
 	// Handle notifications in background
-	go HandleNotifications(client, c)
+	go HandleNotifications(client, contacts, history, c)
 
 	// Check Status
 	success, err := APIGetStatus(client, c)
@@ -865,6 +1661,11 @@ func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts) {
 	if !success {
 		prettyLogInfo("First time setup")
 		success, err := APIUploadBundle(client, c)
+		var refused *APIError
+		if errors.As(err, &refused) {
+			prettyLogRisky("Could not upload bundle: " + refused.Error())
+			return
+		}
 		if err != nil {
 			prettyLogRisky("Could not upload bundle")
 			fmt.Println("Could not upload bundle:", err)
@@ -875,15 +1676,171 @@ func ConnectToServer(client *x3dh_client.X3DHClient, contacts *Contacts) {
 			fmt.Println("Could not upload bundle 2")
 			return
 		}
+	} else if client.PendingRotation != nil {
+		// Finish an identity change interrupted earlier
+		prettyLogInfo("Uploading pending identity change")
+		success, err := APIRotateIdentity(client, c, password)
+		if err != nil || !success {
+			prettyLogRisky("Could not upload pending identity change")
+		}
+	}
+	// Pushed messages are handled with the notifications
+	if push_messages {
+		success, err := APISubscribeMessages(c, true)
+		if err != nil || !success {
+			prettyLogRisky("Could not subscribe to messages, use Receive Messages instead")
+		}
+	}
+	// Keys of previous identities are only needed for messages still queued
+	ForgetRetiredIdentities(client, c)
+	// Status of sent messages is shown in the history
+	err = SyncReceipts(client, c, contacts, history)
+	if err != nil {
+		prettyLogRisky("Could not subscribe to receipts")
+	}
+	// Presence of contacts is shown in the contact list
+	err = SyncPresence(c, contacts)
+	if err != nil {
+		prettyLogRisky("Could not subscribe to presence of contacts")
 	}
 	// Infinite loop for interface
-	Menu(client, contacts, c)
+	Menu(client, contacts, history, c)
+}
+
+// ================================== PROFILE MENU ===========================
+func MenuListProfiles() {
+	names, err := ListProfiles()
+	if err != nil {
+		prettyLogRisky("Could not list profiles: " + err.Error())
+		return
+	}
+	prettyTitle("=== Profiles ===")
+	if len(names) == 0 {
+		prettyLogInfo("No profiles")
+		return
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"#", "Profile"})
+	for i, name := range names {
+		t.AppendRow([]interface{}{i, name})
+	}
+	t.SetStyle(table.StyleColoredBright)
+	t.Render()
+}
+
+func MenuDeleteProfile(name string) {
+	if !ProfileExists(name) {
+		prettyLogRisky("Profile does not exist: " + name)
+		return
+	}
+	// Confirmation
+	prettyLogRisky("Deleting a profile destroys its private keys. Messages sent to it can no longer be read.")
+	confirm := prettyAskString("Enter the profile name to confirm: ")
+	if confirm != name {
+		prettyLogInfo("Profile not deleted")
+		return
+	}
+	err := DeleteProfile(name)
+	if err != nil {
+		prettyLogRisky("Could not delete profile: " + err.Error())
+		return
+	}
+	prettyLogInfo("Profile deleted")
+}
+
+// Pick an existing profile by number or create a new one by name
+func MenuSelectProfile() string {
+	MenuListProfiles()
+	names, _ := ListProfiles()
+	answer := prettyAskString("Enter profile # or a new profile name: ")
+	for i, name := range names {
+		if answer == fmt.Sprint(i) {
+			return name
+		}
+	}
+	return answer
+}
+
+// Point the client at the files of a profile
+func UseProfile(profile *Profile) error {
+	settings, err := profile.LoadServerSettings()
+	if err != nil {
+		return err
+	}
+	copied, err := profile.ImportDefaultCACert(settings)
+	if err != nil {
+		return err
+	}
+	if copied {
+		prettyLogInfo("Server certificate copied to " + profile.CACertPath(settings))
+	}
+	url = settings.URL
+	ca_cert_filename = profile.CACertPath(settings)
+	push_messages = settings.PushMessages
+	presence_visibility = settings.PresenceVisibility
+	share_last_seen = settings.ShareLastSeen
+	active_profile = profile
+	secrets_filename = profile.SecretsPath()
+	contacts_filename = profile.ContactsPath()
+	history_filename = profile.HistoryPath()
+	return nil
 }
 
 // ================================== MAIN ===========================
 func main() {
-	// Select user file
-	secrets_filename = prettyAskString("Enter user file: ")
+	profileName := flag.String("profile", "", "profile to use (created if it does not exist)")
+	listProfiles := flag.Bool("list-profiles", false, "list profiles and exit")
+	deleteProfile := flag.String("delete-profile", "", "delete a profile and exit")
+	pushMessages := flag.Bool("push-messages", false, "have the server push messages to this profile (saved in the profile)")
+	flag.Parse()
+
+	// Profile commands
+	if *listProfiles {
+		MenuListProfiles()
+		return
+	}
+	if *deleteProfile != "" {
+		MenuDeleteProfile(*deleteProfile)
+		return
+	}
+
+	// Select profile
+	name := *profileName
+	if name == "" {
+		name = MenuSelectProfile()
+	}
+	profile, err := OpenProfile(name)
+	if err != nil {
+		prettyLogRisky("Could not open profile: " + err.Error())
+		return
+	}
+
+	// Only one process may use a profile at a time
+	lock, err := AcquireProfileLock(profile.LockPath())
+	if err != nil {
+		prettyLogRisky("Could not lock profile: " + err.Error())
+		return
+	}
+	defer lock.Release()
+
+	// Only change the saved setting if the flag was given
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "push-messages" {
+			err = profile.SetPushMessages(*pushMessages)
+		}
+	})
+	if err != nil {
+		prettyLogRisky("Could not save server settings: " + err.Error())
+		return
+	}
+
+	err = UseProfile(profile)
+	if err != nil {
+		prettyLogRisky("Could not load server settings: " + err.Error())
+		return
+	}
+	prettyLogInfo("Using profile " + profile.Name + " (" + profile.Dir + ")")
 
 	// LOAD CLIENT
 	a, err := GetMyClient()
@@ -897,6 +1854,12 @@ func main() {
 		prettyLogRisky("Failed to load contacts!")
 		return
 	}
+	// LOAD HISTORY
+	h, err := LoadHistory(history_filename)
+	if err != nil {
+		prettyLogRisky("Failed to load history!")
+		return
+	}
 	// Connect to server
-	ConnectToServer(a, c)
+	ConnectToServer(a, c, h)
 }
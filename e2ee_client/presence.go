@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	e2ee_api "tux.tech/e2ee/api"
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+// ================================== PRESENCE ===========================
+// Last known presence of contacts, updated by notify_presence
+type presenceState struct {
+	mu     sync.Mutex
+	byUser map[string]e2ee_api.Presence
+}
+
+var contactPresence = &presenceState{
+	byUser: make(map[string]e2ee_api.Presence),
+}
+
+func (p *presenceState) set(presence e2ee_api.Presence) {
+	p.mu.Lock()
+	p.byUser[presence.UserID] = presence
+	p.mu.Unlock()
+}
+
+// Forget all presence, returns whether any was known
+func (p *presenceState) clear() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := len(p.byUser) > 0
+	clear(p.byUser)
+	return known
+}
+
+// Shown in the contact list
+func (p *presenceState) Label(username string) string {
+	p.mu.Lock()
+	presence, ok := p.byUser[username]
+	p.mu.Unlock()
+	if !ok {
+		return "-"
+	}
+	switch presence.Status {
+	case e2ee_api.StatusOnline:
+		return "online"
+	case e2ee_api.StatusOffline:
+		if presence.LastSeen != nil {
+			return "last seen " + presence.LastSeen.Local().Format(time.DateTime)
+		}
+		return "offline"
+	default:
+		return "hidden"
+	}
+}
+
+// Whether the server knows presence requests (protocol version 2)
+func presenceSupported() bool {
+	return slices.Contains(serverHello.Methods, "subscribe_presence")
+}
+
+func contactUsernames(contacts *Contacts) []string {
+	usernames := make([]string, 0, len(*contacts))
+	for _, contact := range *contacts {
+		usernames = append(usernames, contact.Username)
+	}
+	return usernames
+}
+
+// Contacts are only watched by users that share their own presence, so the
+// server does not learn the contact list of users that left presence off
+func presenceEnabled() bool {
+	return presence_visibility != "" && presence_visibility != x3dh_core.PresenceNobody
+}
+
+// Send the visibility setting of the profile and, if presence is on, watch
+// all contacts. Called on connect and whenever contacts change, the contact
+// list is part of the setting.
+func SyncPresence(c *websocket.Conn, contacts *Contacts) error {
+	if !presenceSupported() {
+		return nil
+	}
+	usernames := contactUsernames(contacts)
+	allowed := []string(nil)
+	if presence_visibility == x3dh_core.PresenceContacts {
+		allowed = usernames
+	}
+	err := APISetPresence(c, presence_visibility, share_last_seen, allowed)
+	if err != nil {
+		return err
+	}
+	if !presenceEnabled() {
+		// Stop watching if presence was just turned off
+		if contactPresence.clear() {
+			_, err = APISubscribePresence(c, nil)
+		}
+		return err
+	}
+	presence, err := APISubscribePresence(c, usernames)
+	if err != nil {
+		return err
+	}
+	for _, p := range presence {
+		contactPresence.set(p)
+	}
+	return nil
+}
+
+func APISetPresence(c *websocket.Conn, visibility string, shareLastSeen bool, allowed []string) error {
+	// Build API call
+	params := &e2ee_api.RequestSetPresence{
+		Visibility:    visibility,
+		ShareLastSeen: shareLastSeen,
+		Contacts:      allowed,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "set_presence")
+	if err != nil {
+		return err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseSetPresence{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return err
+	}
+	if !params_response.Success {
+		return fmt.Errorf("server did not store the presence setting")
+	}
+	return nil
+}
+
+func APISubscribePresence(c *websocket.Conn, usernames []string) ([]e2ee_api.Presence, error) {
+	// Build API call
+	params := &e2ee_api.RequestSubscribePresence{
+		UserIDs: usernames,
+	}
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, params, "subscribe_presence")
+	if err != nil {
+		return nil, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseSubscribePresence{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return nil, err
+	}
+	return params_response.Presence, nil
+}
+
+func MenuPresenceSettings(c *websocket.Conn, contacts *Contacts) {
+	if !presenceSupported() {
+		prettyLogRisky("The server does not support presence")
+		return
+	}
+	fmt.Println("Currently visible to:", presence_visibility, "- share last seen:", share_last_seen)
+	fmt.Println("Contacts are only watched while your own presence is visible to someone")
+	fmt.Println("1. Nobody")
+	fmt.Println("2. Contacts")
+	fmt.Println("3. Everyone")
+	var visibility string
+	switch prettyAskInt("Who may see when you are online: ") {
+	case 1:
+		visibility = x3dh_core.PresenceNobody
+	case 2:
+		visibility = x3dh_core.PresenceContacts
+	case 3:
+		visibility = x3dh_core.PresenceEveryone
+	default:
+		fmt.Println("Invalid choice")
+		return
+	}
+	shareLastSeen := false
+	if visibility != x3dh_core.PresenceNobody {
+		shareLastSeen = prettyAskString("Also share when you were last online? (yes/no): ") == "yes"
+	}
+	err := active_profile.SetPresence(visibility, shareLastSeen)
+	if err != nil {
+		prettyLogRisky("Could not save presence settings: " + err.Error())
+		return
+	}
+	presence_visibility = visibility
+	share_last_seen = shareLastSeen
+	err = SyncPresence(c, contacts)
+	if err != nil {
+		prettyLogRisky("Could not update presence settings on the server: " + err.Error())
+		return
+	}
+	prettyLogInfo("Presence settings updated")
+}
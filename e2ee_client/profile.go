@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	x3dh_client "tux.tech/x3dh/client"
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+// ================================== PROFILES ===========================
+// Every profile lives in its own directory under the user config directory
+// ($XDG_CONFIG_HOME/e2ee-chat/profiles/<name> on Linux) and holds its own
+// secrets, contacts, message history and server settings.
+const appDirName = "e2ee-chat"
+const profilesDirName = "profiles"
+
+// Certificate of the development server, copied into new profiles when it is
+// found relative to the working directory. Older profiles stored this path.
+const defaultCACertFile = "server.crt"
+const legacyCACertFile = "../certs/server.crt"
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+type Profile struct {
+	Name string
+	Dir  string
+}
+
+type ServerSettings struct {
+	// WebSocket endpoint
+	URL string `json:"url"`
+	// Certificate of the server (self-signed setups), relative to the profile directory
+	CACertFile string `json:"ca_cert_file"`
+	// Have the server push messages while connected
+	PushMessages bool `json:"push_messages"`
+	// Who may see when this profile is online: nobody, contacts or everyone
+	PresenceVisibility string `json:"presence_visibility"`
+	// Also show when this profile was last online
+	ShareLastSeen bool `json:"share_last_seen"`
+}
+
+func DefaultServerSettings() *ServerSettings {
+	return &ServerSettings{
+		URL:                "wss://localhost:8765/ws",
+		CACertFile:         defaultCACertFile,
+		PresenceVisibility: x3dh_core.PresenceNobody,
+	}
+}
+
+func ProfilesDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, appDirName, profilesDirName), nil
+}
+
+func ValidateProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q (letters, digits, '.', '_' and '-' only)", name)
+	}
+	return nil
+}
+
+func ListProfiles() ([]string, error) {
+	dir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateProfileName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open a profile, creating its directory if it does not exist yet
+func OpenProfile(name string) (*Profile, error) {
+	err := ValidateProfileName(name)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ProfilesDir()
+	if err != nil {
+		return nil, err
+	}
+	profileDir := filepath.Join(dir, name)
+	err = os.MkdirAll(profileDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{
+		Name: name,
+		Dir:  profileDir,
+	}, nil
+}
+
+func ProfileExists(name string) bool {
+	if ValidateProfileName(name) != nil {
+		return false
+	}
+	dir, err := ProfilesDir()
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, name))
+	return err == nil && info.IsDir()
+}
+
+// Delete a profile and everything in it. Fails if the profile is in use.
+func DeleteProfile(name string) error {
+	if !ProfileExists(name) {
+		return fmt.Errorf("profile %q does not exist", name)
+	}
+	profile, err := OpenProfile(name)
+	if err != nil {
+		return err
+	}
+	lock, err := AcquireProfileLock(profile.LockPath())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	return os.RemoveAll(profile.Dir)
+}
+
+func (p *Profile) SecretsPath() string {
+	return filepath.Join(p.Dir, "secrets.json")
+}
+
+func (p *Profile) ContactsPath() string {
+	return filepath.Join(p.Dir, "contacts.json")
+}
+
+func (p *Profile) HistoryPath() string {
+	return filepath.Join(p.Dir, "history.json")
+}
+
+func (p *Profile) ServerSettingsPath() string {
+	return filepath.Join(p.Dir, "server.json")
+}
+
+func (p *Profile) LockPath() string {
+	return filepath.Join(p.Dir, "profile.lock")
+}
+
+// Own contact, exported to share as a file
+func (p *Profile) MyContactPath() string {
+	return filepath.Join(p.Dir, "MyContact.json")
+}
+
+// Certificate file of the settings, relative paths are inside the profile
+func (p *Profile) CACertPath(settings *ServerSettings) string {
+	if filepath.IsAbs(settings.CACertFile) {
+		return settings.CACertFile
+	}
+	return filepath.Join(p.Dir, settings.CACertFile)
+}
+
+// Copy the development server certificate into the profile if it has none yet.
+// Returns whether it was copied.
+func (p *Profile) ImportDefaultCACert(settings *ServerSettings) (bool, error) {
+	target := p.CACertPath(settings)
+	if settings.CACertFile != defaultCACertFile {
+		return false, nil
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		return false, err
+	}
+	data, err := os.ReadFile(legacyCACertFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, x3dh_client.WriteFileAtomic(target, data, 0644)
+}
+
+// Load server settings, writing the defaults on first use so they can be edited
+func (p *Profile) LoadServerSettings() (*ServerSettings, error) {
+	data, err := os.ReadFile(p.ServerSettingsPath())
+	if os.IsNotExist(err) {
+		settings := DefaultServerSettings()
+		err = p.SaveServerSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings := DefaultServerSettings()
+	err = json.Unmarshal(data, settings)
+	if err != nil {
+		return nil, err
+	}
+	// The path used to depend on the working directory
+	if settings.CACertFile == legacyCACertFile {
+		settings.CACertFile = defaultCACertFile
+		err = p.SaveServerSettings(settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (p *Profile) SetPushMessages(push bool) error {
+	settings, err := p.LoadServerSettings()
+	if err != nil {
+		return err
+	}
+	settings.PushMessages = push
+	return p.SaveServerSettings(settings)
+}
+
+func (p *Profile) SetPresence(visibility string, shareLastSeen bool) error {
+	settings, err := p.LoadServerSettings()
+	if err != nil {
+		return err
+	}
+	settings.PresenceVisibility = visibility
+	settings.ShareLastSeen = shareLastSeen
+	return p.SaveServerSettings(settings)
+}
+
+func (p *Profile) SaveServerSettings(settings *ServerSettings) error {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return x3dh_client.WriteFileAtomic(p.ServerSettingsPath(), data, 0600)
+}
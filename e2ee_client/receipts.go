@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+	e2ee_api "tux.tech/e2ee/api"
+	x3dh_client "tux.tech/x3dh/client"
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+// ================================== RECEIPTS ===========================
+// Plaintext of a read receipt
+type readReceiptPayload struct {
+	MessageIDs []string `json:"message_ids"`
+	ReadAt     int64    `json:"read_at"`
+}
+
+// Whether the server handles receipts (protocol version 4)
+func receiptsSupported() bool {
+	return slices.Contains(serverHello.Methods, "subscribe_receipts")
+}
+
+// Update the status of sent messages. Read receipts from unknown contacts or
+// encrypted with another identity key than the pinned one are ignored.
+func HandleReceipt(client *x3dh_client.X3DHClient, contacts *Contacts, history *History, receipt e2ee_api.Receipt) {
+	var messageIDs []string
+	status := ""
+	switch receipt.Type {
+	case x3dh_core.ReceiptDelivered:
+		messageIDs = []string{receipt.MessageID}
+		status = MessageDelivered
+	case x3dh_core.ReceiptRead:
+		contact := contacts.FindContactByUsername(receipt.UserID)
+		if contact == nil || receipt.Signal == nil || !contact.PublicKey.IdentityKey.Equal(receipt.Signal.IdentityKey) {
+			return
+		}
+		plaintext, err := client.ReceiveSignal(receipt.Signal)
+		if err != nil {
+			return
+		}
+		payload := &readReceiptPayload{}
+		if json.Unmarshal(plaintext, payload) != nil {
+			return
+		}
+		messageIDs = payload.MessageIDs
+		status = MessageRead
+	default:
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	changed := false
+	for _, messageID := range messageIDs {
+		if history.SetStatus(receipt.UserID, messageID, status) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := SaveMyHistory(history); err != nil {
+		prettyLogRisky("Could not save history")
+	}
+}
+
+// Apply receipts kept while offline and receive new ones as notify_receipt
+func SyncReceipts(client *x3dh_client.X3DHClient, c *websocket.Conn, contacts *Contacts, history *History) error {
+	if !receiptsSupported() {
+		return nil
+	}
+	receipts, err := APISubscribeReceipts(c)
+	if err != nil {
+		return err
+	}
+	for _, receipt := range receipts {
+		HandleReceipt(client, contacts, history, receipt)
+	}
+	return nil
+}
+
+func APISubscribeReceipts(c *websocket.Conn) ([]e2ee_api.Receipt, error) {
+	// Send And Await Response
+	response, err := sendAndAwaitWsResponse(c, &e2ee_api.RequestSubscribeReceipts{}, "subscribe_receipts")
+	if err != nil {
+		return nil, err
+	}
+	// Parse params
+	params_response := &e2ee_api.ResponseSubscribeReceipts{}
+	err = json.Unmarshal(response, params_response)
+	if err != nil {
+		return nil, err
+	}
+	if !params_response.Success {
+		return nil, fmt.Errorf("server did not subscribe to receipts")
+	}
+	return params_response.Receipts, nil
+}
+
+// Fire-and-forget like acks, a lost read receipt only leaves the message
+// shown as delivered. The server only accepts it after the acknowledgement.
+func APISendReadReceipt(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Contact, messageID string) error {
+	if !receiptsSupported() {
+		return nil
+	}
+	payload, err := json.Marshal(&readReceiptPayload{
+		MessageIDs: []string{messageID},
+		ReadAt:     time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	// Encrypt receipt
+	signal, err := client.BuildSignal(contact.PublicKey.IdentityKey, payload)
+	if err != nil {
+		return err
+	}
+	// Build API call
+	params := &e2ee_api.RequestSendReadReceipt{
+		RecipientID: contact.Username,
+		MessageID:   messageID,
+		Signal:      *signal,
+	}
+	return writeWsRequest(c, params, "send_read_receipt")
+}
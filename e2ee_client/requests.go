@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	e2ee_api "tux.tech/e2ee/api"
+)
+
+// How long a request waits for its response
+const requestTimeout = 30 * time.Second
+
+var (
+	errRequestTimeout   = errors.New("no response from server")
+	errConnectionClosed = errors.New("connection to server closed")
+)
+
+// Requests waiting for a response, by request ID. Responses are matched by ID,
+// so requests from the menu and from notification handlers can be in flight
+// at the same time.
+type pendingRequests struct {
+	mu      sync.Mutex
+	nextID  uint64
+	waiting map[string]chan e2ee_api.OutboundMessage
+	closed  bool
+}
+
+var pending = &pendingRequests{
+	waiting: make(map[string]chan e2ee_api.OutboundMessage),
+}
+
+// Register a new request, the channel receives its response
+func (p *pendingRequests) add() (string, chan e2ee_api.OutboundMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return "", nil, errConnectionClosed
+	}
+	p.nextID++
+	id := strconv.FormatUint(p.nextID, 10)
+	// Buffered so delivery never blocks the reader
+	response := make(chan e2ee_api.OutboundMessage, 1)
+	p.waiting[id] = response
+	return id, response, nil
+}
+
+func (p *pendingRequests) remove(id string) {
+	p.mu.Lock()
+	delete(p.waiting, id)
+	p.mu.Unlock()
+}
+
+// Hand a response to its request. Returns false if nobody waits for it
+// (unknown ID, timed out, or a request sent without ID).
+func (p *pendingRequests) deliver(response e2ee_api.OutboundMessage) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	waiting, ok := p.waiting[response.ID]
+	if !ok {
+		return false
+	}
+	delete(p.waiting, response.ID)
+	waiting <- response
+	return true
+}
+
+// Fail all waiting requests and refuse new ones
+func (p *pendingRequests) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for id, waiting := range p.waiting {
+		close(waiting)
+		delete(p.waiting, id)
+	}
+}
+
+// Wait for the response to a request registered with add
+func (p *pendingRequests) await(id string, response chan e2ee_api.OutboundMessage) (e2ee_api.OutboundMessage, error) {
+	timer := time.NewTimer(requestTimeout)
+	defer timer.Stop()
+	select {
+	case message, ok := <-response:
+		if !ok {
+			return e2ee_api.OutboundMessage{}, errConnectionClosed
+		}
+		return message, nil
+	case <-timer.C:
+		p.remove(id)
+		return e2ee_api.OutboundMessage{}, errRequestTimeout
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	e2ee_api "tux.tech/e2ee/api"
+	x3dh_client "tux.tech/x3dh/client"
+)
+
+// ================================== TYPING ===========================
+const (
+	// Sent again while composing, a lost "stopped" only lasts until the timeout
+	typingRefresh = 5 * time.Second
+	typingTimeout = 15 * time.Second
+	// Older signals are replays or from a badly set clock
+	maxSignalAge = time.Minute
+)
+
+// Plaintext of an ephemeral signal
+type signalPayload struct {
+	Type   string `json:"type"`
+	Typing bool   `json:"typing"`
+	SentAt int64  `json:"sent_at"`
+}
+
+const signalTypeTyping = "typing"
+
+// Contacts typing, until when
+type typingState struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var contactTyping = &typingState{
+	until: make(map[string]time.Time),
+}
+
+// Returns whether username just started typing
+func (t *typingState) set(username string, typing bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wasTyping := time.Now().Before(t.until[username])
+	if !typing {
+		delete(t.until, username)
+		return false
+	}
+	t.until[username] = time.Now().Add(typingTimeout)
+	return !wasTyping
+}
+
+// Whether the server relays ephemeral signals (protocol version 3)
+func signalSupported() bool {
+	return slices.Contains(serverHello.Methods, "signal_ephemeral")
+}
+
+// Tell contact we are typing until the returned function is called
+func StartTyping(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Contact) func() {
+	if !signalSupported() {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(typingRefresh)
+		defer ticker.Stop()
+		for {
+			// Best effort, typing is not worth an error message
+			_ = APISignalTyping(client, c, contact, true)
+			select {
+			case <-done:
+				_ = APISignalTyping(client, c, contact, false)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Show that a contact is typing. Signals from unknown contacts or with
+// another identity key than the pinned one are ignored.
+func HandleSignal(client *x3dh_client.X3DHClient, contacts *Contacts, notification *e2ee_api.NotifySignal) {
+	contact := contacts.FindContactByUsername(notification.SenderID)
+	if contact == nil || !contact.PublicKey.IdentityKey.Equal(notification.Signal.IdentityKey) {
+		return
+	}
+	plaintext, err := client.ReceiveSignal(&notification.Signal)
+	if err != nil {
+		return
+	}
+	payload := &signalPayload{}
+	if json.Unmarshal(plaintext, payload) != nil || payload.Type != signalTypeTyping {
+		return
+	}
+	if time.Since(time.Unix(payload.SentAt, 0)).Abs() > maxSignalAge {
+		return
+	}
+	if contactTyping.set(contact.Username, payload.Typing) {
+		fmt.Println()
+		prettyLogInfo("<" + contact.Username + " is typing…>")
+		fmt.Println()
+	}
+}
+
+func APISignalTyping(client *x3dh_client.X3DHClient, c *websocket.Conn, contact Contact, typing bool) error {
+	payload, err := json.Marshal(&signalPayload{
+		Type:   signalTypeTyping,
+		Typing: typing,
+		SentAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	// Encrypt signal
+	signal, err := client.BuildSignal(contact.PublicKey.IdentityKey, payload)
+	if err != nil {
+		return err
+	}
+	// Build API call
+	params := &e2ee_api.RequestSignalEphemeral{
+		RecipientID: contact.Username,
+		Signal:      *signal,
+	}
+	// No response is awaited, the server cannot tell whether it was delivered
+	return writeWsRequest(c, params, "signal_ephemeral")
+}
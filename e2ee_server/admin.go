@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Operator API, served on its own listener with its own credentials.
+// Every endpoint answers with JSON.
+//
+//	GET  /admin/users                       accounts with their open sessions
+//	GET  /admin/users/{username}            account, keys and queue of one user
+//	POST /admin/users/{username}/disconnect close all sessions
+//	POST /admin/users/{username}/suspend    refuse logins and close all sessions
+//	POST /admin/users/{username}/unsuspend  allow logins again
+//	POST /admin/users/{username}/purge      drop all queued messages
+//	GET  /admin/metrics                     requests, errors and durations per method
+type AdminServer struct {
+	server   *WsServer
+	username string
+	password string
+}
+
+type AdminUser struct {
+	Username  string     `json:"username"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Suspended bool       `json:"suspended"`
+	Sessions  int        `json:"sessions"`
+}
+
+type AdminUserDetail struct {
+	AdminUser
+	Registered     bool       `json:"registered"`
+	OTPCount       int        `json:"otp_count"`
+	SPKUpdatedAt   *time.Time `json:"spk_updated_at,omitempty"`
+	SPKAgeSeconds  int64      `json:"spk_age_seconds,omitempty"`
+	QueuedMessages int        `json:"queued_messages"`
+}
+
+type AdminResult struct {
+	Username string `json:"username"`
+	// Sessions closed or messages purged
+	Count int `json:"count"`
+}
+
+type AdminError struct {
+	Error string `json:"error"`
+}
+
+func NewAdminServer(server *WsServer, username string, password string) *AdminServer {
+	return &AdminServer{
+		server:   server,
+		username: username,
+		password: password,
+	}
+}
+
+func (admin *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/users", admin.HandleListUsers)
+	mux.HandleFunc("GET /admin/users/{username}", admin.HandleGetUser)
+	mux.HandleFunc("POST /admin/users/{username}/disconnect", admin.HandleDisconnect)
+	mux.HandleFunc("POST /admin/users/{username}/suspend", admin.HandleSuspend)
+	mux.HandleFunc("POST /admin/users/{username}/unsuspend", admin.HandleUnsuspend)
+	mux.HandleFunc("POST /admin/users/{username}/purge", admin.HandlePurgeQueue)
+	mux.HandleFunc("GET /admin/metrics", admin.HandleMetrics)
+	return admin.requireAuth(mux)
+}
+
+// Compare hashes so the comparison takes the same time for any length
+func secureEqual(a, b string) bool {
+	hashA := sha256.Sum256([]byte(a))
+	hashB := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(hashA[:], hashB[:]) == 1
+}
+
+func (admin *AdminServer) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		// Evaluate both so a wrong username is not answered faster
+		validUser := secureEqual(username, admin.username)
+		validPassword := secureEqual(password, admin.password)
+		if !ok || !validUser || !validPassword {
+			logSecurityEvent(username, "admin_auth_failed", "from "+r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="e2ee admin"`)
+			writeAdminJSON(w, http.StatusUnauthorized, AdminError{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	fmt.Println("Admin request failed:", err)
+	writeAdminJSON(w, http.StatusInternalServerError, AdminError{Error: "internal error"})
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (admin *AdminServer) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := admin.server.X3DHServer.ListUsers()
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	sessions := admin.server.sessionCounts()
+	result := make([]AdminUser, 0, len(users))
+	for _, user := range users {
+		result = append(result, AdminUser{
+			Username:  user.Username,
+			LastSeen:  optionalTime(user.LastSeen),
+			Suspended: user.Suspended,
+			Sessions:  sessions[user.Username],
+		})
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (admin *AdminServer) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	user, ok, err := admin.server.X3DHServer.GetUser(username)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if !ok {
+		writeAdminJSON(w, http.StatusNotFound, AdminError{Error: "user not found"})
+		return
+	}
+	stats, err := admin.server.X3DHServer.GetClientStats(username)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	detail := AdminUserDetail{
+		AdminUser: AdminUser{
+			Username:  user.Username,
+			LastSeen:  optionalTime(user.LastSeen),
+			Suspended: user.Suspended,
+			Sessions:  admin.server.sessionCounts()[user.Username],
+		},
+		Registered:     stats.Registered,
+		OTPCount:       stats.OTPCount,
+		SPKUpdatedAt:   optionalTime(stats.SPKUpdatedAt),
+		QueuedMessages: stats.QueuedMessages,
+	}
+	if !stats.SPKUpdatedAt.IsZero() {
+		detail.SPKAgeSeconds = int64(time.Since(stats.SPKUpdatedAt).Seconds())
+	}
+	writeAdminJSON(w, http.StatusOK, detail)
+}
+
+func (admin *AdminServer) HandleDisconnect(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	closed := admin.server.DisconnectUser(username)
+	logSecurityEvent(username, "admin_disconnect", fmt.Sprint(closed, " sessions"))
+	writeAdminJSON(w, http.StatusOK, AdminResult{Username: username, Count: closed})
+}
+
+func (admin *AdminServer) HandleSuspend(w http.ResponseWriter, r *http.Request) {
+	admin.setSuspended(w, r.PathValue("username"), true)
+}
+
+func (admin *AdminServer) HandleUnsuspend(w http.ResponseWriter, r *http.Request) {
+	admin.setSuspended(w, r.PathValue("username"), false)
+}
+
+func (admin *AdminServer) setSuspended(w http.ResponseWriter, username string, suspended bool) {
+	found, err := admin.server.X3DHServer.SetUserSuspended(username, suspended)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if !found {
+		writeAdminJSON(w, http.StatusNotFound, AdminError{Error: "user not found"})
+		return
+	}
+	closed := 0
+	if suspended {
+		// Open sessions would otherwise outlive the suspension
+		closed = admin.server.DisconnectUser(username)
+		logSecurityEvent(username, "admin_suspend", fmt.Sprint(closed, " sessions closed"))
+	} else {
+		logSecurityEvent(username, "admin_unsuspend", "")
+	}
+	writeAdminJSON(w, http.StatusOK, AdminResult{Username: username, Count: closed})
+}
+
+func (admin *AdminServer) HandlePurgeQueue(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	purged, err := admin.server.X3DHServer.ClearMessages(username)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	logSecurityEvent(username, "admin_purge", fmt.Sprint(purged, " messages"))
+	writeAdminJSON(w, http.StatusOK, AdminResult{Username: username, Count: purged})
+}
+
+func (admin *AdminServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, admin.server.metrics.Snapshot())
+}
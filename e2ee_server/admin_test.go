@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	x3dh_core "tux.tech/x3dh/core"
+)
+
+// Admin API of server on a test listener, requests with setAuth use the
+// right credentials
+func newTestAdmin(t *testing.T, server *WsServer) (url string, setAuth func(r *http.Request)) {
+	t.Helper()
+	admin := NewAdminServer(server, "admin", "admin password")
+	listener := httptest.NewServer(admin.Handler())
+	t.Cleanup(listener.Close)
+	return listener.URL, func(r *http.Request) { r.SetBasicAuth("admin", "admin password") }
+}
+
+func adminRequest(t *testing.T, method string, url string, setAuth func(r *http.Request), result interface{}) int {
+	t.Helper()
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setAuth != nil {
+		setAuth(request)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if result != nil && response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestAdminAuth(t *testing.T) {
+	url, setAuth := newTestAdmin(t, newTestServer(t))
+	tests := []struct {
+		name    string
+		setAuth func(r *http.Request)
+		want    int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"wrong username", func(r *http.Request) { r.SetBasicAuth("root", "admin password") }, http.StatusUnauthorized},
+		{"empty credentials", func(r *http.Request) { r.SetBasicAuth("", "") }, http.StatusUnauthorized},
+		{"valid credentials", setAuth, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, request := range []struct{ method, path string }{
+				{http.MethodGet, "/admin/users"},
+				{http.MethodGet, "/admin/metrics"},
+				{http.MethodPost, "/admin/users/alice/disconnect"},
+			} {
+				if status := adminRequest(t, request.method, url+request.path, tt.setAuth, nil); status != tt.want {
+					t.Fatalf("%s %s = %d; want %d", request.method, request.path, status, tt.want)
+				}
+			}
+		})
+	}
+	// Checked before routing, unknown paths do not reveal anything either
+	if status := adminRequest(t, http.MethodGet, url+"/admin/no_such_path", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("unknown path without credentials = %d; want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminSuspend(t *testing.T) {
+	server := newTestServer(t)
+	url, setAuth := newTestAdmin(t, server)
+	// Creates the account and keeps a session open
+	dialTestClient(t, server, newTestListener(t, server), "alice")
+	password := "password of alice"
+	result := &AdminResult{}
+	if status := adminRequest(t, http.MethodPost, url+"/admin/users/alice/suspend", setAuth, result); status != http.StatusOK || result.Count != 1 {
+		t.Fatalf("suspend = %d, %+v; want 1 session closed", status, result)
+	}
+	waitFor(t, func() bool { return server.sessionCounts()["alice"] == 0 })
+	if _, err := server.authenticateUser("alice", password); err != errAccountSuspended {
+		t.Fatalf("authenticateUser of a suspended user = %v; want %v", err, errAccountSuspended)
+	}
+	user := &AdminUserDetail{}
+	if status := adminRequest(t, http.MethodGet, url+"/admin/users/alice", setAuth, user); status != http.StatusOK || !user.Suspended {
+		t.Fatalf("user after suspend = %d, %+v; want suspended", status, user)
+	}
+
+	if status := adminRequest(t, http.MethodPost, url+"/admin/users/alice/unsuspend", setAuth, result); status != http.StatusOK {
+		t.Fatalf("unsuspend = %d", status)
+	}
+	if _, err := server.authenticateUser("alice", password); err != nil {
+		t.Fatalf("authenticateUser after unsuspend = %v", err)
+	}
+	if status := adminRequest(t, http.MethodPost, url+"/admin/users/nobody/suspend", setAuth, nil); status != http.StatusNotFound {
+		t.Fatalf("suspend of an unknown user = %d; want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	server := newTestServer(t)
+	url, setAuth := newTestAdmin(t, server)
+	ik, err := x3dh_core.GenerateFullIK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := x3dh_core.GenerateFullSPK(ik.IdentityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := x3dh_core.X3DHClientBundle{IK: *ik.PublicIK(), SPK: *spk.PublicSPK()}
+	if err := server.X3DHServer.RegisterClient("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	const queued = 3
+	for i := 0; i < queued; i++ {
+		if _, err := server.X3DHServer.SendMessage("alice", "bob", x3dh_core.InitialMessage{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result := &AdminResult{}
+	if status := adminRequest(t, http.MethodPost, url+"/admin/users/alice/purge", setAuth, result); status != http.StatusOK {
+		t.Fatalf("purge = %d", status)
+	}
+	if result.Username != "alice" || result.Count != queued {
+		t.Fatalf("purge = %+v; want %d messages of alice", result, queued)
+	}
+	messages, err := server.X3DHServer.ListMessages("alice", "", queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("queue after purge = %d messages; want none", len(messages))
+	}
+	// Nothing left to purge
+	if status := adminRequest(t, http.MethodPost, url+"/admin/users/alice/purge", setAuth, result); status != http.StatusOK || result.Count != 0 {
+		t.Fatalf("second purge = %d, %+v; want 0 messages", status, result)
+	}
+}
@@ -3,16 +3,57 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	api "tux.tech/e2ee/api"
 )
 
+// Messages per receive_messages response and per backlog push
+const (
+	defaultMessageBatch = 50
+	maxMessageBatch     = 200
+)
+
+// Ciphertext bytes of an ephemeral signal, they carry small state like typing
+const maxSignalSize = 1024
+
+const (
+	// Time allowed to write a frame
+	writeWait = 10 * time.Second
+	// Time allowed between pongs (or other frames) from the client
+	pongWait = 60 * time.Second
+	// Pings are sent more often than pongWait so one can be late
+	pingPeriod = pongWait * 9 / 10
+	// Largest frame accepted from a client (messages are limited by the store)
+	maxFrameSize = 1 << 20
+	// Frames waiting to be written. A client that lets it fill up is
+	// disconnected instead of blocking whoever sends to it.
+	sendQueueSize = 256
+)
+
 type WsClient struct {
 	username string
 	server   *WsServer
 	conn     *websocket.Conn
 	send     chan []byte
+	// Closed when the connection is shutting down
+	done     chan struct{}
+	stopOnce sync.Once
+	// Messages are pushed instead of announced
+	push atomic.Bool
+	// Receipts are sent as notify_receipt
+	receipts atomic.Bool
+	// Closed because the server shuts down
+	goingAway atomic.Bool
+	// Negotiated by hello, 0 before. Only used by ReadPump.
+	protocolVersion int
+	// Rate limits per method. Only used by ReadPump.
+	limiters map[string]*tokenBucket
+	// Users whose presence is watched, guarded by server.mu
+	watching []string
 }
 
 func NewWsClient(username string, server *WsServer, conn *websocket.Conn) *WsClient {
@@ -20,22 +61,54 @@ func NewWsClient(username string, server *WsServer, conn *websocket.Conn) *WsCli
 		username: username,
 		server:   server,
 		conn:     conn,
-		send:     make(chan []byte),
+		send:     make(chan []byte, sendQueueSize),
+		done:     make(chan struct{}),
+		limiters: make(map[string]*tokenBucket),
 	}
 }
 
+// Writes queued frames and pings. A nil frame closes the connection after
+// everything queued before it. Any write error stops the connection.
 func (client *WsClient) WritePump() {
-	for message := range client.send {
-		client.conn.WriteMessage(websocket.TextMessage, message)
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer client.stop()
+	for {
+		select {
+		case message := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if message == nil {
+				client.conn.WriteMessage(websocket.CloseMessage, client.closeFrame())
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				fmt.Println("Error writing to user", client.username, ":", err)
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				fmt.Println("Error pinging user", client.username, ":", err)
+				return
+			}
+		case <-client.done:
+			return
+		}
 	}
 }
 
 func (client *WsClient) ReadPump() {
+	client.conn.SetReadLimit(maxFrameSize)
+	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
 		mt, message, err := client.conn.ReadMessage()
 		if err != nil || mt == websocket.CloseMessage {
 			break // Exit loop
 		}
+		client.conn.SetReadDeadline(time.Now().Add(pongWait))
 		if mt == websocket.TextMessage {
 			client.HandleMessage(message)
 		}
@@ -43,29 +116,79 @@ func (client *WsClient) ReadPump() {
 	client.Disconnect()
 }
 
+// Queue a frame without blocking, for notifications sent on behalf of other
+// users. A client whose queue is full is too slow and gets disconnected.
+func (client *WsClient) trySend(message []byte) bool {
+	select {
+	case <-client.done:
+		return false
+	default:
+	}
+	select {
+	case client.send <- message:
+		return true
+	default:
+		fmt.Println("Disconnecting user", client.username, ": send queue full")
+		client.stop()
+		return false
+	}
+}
+
+// Queue a frame, waiting for room. Only used from the client's own ReadPump,
+// so a slow client only slows itself down.
+func (client *WsClient) sendWait(message []byte) bool {
+	select {
+	case client.send <- message:
+		return true
+	case <-client.done:
+		return false
+	}
+}
+
+// Close the connection once everything queued so far is written, or right
+// away if the queue is full
+func (client *WsClient) Close() {
+	client.trySend(nil)
+}
+
+// Like Close, but tells the client the server is going away so it reconnects
+// later or elsewhere
+func (client *WsClient) GoAway() {
+	client.goingAway.Store(true)
+	client.trySend(nil)
+}
+
+func (client *WsClient) closeFrame() []byte {
+	if client.goingAway.Load() {
+		return goingAwayFrame()
+	}
+	return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+}
+
+// Stop both pumps now. Safe to call more than once and from any goroutine.
+func (client *WsClient) stop() {
+	client.stopOnce.Do(func() {
+		close(client.done)
+		client.conn.Close()
+	})
+}
+
 func (client *WsClient) HandleMessage(rawMessage []byte) {
-	// Log
-	fmt.Println("Received message from", client.username, ":", string(rawMessage))
 	// Parse JSON
 	message := &api.InboundMessage{}
 	err := json.Unmarshal(rawMessage, message)
 	if err != nil {
+		fmt.Println("Malformed request from", client.username)
+		client.sendError("", "", api.NewError(api.ErrCodeInvalidRequest, "malformed request"))
 		return
 	}
-	switch message.Method {
-	case "get_bundle":
-		client.HandleGetUserBundle(message.Params)
-	case "upload_bundle":
-		client.HandleUploadBundle(message.Params)
-	case "send_message":
-		client.HandleSendMessage(message.Params)
-	case "receive_message":
-		client.HandleReceiveMessage(message.Params)
-	case "status":
-		client.HandleUserStatus(message.Params)
-	case "upload_new_otps":
-		client.HandleUploadNewOTPs(message.Params)
+	// Requests that were already running finish during shutdown, new ones are refused
+	if !client.server.beginRequest() {
+		client.sendError(message.ID, message.Method, api.NewError(api.ErrCodeShuttingDown, "server is shutting down"))
+		return
 	}
+	defer client.server.endRequest()
+	client.server.handlers.Dispatch(client, message)
 }
 
 func buildOutboundMessage(params interface{}, method string) (*api.OutboundMessage, error) {
@@ -82,260 +205,92 @@ func buildOutboundMessage(params interface{}, method string) (*api.OutboundMessa
 	return api_call, nil
 }
 
-func (client *WsClient) Disconnect() {
-	client.server.UnsetClient(client)
-	client.conn.Close()
-	close(client.send) // Close write pump
-}
-
-func getLowOTPNotification() []byte {
-	notification, err := buildOutboundMessage(&api.NotifyLowOTP{}, "notify_low_otp")
+// Encode a notification, nil if it cannot be marshalled (senders skip nil)
+func buildNotification(params interface{}, method string) []byte {
+	notification, err := buildOutboundMessage(params, method)
 	if err != nil {
-		fmt.Println("Error marshalling notification to notify_low_otp")
+		fmt.Println("Error marshalling notification to", method)
 		return nil
 	}
 	notificationBytes, err := json.Marshal(notification)
 	if err != nil {
-		fmt.Println("Error marshalling notification to notify_low_otp")
+		fmt.Println("Error marshalling notification to", method)
 		return nil
 	}
 	return notificationBytes
 }
 
-func (client *WsClient) HandleUploadNewOTPs(rawParams json.RawMessage) {
-	params := &api.RequestUploadOTPs{}
-	err := json.Unmarshal(rawParams, params)
-	if err != nil {
-		return
-	}
-	// Register OTPs
-	client.server.X3DHServer.ExpandOTPSet(client.username, params.OTPs)
-	fmt.Println("User", client.username, "uploaded #", len(params.OTPs), "new OTPs")
-}
-
-func (client *WsClient) HandleGetUserBundle(rawParams json.RawMessage) {
-	params := &api.RequestUserBundle{}
-	err := json.Unmarshal(rawParams, params)
-	if err != nil {
-		return
-	}
-
-	// Get the bundle
-	bundle, ok, err := client.server.X3DHServer.GetClientBundle(params.UserID)
-	if err != nil {
-		fmt.Println("Db error getting bundle for user", params.UserID)
-		return
-	}
-	fmt.Println("User", client.username, "requested bundle for user", params.UserID, ":", ok)
-
-	// Notify recipient if otp is running low
-	count, err := client.server.X3DHServer.GetRemainingOTPCount(params.UserID)
-	if err != nil {
-		fmt.Println("Error getting remaining OTP count for user", params.UserID)
-		return
-	}
-	if count < 3 {
-		// Notify user
-		fmt.Println("Notifying user", params.UserID, "that OTP is running low")
-		// Send notification
-		notificationBytes := getLowOTPNotification()
-		client.server.SendNotificationToUser(params.UserID, notificationBytes)
-	}
-	// Send response
-	response, err := buildOutboundMessage(&api.ResponseUserBundle{
-		Success: ok,
-		Bundle:  bundle,
-	}, "get_bundle")
+// Answer a request, echoing its ID so the client can match the response
+func (client *WsClient) sendResponse(requestID string, method string, params interface{}) {
+	response, err := buildOutboundMessage(params, method)
 	if err != nil {
-		fmt.Println("Error marshalling response to get_bundle")
+		fmt.Println("Error marshalling response to", method)
+		client.sendError(requestID, method, internalError())
 		return
 	}
+	response.ID = requestID
 	responseBytes, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("Error marshalling fail response to get_bundle")
+		fmt.Println("Error marshalling response to", method)
+		client.sendError(requestID, method, internalError())
 		return
 	}
-	client.send <- responseBytes
-
+	client.sendWait(responseBytes)
 }
 
-func (client *WsClient) HandleUploadBundle(rawParams json.RawMessage) {
-	params := &api.RequestUploadBundle{}
-	err := json.Unmarshal(rawParams, params)
-	if err != nil {
-		return
-	}
-	// Check if the user is the same
-	if client.username != params.UserID {
-		fmt.Println("User", client.username, "attempted to upload bundle for user", params.UserID)
-
-		response, err := buildOutboundMessage(&api.ResponseUploadBundle{
-			Success: false,
-		}, "upload_bundle")
-		if err != nil {
-			fmt.Println("Error marshalling response to upload_bundle")
-			return
-		}
-		responseBytes, err := json.Marshal(response)
-		if err != nil {
-			fmt.Println("Error marshalling fail response to upload_bundle")
-			return
-		}
-		client.send <- responseBytes
-	}
-	// Register
-	client.server.X3DHServer.RegisterClient(params.UserID, params.Bundle)
-	fmt.Println("User", client.username, "uploaded bundle for user", params.UserID)
-	// Send response
-	response, err := buildOutboundMessage(&api.ResponseUploadBundle{
-		Success: true,
-	}, "upload_bundle")
-	if err != nil {
-		fmt.Println("Error marshalling response to upload_bundle")
-		return
-	}
-	responseBytes, err := json.Marshal(response)
+// Answer a failed request. Every request gets either a response or an error.
+func (client *WsClient) sendError(requestID string, method string, apiErr *api.Error) {
+	responseBytes, err := json.Marshal(&api.OutboundMessage{
+		ID:     requestID,
+		Method: method,
+		Error:  apiErr,
+	})
 	if err != nil {
-		fmt.Println("Error marshalling success response to upload_bundle")
+		fmt.Println("Error marshalling error response to", method)
 		return
 	}
-	client.send <- responseBytes
+	client.sendWait(responseBytes)
 }
 
-func (client *WsClient) HandleSendMessage(rawParams json.RawMessage) {
-	params := &api.RequestSendMsg{}
-	err := json.Unmarshal(rawParams, params)
-	if err != nil {
-		return
-	}
-	// Send message
-	ok := client.server.X3DHServer.SendMessage(params.RecipientID, client.username, params.MessageData)
-	fmt.Println("User", client.username, "sent message to user", params.RecipientID, ":", ok)
-	// Send response
-	response, err := buildOutboundMessage(&api.ResponseSendMsg{
-		Success: ok,
-	}, "send_message")
-	if err != nil {
-		fmt.Println("Error marshalling response to send_message")
-		return
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshalling success response to send_message")
-		return
-	}
-	client.send <- responseBytes
-	// Notify recipient of message only if successful
-	if !ok {
-		return
-	}
-	// Send notification
-	notification, err := buildOutboundMessage(&api.NotifyNewMessage{
-		SenderID: client.username,
-	}, "notify_new_message")
-	if err != nil {
-		fmt.Println("Error marshalling notification to notify_new_message")
-		return
-	}
-	notificationBytes, err := json.Marshal(notification)
-	if err != nil {
-		fmt.Println("Error marshalling notification to notify_new_message")
-		return
-	}
-	client.server.SendNotificationToUser(params.RecipientID, notificationBytes)
+// Storage and other server failures, details stay in the log
+func internalError() *api.Error {
+	return api.NewError(api.ErrCodeInternal, "internal server error")
 }
 
-func (client *WsClient) HandleReceiveMessage(rawParams json.RawMessage) {
-	params := &api.RequestReceiveMsg{}
-	err := json.Unmarshal(rawParams, params)
-	if err != nil {
-		return
-	}
-	// Unqueue message
-	messageData, ok, err := client.server.X3DHServer.GetMessage(client.username)
-	if err != nil {
-		fmt.Println("Error getting message for user", client.username)
-		return
-	}
-	if !ok {
-		fmt.Println("User", client.username, "requested message but none available")
-		// Send response
-		response, err := buildOutboundMessage(&api.ResponseReceiveMsg{
-			Success: false,
-		}, "receive_message")
+// Push everything already queued. Messages arriving meanwhile may be pushed
+// twice, clients drop duplicates by ID.
+func (client *WsClient) PushQueuedMessages() {
+	cursor := ""
+	for {
+		messages, err := client.server.X3DHServer.ListMessages(client.username, cursor, defaultMessageBatch)
 		if err != nil {
-			fmt.Println("Error marshalling response to receive_message")
+			fmt.Println("Error listing messages for user", client.username)
 			return
 		}
-		responseBytes, err := json.Marshal(response)
-		if err != nil {
-			fmt.Println("Error marshalling fail response to receive_message")
+		for _, messageData := range messages {
+			notificationBytes := getMessageNotification(messageData)
+			if notificationBytes == nil {
+				return
+			}
+			if !client.sendWait(notificationBytes) {
+				return
+			}
+			cursor = messageData.ID
+		}
+		if len(messages) < defaultMessageBatch {
 			return
 		}
-		client.send <- responseBytes
-		return
-	}
-	fmt.Println("User", client.username, "received message from user", messageData.SenderID)
-	// Send response
-	response, err := buildOutboundMessage(&api.ResponseReceiveMsg{
-		Success:     true,
-		SenderID:    messageData.SenderID,
-		MessageData: messageData.Message,
-	}, "receive_message")
-	if err != nil {
-		fmt.Println("Error marshalling response to receive_message")
-		return
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshalling success response to receive_message")
-		return
 	}
-	client.send <- responseBytes
 }
 
-func (client *WsClient) HandleUserStatus(rawParams json.RawMessage) {
-	// Check if the user is registered
-	//registered := client.server.X3DHServer.IsClientRegistered(params.UserID)
-	//fmt.Println("User", client.username, "checked if user", params.UserID, "is registered")
-
-	// Check if self is registered
-	registered, err := client.server.X3DHServer.IsClientRegistered(client.username)
-	if err != nil {
-		fmt.Println("Error checking if user", client.username, "is registered")
-		return
-	}
-	fmt.Println("User", client.username, "checked if self is registered")
-
-	// Send response
-	response, err := buildOutboundMessage(&api.ResponseUserStatus{
-		Success: registered,
-	}, "status")
-	if err != nil {
-		fmt.Println("Error marshalling response to status")
-		return
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshalling success response to status")
-		return
-	}
-	client.send <- responseBytes
-	// If not registered, do not notify otp
-	if !registered {
-		return
-	}
-	// Notify recipient if otp is running low
-	count, err := client.server.X3DHServer.GetRemainingOTPCount(client.username)
-	if err != nil {
-		fmt.Println("Error getting remaining OTP count for user", client.username)
-		return
-	}
-	if count < 3 {
-		// Notify user
-		fmt.Println("Notifying user", client.username, "that OTP is running low")
-		// Send notification
-		notificationBytes := getLowOTPNotification()
-		client.send <- notificationBytes
+func (client *WsClient) Disconnect() {
+	last := client.server.UnsetClient(client)
+	if err := client.server.X3DHServer.TouchUser(client.username); err != nil {
+		fmt.Println("Error updating last seen for user", client.username, ":", err)
+	}
+	client.stop() // Stops the write pump
+	// After touching, so watchers get the new last seen time
+	if last {
+		client.server.NotifyPresence(client.username)
 	}
 }
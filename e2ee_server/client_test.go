@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket listener of server over plain HTTP, returns its URL
+func newTestListener(t *testing.T, server *WsServer) string {
+	t.Helper()
+	listener := httptest.NewServer(http.HandlerFunc(server.connnect))
+	t.Cleanup(listener.Close)
+	return "ws" + strings.TrimPrefix(listener.URL, "http")
+}
+
+// Connect as username, the account is created on first use
+func dialTestClient(t *testing.T, server *WsServer, url string, username string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{}
+	header.Set("User", username)
+	header.Set("Password", "password of "+username)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// Registered right after the upgrade response is written
+	waitFor(t, func() bool { return server.sessionCounts()[username] > 0 })
+	return conn
+}
+
+// Poll cond until it holds, failing after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowClientDisconnected(t *testing.T) {
+	server := newTestServer(t)
+	url := newTestListener(t, server)
+	// Never reads
+	dialTestClient(t, server, url, "alice")
+	alice := server.clientsOf("alice")[0]
+	bob := dialTestClient(t, server, url, "bob")
+	var received atomic.Int64
+	go func() {
+		for {
+			if _, _, err := bob.ReadMessage(); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	// Large frames fill the socket buffers, then the send queue of alice.
+	// Bob is sent a frame now and then meanwhile.
+	frame := bytes.Repeat([]byte("x"), 64<<10)
+	notification := []byte(`{"method":"notify_test"}`)
+	maxFrames := 100 * sendQueueSize
+	sentToBob := int64(0)
+	start := time.Now()
+	for i := 0; i < maxFrames && alice.trySend(frame); i++ {
+		if i%64 == 0 {
+			server.SendNotificationToUser("bob", notification)
+			sentToBob++
+		}
+	}
+	if elapsed := time.Since(start); elapsed > writeWait/2 {
+		t.Fatalf("sending to a slow client took %v; want no blocking", elapsed)
+	}
+	select {
+	case <-alice.done:
+	default:
+		t.Fatalf("client that never reads not disconnected after %d frames", maxFrames)
+	}
+	waitFor(t, func() bool { return server.sessionCounts()["alice"] == 0 })
+	waitFor(t, func() bool { return received.Load() == sentToBob })
+
+	// Sending to the gone client returns right away
+	start = time.Now()
+	server.SendNotificationToUser("alice", frame)
+	server.SendNotificationToUser("bob", notification)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("SendNotificationToUser took %v; want no blocking", elapsed)
+	}
+	waitFor(t, func() bool { return received.Load() == sentToBob+1 })
+}
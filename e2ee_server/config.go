@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Server settings. Each one is taken from, by increasing precedence: the
+// default, the YAML config file, its environment variable and its flag.
+type Config struct {
+	// Websocket listener (HTTPS)
+	ListenAddr string       `yaml:"listen_addr"`
+	CertFile   string       `yaml:"cert_file"`
+	KeyFile    string       `yaml:"key_file"`
+	Store      StoreConfig  `yaml:"store"`
+	Limits     LimitsConfig `yaml:"limits"`
+	Admin      AdminConfig  `yaml:"admin"`
+	// Users with fewer one time pre keys left are asked to upload more
+	LowOTPThreshold int `yaml:"low_otp_threshold"`
+	// Time connections get to finish their requests on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type StoreConfig struct {
+	// memory, mongo or bolt
+	Backend string `yaml:"backend"`
+	// Connection string (mongo) or database file (bolt)
+	URI          string `yaml:"uri"`
+	Database     string `yaml:"database"`
+	AuthDatabase string `yaml:"auth_database"`
+	// Apply pending schema migrations on startup (mongo)
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// Zero disables a limit
+type LimitsConfig struct {
+	MaxQueuedMessages int           `yaml:"max_queued_messages"`
+	MaxMessageSize    int           `yaml:"max_message_size"`
+	MaxStoredOTPs     int           `yaml:"max_stored_otps"`
+	MessageTTL        time.Duration `yaml:"message_ttl"`
+	// Accounts without a login for this many days are deleted
+	AccountExpiryDays int `yaml:"account_expiry_days"`
+}
+
+// The admin API is disabled without a password
+type AdminConfig struct {
+	Addr     string `yaml:"addr"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+func DefaultConfig() Config {
+	store := x3dh_server.DefaultConfig()
+	return Config{
+		ListenAddr: "0.0.0.0:8765",
+		CertFile:   "../certs/server.crt",
+		KeyFile:    "../certs/server.key",
+		Store: StoreConfig{
+			Backend:      store.Backend,
+			URI:          store.URI,
+			Database:     store.Database,
+			AuthDatabase: store.AuthDatabase,
+			AutoMigrate:  store.AutoMigrate,
+		},
+		Limits: LimitsConfig{
+			MaxQueuedMessages: store.Limits.MaxQueuedMessages,
+			MaxMessageSize:    store.Limits.MaxMessageSize,
+			MaxStoredOTPs:     store.Limits.MaxStoredOTPs,
+			MessageTTL:        store.Limits.MessageTTL,
+			AccountExpiryDays: int(store.Limits.InactiveAccountTTL / (24 * time.Hour)),
+		},
+		Admin: AdminConfig{
+			Addr: "127.0.0.1:8766",
+			User: "admin",
+		},
+		LowOTPThreshold: 3,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Flag and environment variable of every setting, in the order of --help
+var configSettings = []struct {
+	flag string
+	env  string
+}{
+	{"listen", "X3DH_LISTEN_ADDR"},
+	{"cert", "X3DH_CERT_FILE"},
+	{"key", "X3DH_KEY_FILE"},
+	{"store-backend", "X3DH_STORE_BACKEND"},
+	{"store-uri", "X3DH_STORE_URI"},
+	{"store-database", "X3DH_STORE_DATABASE"},
+	{"store-auth-database", "X3DH_STORE_AUTH_DATABASE"},
+	{"auto-migrate", "X3DH_AUTO_MIGRATE"},
+	{"max-queued-messages", "X3DH_MAX_QUEUED_MESSAGES"},
+	{"max-message-size", "X3DH_MAX_MESSAGE_SIZE"},
+	{"max-stored-otps", "X3DH_MAX_STORED_OTPS"},
+	{"message-ttl", "X3DH_MESSAGE_TTL"},
+	{"account-expiry-days", "X3DH_ACCOUNT_EXPIRY_DAYS"},
+	{"admin-addr", "X3DH_ADMIN_ADDR"},
+	{"admin-user", "X3DH_ADMIN_USER"},
+	{"admin-password", "X3DH_ADMIN_PASSWORD"},
+	{"low-otp-threshold", "X3DH_LOW_OTP_THRESHOLD"},
+	{"shutdown-timeout", "X3DH_SHUTDOWN_TIMEOUT"},
+}
+
+// Register a flag for every setting, writing to c
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "listen address of the websocket server")
+	fs.StringVar(&c.CertFile, "cert", c.CertFile, "TLS certificate file")
+	fs.StringVar(&c.KeyFile, "key", c.KeyFile, "TLS key file")
+	fs.StringVar(&c.Store.Backend, "store-backend", c.Store.Backend, "storage backend: memory, mongo or bolt")
+	fs.StringVar(&c.Store.URI, "store-uri", c.Store.URI, "MongoDB connection string or bbolt file")
+	fs.StringVar(&c.Store.Database, "store-database", c.Store.Database, "MongoDB database for bundles and queues")
+	fs.StringVar(&c.Store.AuthDatabase, "store-auth-database", c.Store.AuthDatabase, "MongoDB database for accounts")
+	fs.BoolVar(&c.Store.AutoMigrate, "auto-migrate", c.Store.AutoMigrate, "apply pending MongoDB schema migrations on startup")
+	fs.IntVar(&c.Limits.MaxQueuedMessages, "max-queued-messages", c.Limits.MaxQueuedMessages, "messages waiting per recipient, 0 for no limit")
+	fs.IntVar(&c.Limits.MaxMessageSize, "max-message-size", c.Limits.MaxMessageSize, "bytes per message (ciphertext, associated data and keys), 0 for no limit")
+	fs.IntVar(&c.Limits.MaxStoredOTPs, "max-stored-otps", c.Limits.MaxStoredOTPs, "one time pre keys stored per user, 0 for no limit")
+	fs.DurationVar(&c.Limits.MessageTTL, "message-ttl", c.Limits.MessageTTL, "age after which unacknowledged messages are purged, 0 to keep them")
+	fs.IntVar(&c.Limits.AccountExpiryDays, "account-expiry-days", c.Limits.AccountExpiryDays, "days without a login after which an account is deleted, 0 to keep accounts")
+	fs.StringVar(&c.Admin.Addr, "admin-addr", c.Admin.Addr, "listen address of the admin API")
+	fs.StringVar(&c.Admin.User, "admin-user", c.Admin.User, "username of the admin API")
+	fs.StringVar(&c.Admin.Password, "admin-password", c.Admin.Password, "password of the admin API, empty to disable it")
+	fs.IntVar(&c.LowOTPThreshold, "low-otp-threshold", c.LowOTPThreshold, "ask users with fewer one time pre keys left to upload more")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time connections get to finish on SIGINT or SIGTERM")
+}
+
+// Parse args with fs (which may define other flags) and build the config
+// from the defaults, the config file (-config or X3DH_CONFIG), the
+// environment and the flags set in args. The result is not validated.
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	// Only read through fs.Visit, unset flags must not override the file
+	parsed := DefaultConfig()
+	parsed.bind(fs)
+	configFile := fs.String("config", os.Getenv("X3DH_CONFIG"), "YAML config file")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := DefaultConfig()
+	if *configFile != "" {
+		if err := config.loadFile(*configFile); err != nil {
+			return Config{}, err
+		}
+	}
+	// Environment and flags are applied through flag values, so both are
+	// parsed the same way
+	overrides := flag.NewFlagSet("config", flag.ContinueOnError)
+	config.bind(overrides)
+	for _, setting := range configSettings {
+		value, ok := os.LookupEnv(setting.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := overrides.Set(setting.flag, value); err != nil {
+			return Config{}, fmt.Errorf("invalid %s: %w", setting.env, err)
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && overrides.Lookup(f.Name) != nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Settings missing from the file keep their current value
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	// Catch misspelled settings
+	decoder.KnownFields(true)
+	// An empty file sets nothing
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Every problem at once, so they can all be fixed before the next start
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.ListenAddr)
+	check(err == nil, "listen_addr %q must be host:port", c.ListenAddr)
+	for name, path := range map[string]string{"cert_file": c.CertFile, "key_file": c.KeyFile} {
+		_, err := os.Stat(path)
+		check(err == nil, "%s: %v", name, err)
+	}
+
+	switch c.Store.Backend {
+	case x3dh_server.BackendMemory:
+	case x3dh_server.BackendBolt:
+		check(c.Store.URI != "", "store.uri must be the database file for the bolt backend")
+		// The default URI is for mongo, it must not become a file name
+		check(!strings.HasPrefix(c.Store.URI, "mongodb://") && !strings.HasPrefix(c.Store.URI, "mongodb+srv://"),
+			"store.uri %q is a MongoDB connection string, set it to the database file for the bolt backend", c.Store.URI)
+	case x3dh_server.BackendMongo:
+		check(c.Store.URI != "", "store.uri is required for the mongo backend")
+		check(c.Store.Database != "" && c.Store.AuthDatabase != "", "store.database and store.auth_database are required for the mongo backend")
+		check(c.Store.Database != c.Store.AuthDatabase, "store.database and store.auth_database must differ")
+	default:
+		errs = append(errs, fmt.Errorf("store.backend %q must be memory, mongo or bolt", c.Store.Backend))
+	}
+
+	check(c.Limits.MaxQueuedMessages >= 0, "limits.max_queued_messages must not be negative")
+	check(c.Limits.MaxMessageSize >= 0, "limits.max_message_size must not be negative")
+	check(c.Limits.MaxStoredOTPs >= 0, "limits.max_stored_otps must not be negative")
+	check(c.Limits.MessageTTL >= 0, "limits.message_ttl must not be negative")
+	check(c.Limits.AccountExpiryDays >= 0, "limits.account_expiry_days must not be negative")
+	check(c.LowOTPThreshold >= 0, "low_otp_threshold must not be negative")
+	// Otherwise users are asked for keys the server refuses to store
+	check(c.Limits.MaxStoredOTPs == 0 || c.LowOTPThreshold < c.Limits.MaxStoredOTPs,
+		"low_otp_threshold (%d) must be below limits.max_stored_otps (%d)", c.LowOTPThreshold, c.Limits.MaxStoredOTPs)
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+
+	if c.Admin.Password != "" {
+		_, _, err := net.SplitHostPort(c.Admin.Addr)
+		check(err == nil, "admin.addr %q must be host:port", c.Admin.Addr)
+		check(c.Admin.Addr != c.ListenAddr, "admin.addr must differ from listen_addr")
+		check(c.Admin.User != "", "admin.user is required when admin.password is set")
+	}
+	return errors.Join(errs...)
+}
+
+// Copy that is safe to print: the admin password and the password in the
+// store URI are replaced
+func (c Config) Redacted() Config {
+	if c.Admin.Password != "" {
+		c.Admin.Password = "REDACTED"
+	}
+	if u, err := url.Parse(c.Store.URI); err == nil && u.User != nil {
+		c.Store.URI = u.Redacted()
+	}
+	return c
+}
+
+// YAML in the format of the config file, secrets redacted
+func (c Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprint("invalid config: ", err)
+	}
+	return string(data)
+}
+
+// Settings of the x3dh storage backend
+func (c Config) StoreConfig() x3dh_server.Config {
+	return x3dh_server.Config{
+		Backend:      c.Store.Backend,
+		URI:          c.Store.URI,
+		Database:     c.Store.Database,
+		AuthDatabase: c.Store.AuthDatabase,
+		Limits: x3dh_server.Limits{
+			MaxQueuedMessages:  c.Limits.MaxQueuedMessages,
+			MaxMessageSize:     c.Limits.MaxMessageSize,
+			MessageTTL:         c.Limits.MessageTTL,
+			MaxStoredOTPs:      c.Limits.MaxStoredOTPs,
+			InactiveAccountTTL: time.Duration(c.Limits.AccountExpiryDays) * 24 * time.Hour,
+		},
+		AutoMigrate: c.Store.AutoMigrate,
+	}
+}
@@ -8,13 +8,17 @@ replace tux.tech/x3dh/core => ../x3dh_core
 
 replace tux.tech/x3dh/server => ../x3dh_server
 
-require tux.tech/x3dh/core v0.0.0-00010101000000-000000000000 // indirect
+require tux.tech/x3dh/core v0.0.0-00010101000000-000000000000
 
 require tux.tech/x3dh/server v0.0.0-00010101000000-000000000000
 
 require tux.tech/e2ee/api v0.0.0-00010101000000-000000000000
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
@@ -25,9 +29,10 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	go.etcd.io/bbolt v1.3.10 // indirect
 	go.mongodb.org/mongo-driver v1.16.0 // indirect
 	go.step.sm/crypto v0.47.0 // indirect
-	golang.org/x/crypto v0.23.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 )
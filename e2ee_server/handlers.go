@@ -1,5 +1,329 @@
 package main
 
-/*
-Implement handlers
-*/
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	api "tux.tech/e2ee/api"
+)
+
+// A request being handled
+type Request struct {
+	Client *WsClient
+	ID     string
+	Method string
+	Params json.RawMessage
+	// Run once the response is sent
+	after []func()
+}
+
+// Run f after the response (or error) is sent, for work the client should
+// only see after the response: notifications, pushes, closing the connection
+func (req *Request) AfterResponse(f func()) {
+	req.after = append(req.after, f)
+}
+
+// Returns the response params, or the error sent instead
+type HandlerFunc func(req *Request) (interface{}, *api.Error)
+
+// Wraps a handler, e.g. to check, log or count requests
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Handlers by method name. Every handler is wrapped in the middleware of the
+// registry, the first middleware is the outermost. Unknown methods go through
+// the same middleware, so they are also logged, counted and need a handshake.
+type HandlerRegistry struct {
+	handlers   map[string]HandlerFunc
+	middleware []Middleware
+	unknown    HandlerFunc
+}
+
+func NewHandlerRegistry(middleware ...Middleware) *HandlerRegistry {
+	registry := &HandlerRegistry{
+		handlers:   make(map[string]HandlerFunc),
+		middleware: middleware,
+	}
+	registry.unknown = registry.wrap(handleUnknownMethod)
+	return registry
+}
+
+func (registry *HandlerRegistry) Handle(method string, handler HandlerFunc) {
+	registry.handlers[method] = registry.wrap(handler)
+}
+
+func (registry *HandlerRegistry) wrap(handler HandlerFunc) HandlerFunc {
+	for i := len(registry.middleware) - 1; i >= 0; i-- {
+		handler = registry.middleware[i](handler)
+	}
+	return handler
+}
+
+func handleUnknownMethod(req *Request) (interface{}, *api.Error) {
+	return nil, api.NewError(api.ErrCodeUnknownMethod, "unknown method "+req.Method)
+}
+
+// Run the handler of a request and send its response or error
+func (registry *HandlerRegistry) Dispatch(client *WsClient, message *api.InboundMessage) {
+	handler, ok := registry.handlers[message.Method]
+	if !ok {
+		handler = registry.unknown
+	}
+	req := &Request{
+		Client: client,
+		ID:     message.ID,
+		Method: message.Method,
+		Params: message.Params,
+	}
+	response, apiErr := handler(req)
+	if apiErr != nil {
+		client.sendError(req.ID, req.Method, apiErr)
+	} else {
+		client.sendResponse(req.ID, req.Method, response)
+	}
+	for _, f := range req.after {
+		f()
+	}
+}
+
+// Adapt a handler taking decoded params. Missing params decode as empty.
+func Typed[P any, R any](handler func(req *Request, params *P) (*R, *api.Error)) HandlerFunc {
+	return func(req *Request) (interface{}, *api.Error) {
+		params := new(P)
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, params); err != nil {
+				return nil, api.NewError(api.ErrCodeInvalidRequest, "invalid params")
+			}
+		}
+		response, apiErr := handler(req, params)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		return response, nil
+	}
+}
+
+// Requests per second and burst allowed per connection
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Methods that are expensive (password checks, key lookups consuming one time
+// pre keys of others) or that fill storage. Unlisted methods are unlimited.
+var methodRateLimits = map[string]RateLimit{
+	"send_message":       {Rate: 10, Burst: 30},
+	"get_bundle":         {Rate: 2, Burst: 10},
+	"lookup_user":        {Rate: 5, Burst: 20},
+	"upload_bundle":      {Rate: 0.2, Burst: 3},
+	"upload_new_otps":    {Rate: 1, Burst: 5},
+	"rotate_identity":    {Rate: 0.1, Burst: 3},
+	"delete_account":     {Rate: 0.1, Burst: 3},
+	"set_presence":       {Rate: 0.5, Burst: 5},
+	"subscribe_presence": {Rate: 0.5, Burst: 5},
+	"signal_ephemeral":   {Rate: 2, Burst: 10},
+	"send_read_receipt":  {Rate: 10, Burst: 30},
+}
+
+func newHandlerRegistry(metrics *Metrics) *HandlerRegistry {
+	registry := NewHandlerRegistry(
+		logRequests,
+		metrics.Middleware,
+		recoverPanics,
+		requireHandshake,
+		rateLimit(methodRateLimits),
+	)
+	registry.Handle("hello", Typed(handleHello))
+	registry.Handle("get_bundle", Typed(handleGetUserBundle))
+	registry.Handle("upload_bundle", Typed(handleUploadBundle))
+	registry.Handle("send_message", Typed(handleSendMessage))
+	registry.Handle("receive_message", Typed(handleReceiveMessage))
+	registry.Handle("receive_messages", Typed(handleReceiveMessages))
+	registry.Handle("subscribe_messages", Typed(handleSubscribeMessages))
+	registry.Handle("ack_message", Typed(handleAckMessage))
+	registry.Handle("status", Typed(handleUserStatus))
+	registry.Handle("upload_new_otps", Typed(handleUploadNewOTPs))
+	registry.Handle("lookup_user", Typed(handleLookupUser))
+	registry.Handle("rotate_identity", Typed(handleRotateIdentity))
+	registry.Handle("identity_history", Typed(handleIdentityHistory))
+	registry.Handle("delete_account", Typed(handleDeleteAccount))
+	registry.Handle("set_presence", Typed(handleSetPresence))
+	registry.Handle("subscribe_presence", Typed(handleSubscribePresence))
+	registry.Handle("signal_ephemeral", Typed(handleSignalEphemeral))
+	registry.Handle("subscribe_receipts", Typed(handleSubscribeReceipts))
+	registry.Handle("send_read_receipt", Typed(handleSendReadReceipt))
+	return registry
+}
+
+// Method, user, result and duration of every request. Params are not logged,
+// some carry passwords.
+func logRequests(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (interface{}, *api.Error) {
+		start := time.Now()
+		response, apiErr := next(req)
+		result := "ok"
+		if apiErr != nil {
+			result = apiErr.Code
+		}
+		fmt.Println("Request", req.Method, "from", req.Client.username, ":", result, "in", time.Since(start))
+		return response, apiErr
+	}
+}
+
+// Turn a panicking handler into an internal error instead of a crash
+func recoverPanics(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (response interface{}, apiErr *api.Error) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Println("Panic handling", req.Method, "from", req.Client.username, ":", r)
+				fmt.Println(string(debug.Stack()))
+				response, apiErr = nil, internalError()
+			}
+		}()
+		return next(req)
+	}
+}
+
+// Users are authenticated on upgrade. Before a request is handled the
+// connection must also have finished hello and negotiated a protocol version
+// that has the request.
+func requireHandshake(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (interface{}, *api.Error) {
+		if req.Method == "hello" {
+			return next(req)
+		}
+		client := req.Client
+		if client.protocolVersion == 0 {
+			req.AfterResponse(client.Close)
+			return nil, api.NewError(api.ErrCodeHelloRequired, "the first request must be hello")
+		}
+		if introduced := api.MethodVersions[req.Method]; introduced > client.protocolVersion {
+			return nil, api.NewError(api.ErrCodeUnknownMethod, fmt.Sprint(req.Method, " needs protocol version ", introduced))
+		}
+		return next(req)
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a token if one is available
+func (bucket *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	bucket.tokens = min(bucket.tokens, float64(limit.Burst))
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Refuse requests above the limit of their method on this connection
+func rateLimit(limits map[string]RateLimit) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) (interface{}, *api.Error) {
+			limit, ok := limits[req.Method]
+			if !ok {
+				return next(req)
+			}
+			now := time.Now()
+			bucket, ok := req.Client.limiters[req.Method]
+			if !ok {
+				bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+				req.Client.limiters[req.Method] = bucket
+			}
+			if !bucket.take(limit, now) {
+				logSecurityEvent(req.Client.username, "rate_limited", req.Method)
+				return nil, api.NewError(api.ErrCodeRateLimited, "too many "+req.Method+" requests")
+			}
+			return next(req)
+		}
+	}
+}
+
+// Request counts, errors and durations per method since the server started
+type Metrics struct {
+	mu      sync.Mutex
+	methods map[string]*methodMetrics
+}
+
+type methodMetrics struct {
+	requests int64
+	errors   map[string]int64
+	duration time.Duration
+}
+
+type MethodStats struct {
+	Method   string `json:"method"`
+	Requests int64  `json:"requests"`
+	// Failed requests by error code
+	Errors            map[string]int64 `json:"errors"`
+	AverageDurationMs float64          `json:"average_duration_ms"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		methods: make(map[string]*methodMetrics),
+	}
+}
+
+func (metrics *Metrics) Middleware(next HandlerFunc) HandlerFunc {
+	return func(req *Request) (interface{}, *api.Error) {
+		start := time.Now()
+		response, apiErr := next(req)
+		metrics.record(metricsMethod(req.Method), time.Since(start), apiErr)
+		return response, apiErr
+	}
+}
+
+// Unknown methods are counted together, clients choose their names
+func metricsMethod(method string) string {
+	if _, ok := api.MethodVersions[method]; !ok {
+		return "unknown"
+	}
+	return method
+}
+
+func (metrics *Metrics) record(method string, duration time.Duration, apiErr *api.Error) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stats, ok := metrics.methods[method]
+	if !ok {
+		stats = &methodMetrics{errors: make(map[string]int64)}
+		metrics.methods[method] = stats
+	}
+	stats.requests++
+	stats.duration += duration
+	if apiErr != nil {
+		stats.errors[apiErr.Code]++
+	}
+}
+
+// Stats of every method that was requested, sorted by method
+func (metrics *Metrics) Snapshot() []MethodStats {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	result := make([]MethodStats, 0, len(metrics.methods))
+	for method, stats := range metrics.methods {
+		errors := make(map[string]int64, len(stats.errors))
+		for code, count := range stats.errors {
+			errors[code] = count
+		}
+		result = append(result, MethodStats{
+			Method:            method,
+			Requests:          stats.requests,
+			Errors:            errors,
+			AverageDurationMs: float64(stats.duration.Microseconds()) / 1000 / float64(stats.requests),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Method < result[j].Method
+	})
+	return result
+}
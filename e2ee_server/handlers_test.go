@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	api "tux.tech/e2ee/api"
+)
+
+// Connection that finished hello, without a socket. Frames stay in its queue.
+func testClient(username string, protocolVersion int) *WsClient {
+	client := NewWsClient(username, nil, nil)
+	client.protocolVersion = protocolVersion
+	return client
+}
+
+// The frame queued for the client, nil if it was a close
+func nextFrame(t *testing.T, client *WsClient) *api.OutboundMessage {
+	t.Helper()
+	select {
+	case frame := <-client.send:
+		if frame == nil {
+			return nil
+		}
+		message := &api.OutboundMessage{}
+		if err := json.Unmarshal(frame, message); err != nil {
+			t.Fatalf("invalid frame %q: %v", frame, err)
+		}
+		return message
+	default:
+		t.Fatalf("no frame queued")
+		return nil
+	}
+}
+
+func dispatch(registry *HandlerRegistry, client *WsClient, method string, params string) {
+	message := &api.InboundMessage{ID: "1", Method: method}
+	if params != "" {
+		message.Params = json.RawMessage(params)
+	}
+	registry.Dispatch(client, message)
+}
+
+func TestHandlerChain(t *testing.T) {
+	type echoParams struct {
+		Value string `json:"value"`
+	}
+	type echoResponse struct {
+		Value string `json:"value"`
+	}
+	metrics := NewMetrics()
+	registry := NewHandlerRegistry(
+		logRequests,
+		metrics.Middleware,
+		recoverPanics,
+		requireHandshake,
+		rateLimit(methodRateLimits),
+	)
+	registry.Handle("hello", func(req *Request) (interface{}, *api.Error) {
+		return &echoResponse{Value: "hello"}, nil
+	})
+	registry.Handle("status", Typed(func(req *Request, params *echoParams) (*echoResponse, *api.Error) {
+		return &echoResponse{Value: params.Value}, nil
+	}))
+	registry.Handle("ack_message", func(req *Request) (interface{}, *api.Error) {
+		panic("broken handler")
+	})
+	// Introduced after the version negotiated in the tests
+	registry.Handle("send_read_receipt", func(req *Request) (interface{}, *api.Error) {
+		return &echoResponse{}, nil
+	})
+
+	tests := []struct {
+		name            string
+		protocolVersion int
+		method          string
+		params          string
+		// Empty for success
+		wantCode  string
+		wantValue string
+		wantClose bool
+	}{
+		{"typed params", 1, "status", `{"value":"ok"}`, "", "ok", false},
+		{"missing params", 1, "status", "", "", "", false},
+		{"invalid params", 1, "status", `{"value":1}`, api.ErrCodeInvalidRequest, "", false},
+		{"panic", 1, "ack_message", "", api.ErrCodeInternal, "", false},
+		{"before hello", 0, "status", "", api.ErrCodeHelloRequired, "", true},
+		{"unknown before hello", 0, "no_such_method", "", api.ErrCodeHelloRequired, "", true},
+		{"hello first", 0, "hello", "", "", "hello", false},
+		{"newer method", 1, "send_read_receipt", "", api.ErrCodeUnknownMethod, "", false},
+		{"unknown method", 1, "no_such_method", "", api.ErrCodeUnknownMethod, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClient("alice", tt.protocolVersion)
+			dispatch(registry, client, tt.method, tt.params)
+			response := nextFrame(t, client)
+			if response == nil || response.ID != "1" || response.Method != tt.method {
+				t.Fatalf("response = %+v; want one for request 1 (%s)", response, tt.method)
+			}
+			if tt.wantCode != "" {
+				if response.Error == nil || response.Error.Code != tt.wantCode {
+					t.Fatalf("error = %+v; want %s", response.Error, tt.wantCode)
+				}
+			} else {
+				if response.Error != nil {
+					t.Fatalf("error = %+v; want a response", response.Error)
+				}
+				result := &echoResponse{}
+				if err := json.Unmarshal(response.Params, result); err != nil || result.Value != tt.wantValue {
+					t.Fatalf("params = %s, %v; want value %q", response.Params, err, tt.wantValue)
+				}
+			}
+			// Requests before hello close the connection after the error
+			closed := len(client.send) > 0 && nextFrame(t, client) == nil
+			if closed != tt.wantClose {
+				t.Fatalf("connection closed = %v; want %v", closed, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	limit := RateLimit{Rate: 0.001, Burst: 2}
+	registry := NewHandlerRegistry(requireHandshake, rateLimit(map[string]RateLimit{"send_message": limit}))
+	registry.Handle("send_message", func(req *Request) (interface{}, *api.Error) {
+		return struct{}{}, nil
+	})
+	registry.Handle("status", func(req *Request) (interface{}, *api.Error) {
+		return struct{}{}, nil
+	})
+	client := testClient("alice", 1)
+	for i := 0; i < limit.Burst; i++ {
+		dispatch(registry, client, "send_message", "")
+		if response := nextFrame(t, client); response.Error != nil {
+			t.Fatalf("request %d within the burst = %+v; want a response", i, response.Error)
+		}
+	}
+	dispatch(registry, client, "send_message", "")
+	response := nextFrame(t, client)
+	if response.Error == nil || response.Error.Code != api.ErrCodeRateLimited || !response.Error.Retryable {
+		t.Fatalf("request over the limit = %+v; want a retryable %s", response.Error, api.ErrCodeRateLimited)
+	}
+	// Unlisted methods and other connections are not limited
+	for i := 0; i < 2*limit.Burst; i++ {
+		dispatch(registry, client, "status", "")
+		if response := nextFrame(t, client); response.Error != nil {
+			t.Fatalf("unlimited method = %+v; want a response", response.Error)
+		}
+	}
+	other := testClient("alice", 1)
+	dispatch(registry, other, "send_message", "")
+	if response := nextFrame(t, other); response.Error != nil {
+		t.Fatalf("request on another connection = %+v; want a response", response.Error)
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	registry := NewHandlerRegistry(metrics.Middleware, requireHandshake)
+	registry.Handle("status", func(req *Request) (interface{}, *api.Error) {
+		return struct{}{}, nil
+	})
+	client := testClient("alice", 1)
+	for _, method := range []string{"status", "status", "no_such_method", "another_unknown_method"} {
+		dispatch(registry, client, method, "")
+		nextFrame(t, client)
+	}
+	stats := make(map[string]MethodStats)
+	for _, method := range metrics.Snapshot() {
+		stats[method.Method] = method
+	}
+	// Unknown methods share one entry, clients choose their names
+	if len(stats) != 2 {
+		t.Fatalf("Snapshot = %+v; want status and unknown only", stats)
+	}
+	if stats["status"].Requests != 2 || len(stats["status"].Errors) != 0 {
+		t.Fatalf("status stats = %+v; want 2 requests without errors", stats["status"])
+	}
+	unknown := stats["unknown"]
+	if unknown.Requests != 2 || unknown.Errors[api.ErrCodeUnknownMethod] != 2 {
+		t.Fatalf("unknown stats = %+v; want 2 %s errors", unknown, api.ErrCodeUnknownMethod)
+	}
+}
@@ -1,29 +1,141 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// How often expired messages are purged and inactive accounts deleted
+const (
+	purgeInterval  = 10 * time.Minute
+	expiryInterval = time.Hour
 )
 
 func main() {
-	server := NewWsServer()
-	http.HandleFunc("/ws", server.connnect)
+	migrate := flag.Bool("migrate", false, "apply pending database schema migrations and exit")
+	printConfig := flag.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		fmt.Print(config)
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		return
+	}
+	storeConfig := config.StoreConfig()
+
+	if *migrate {
+		applied, err := x3dh_server.MigrateStore(storeConfig)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Applied", len(applied), "migrations:", applied)
+		return
+	}
 
-	// Load your certificates
-	certFile := "../certs/server.crt"
-	keyFile := "../certs/server.key"
+	server, err := NewWsServer(config)
+	if err != nil {
+		panic(err)
+	}
+	// Background jobs use the store, they are stopped before it is closed
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+	jobs.Add(2)
+	go func() {
+		defer jobs.Done()
+		server.RunPurgeJob(jobsCtx, purgeInterval)
+	}()
+	go func() {
+		defer jobs.Done()
+		server.RunExpiryJob(jobsCtx, expiryInterval)
+	}()
+	http.HandleFunc("/ws", server.connnect)
 
 	srv := &http.Server{
-		Addr: "0.0.0.0:8765",
+		Addr: config.ListenAddr,
 		TLSConfig: &tls.Config{
 			MinVersion: tls.VersionTLS12,
 		},
 	}
 
-	err := srv.ListenAndServeTLS(certFile, keyFile)
-	if err != nil {
-		panic(err)
+	// Listener errors, both servers stop on the first one
+	serveErrors := make(chan error, 2)
+	listeners := []*http.Server{srv}
+
+	// Admin API on its own listener, disabled without a password
+	if config.Admin.Password != "" {
+		adminSrv := &http.Server{
+			Addr:    config.Admin.Addr,
+			Handler: NewAdminServer(server, config.Admin.User, config.Admin.Password).Handler(),
+			TLSConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+			},
+		}
+		listeners = append(listeners, adminSrv)
+		go func() {
+			fmt.Println("Admin API listening on", config.Admin.Addr)
+			serveErrors <- adminSrv.ListenAndServeTLS(config.CertFile, config.KeyFile)
+		}()
+	} else {
+		fmt.Println("Admin API disabled, set admin.password (X3DH_ADMIN_PASSWORD) to enable it")
 	}
 
+	go func() {
+		fmt.Println("Listening on", config.ListenAddr)
+		serveErrors <- srv.ListenAndServeTLS(config.CertFile, config.KeyFile)
+	}()
+
 	//http.ListenAndServe("0.0.0.0:8765", nil)
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	var serveErr error
+	select {
+	case <-signals.Done():
+		fmt.Println("Shutting down, waiting up to", config.ShutdownTimeout, "for connections")
+	case serveErr = <-serveErrors:
+		fmt.Println("Server stopped:", serveErr)
+	}
+	// A second signal kills the process
+	stopSignals()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	// Stop accepting connections, then drain the websockets (the HTTP server
+	// does not track hijacked connections)
+	for _, listener := range listeners {
+		if err := listener.Shutdown(ctx); err != nil {
+			fmt.Println("Error stopping listener", listener.Addr, ":", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Error closing connections:", err)
+	}
+	stopJobs()
+	jobs.Wait()
+	if err := server.X3DHServer.Close(); err != nil {
+		fmt.Println("Error closing store:", err)
+	}
+	fmt.Println("Server stopped")
+	if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+		os.Exit(1)
+	}
 }
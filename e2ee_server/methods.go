@@ -0,0 +1,598 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	api "tux.tech/e2ee/api"
+	x3dh_core "tux.tech/x3dh/core"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Offered to clients in hello, preferred first
+var (
+	supportedCipherSuites = []string{api.CipherSuiteX25519AESGCM}
+	supportedEncodings    = []string{api.EncodingJSON}
+)
+
+// Negotiate protocol version, cipher suite and encoding. Incompatible clients
+// get an error and are disconnected.
+func handleHello(req *Request, params *api.RequestHello) (*api.ResponseHello, *api.Error) {
+	client := req.Client
+	if client.protocolVersion != 0 {
+		return nil, api.NewError(api.ErrCodeInvalidRequest, "hello was already received")
+	}
+	version, compatible := api.NegotiateVersion(params.ProtocolVersion, params.MinProtocolVersion)
+	cipherSuite := selectSupported(params.CipherSuites, supportedCipherSuites)
+	encoding := selectSupported(params.Encodings, supportedEncodings)
+	reason := ""
+	switch {
+	case !compatible:
+		reason = fmt.Sprintf("protocol versions %d to %d are not supported, the server speaks %d to %d",
+			params.MinProtocolVersion, params.ProtocolVersion, api.MinProtocolVersion, api.ProtocolVersion)
+	case cipherSuite == "":
+		reason = "no supported cipher suite, the server supports " + strings.Join(supportedCipherSuites, ", ")
+	case encoding == "":
+		reason = "no supported encoding, the server supports " + strings.Join(supportedEncodings, ", ")
+	}
+	if reason != "" {
+		fmt.Println("Rejected client", params.Client, "of user", client.username, ":", reason)
+		req.AfterResponse(client.Close)
+		return nil, api.NewError(api.ErrCodeIncompatible, reason)
+	}
+	client.protocolVersion = version
+	fmt.Println("User", client.username, "connected with", params.Client, "protocol version", version)
+	limits := client.server.X3DHServer.Limits()
+	return &api.ResponseHello{
+		Success:         true,
+		ProtocolVersion: version,
+		CipherSuite:     cipherSuite,
+		Encoding:        encoding,
+		Methods:         api.MethodsForVersion(version),
+		Limits: api.ServerLimits{
+			MaxMessageSize:    limits.MaxMessageSize,
+			MaxQueuedMessages: limits.MaxQueuedMessages,
+			MaxStoredOTPs:     limits.MaxStoredOTPs,
+			MessageTTLSeconds: int64(limits.MessageTTL.Seconds()),
+			MaxMessageBatch:   maxMessageBatch,
+			MaxSignalSize:     maxSignalSize,
+		},
+	}, nil
+}
+
+// First offered value the server supports, empty if none
+func selectSupported(offered []string, supported []string) string {
+	for _, value := range offered {
+		if slices.Contains(supported, value) {
+			return value
+		}
+	}
+	return ""
+}
+
+func getLowOTPNotification() []byte {
+	return buildNotification(&api.NotifyLowOTP{}, "notify_low_otp")
+}
+
+func handleUploadNewOTPs(req *Request, params *api.RequestUploadOTPs) (*api.ResponseUploadOTPs, *api.Error) {
+	client := req.Client
+	// Register valid OTPs
+	result, err := client.server.X3DHServer.ExpandOTPSet(client.username, params.OTPs)
+	switch err {
+	case nil:
+	case x3dh_server.ErrClientNotFound:
+		return nil, api.NewError(api.ErrCodeNotRegistered, "upload a bundle first")
+	default:
+		fmt.Println("Error storing OTPs for user", client.username, ":", err)
+		return nil, internalError()
+	}
+	response := &api.ResponseUploadOTPs{
+		Success:  true,
+		Accepted: result.Accepted,
+		Rejected: make([]api.OTPRejection, 0),
+	}
+	for _, rejection := range result.Rejected {
+		response.Rejected = append(response.Rejected, api.OTPRejection{
+			ID:     rejection.ID,
+			Reason: rejection.Reason,
+		})
+	}
+	fmt.Println("User", client.username, "uploaded #", len(params.OTPs), "new OTPs, accepted #", len(result.Accepted))
+	if len(result.Rejected) > 0 {
+		logSecurityEvent(client.username, "otps_rejected", fmt.Sprint(len(result.Rejected), " of ", len(params.OTPs), " one time pre keys"))
+	}
+	return response, nil
+}
+
+func handleGetUserBundle(req *Request, params *api.RequestUserBundle) (*api.ResponseUserBundle, *api.Error) {
+	client := req.Client
+	// Get the bundle
+	bundle, ok, err := client.server.X3DHServer.GetClientBundle(params.UserID)
+	if err != nil {
+		fmt.Println("Db error getting bundle for user", params.UserID)
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "requested bundle for user", params.UserID, ":", ok)
+
+	// Notify recipient if otp is running low
+	count, err := client.server.X3DHServer.GetRemainingOTPCount(params.UserID)
+	if err != nil && err != x3dh_server.ErrClientNotFound {
+		fmt.Println("Error getting remaining OTP count for user", params.UserID)
+		return nil, internalError()
+	}
+	if err == nil && count < client.server.lowOTPThreshold {
+		// Notify user
+		fmt.Println("Notifying user", params.UserID, "that OTP is running low")
+		// Send notification
+		notificationBytes := getLowOTPNotification()
+		client.server.SendNotificationToUser(params.UserID, notificationBytes)
+	}
+	return &api.ResponseUserBundle{
+		Success: ok,
+		Bundle:  bundle,
+	}, nil
+}
+
+func handleLookupUser(req *Request, params *api.RequestLookupUser) (*api.ResponseLookupUser, *api.Error) {
+	client := req.Client
+	// Get the identity key (does not consume an OTP)
+	identityKey, ok, err := client.server.X3DHServer.GetIdentityKey(params.UserID)
+	if err != nil {
+		fmt.Println("Db error looking up user", params.UserID)
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "looked up user", params.UserID, ":", ok)
+	return &api.ResponseLookupUser{
+		Success:     ok,
+		UserID:      params.UserID,
+		IdentityKey: identityKey,
+	}, nil
+}
+
+func handleUploadBundle(req *Request, params *api.RequestUploadBundle) (*api.ResponseUploadBundle, *api.Error) {
+	client := req.Client
+	// Check if the user is the same
+	if client.username != params.UserID {
+		logSecurityEvent(client.username, "bundle_rejected", "upload for other user "+params.UserID)
+		return nil, api.NewError(api.ErrCodeForbidden, "bundles can only be uploaded for yourself")
+	}
+	// Register (signature checked, identity key cannot change here)
+	err := client.server.X3DHServer.RegisterClient(params.UserID, params.Bundle)
+	switch err {
+	case nil:
+		fmt.Println("User", client.username, "uploaded bundle for user", params.UserID)
+	case x3dh_server.ErrInvalidBundle:
+		logSecurityEvent(client.username, "bundle_rejected", "invalid signed pre key signature")
+		return nil, api.NewError(api.ErrCodeInvalidBundle, err.Error())
+	case x3dh_server.ErrIdentityTaken:
+		logSecurityEvent(client.username, "bundle_rejected", "identity key change without rotation")
+		return nil, api.NewError(api.ErrCodeIdentityTaken, err.Error())
+	default:
+		fmt.Println("Error registering bundle for user", params.UserID, ":", err)
+		return nil, internalError()
+	}
+	return &api.ResponseUploadBundle{
+		Success: true,
+	}, nil
+}
+
+func handleSendMessage(req *Request, params *api.RequestSendMsg) (*api.ResponseSendMsg, *api.Error) {
+	client := req.Client
+	// Send message
+	messageData, err := client.server.X3DHServer.SendMessage(params.RecipientID, client.username, params.MessageData)
+	if err != nil {
+		fmt.Println("User", client.username, "could not send message to user", params.RecipientID, ":", err)
+		return nil, sendError(err)
+	}
+	fmt.Println("User", client.username, "sent message", messageData.ID, "to user", params.RecipientID)
+	// Notify recipient of message
+	req.AfterResponse(func() {
+		client.server.DeliverMessage(params.RecipientID, messageData)
+	})
+	return &api.ResponseSendMsg{
+		Success:   true,
+		MessageID: messageData.ID,
+	}, nil
+}
+
+func sendError(err error) *api.Error {
+	switch err {
+	case x3dh_server.ErrClientNotFound:
+		return api.NewError(api.ErrCodeRecipientNotFound, "recipient is not registered")
+	case x3dh_server.ErrQueueFull:
+		return api.NewError(api.ErrCodeQueueFull, err.Error())
+	case x3dh_server.ErrMessageTooLarge:
+		return api.NewError(api.ErrCodeMessageTooLarge, err.Error())
+	default:
+		return internalError()
+	}
+}
+
+func toQueuedMessage(messageData x3dh_server.MessageData) api.QueuedMessage {
+	return api.QueuedMessage{
+		MessageID:   messageData.ID,
+		Timestamp:   messageData.Timestamp,
+		SenderID:    messageData.SenderID,
+		MessageData: messageData.Message,
+	}
+}
+
+func toReceipt(receipt x3dh_server.ReceiptData) api.Receipt {
+	return api.Receipt{
+		Type:      receipt.Type,
+		UserID:    receipt.FromID,
+		MessageID: receipt.MessageID,
+		Signal:    receipt.Signal,
+		Timestamp: receipt.Timestamp,
+	}
+}
+
+func handleSubscribeReceipts(req *Request, params *api.RequestSubscribeReceipts) (*api.ResponseSubscribeReceipts, *api.Error) {
+	client := req.Client
+	// Subscribe first, receipts arriving meanwhile are sent and not kept
+	client.receipts.Store(true)
+	kept, err := client.server.X3DHServer.TakeReceipts(client.username)
+	if err != nil {
+		fmt.Println("Error getting receipts for user", client.username, ":", err)
+		return nil, internalError()
+	}
+	receipts := make([]api.Receipt, 0, len(kept))
+	for _, receipt := range kept {
+		receipts = append(receipts, toReceipt(receipt))
+	}
+	fmt.Println("User", client.username, "subscribed to receipts,", len(receipts), "kept")
+	return &api.ResponseSubscribeReceipts{
+		Success:  true,
+		Receipts: receipts,
+	}, nil
+}
+
+func handleSendReadReceipt(req *Request, params *api.RequestSendReadReceipt) (*api.ResponseSendReadReceipt, *api.Error) {
+	client := req.Client
+	if params.RecipientID == "" || params.MessageID == "" {
+		return nil, api.NewError(api.ErrCodeInvalidRequest, "recipient_id and message_id are required")
+	}
+	if apiErr := validSignal(&params.Signal); apiErr != nil {
+		return nil, apiErr
+	}
+	// Only for a message the recipient sent and this user acknowledged
+	delivered, err := client.server.X3DHServer.TakeDelivery(client.username, params.RecipientID, params.MessageID)
+	if err != nil {
+		fmt.Println("Error checking delivery of message", params.MessageID, "to user", client.username, ":", err)
+		return nil, internalError()
+	}
+	if !delivered {
+		return nil, api.NewError(api.ErrCodeForbidden, "no delivered message "+params.MessageID+" from "+params.RecipientID)
+	}
+	err = client.server.SendReceipt(x3dh_server.ReceiptData{
+		OwnerID:   params.RecipientID,
+		FromID:    client.username,
+		Type:      x3dh_core.ReceiptRead,
+		MessageID: params.MessageID,
+		Signal:    &params.Signal,
+	})
+	if err != nil {
+		fmt.Println("User", client.username, "could not send read receipt to user", params.RecipientID, ":", err)
+		return nil, sendError(err)
+	}
+	return &api.ResponseSendReadReceipt{
+		Success: true,
+	}, nil
+}
+
+func getMessageNotification(messageData x3dh_server.MessageData) []byte {
+	return buildNotification(&api.NotifyMessage{
+		QueuedMessage: toQueuedMessage(messageData),
+	}, "notify_message")
+}
+
+func getNewMessageNotification(senderID string) []byte {
+	return buildNotification(&api.NotifyNewMessage{
+		SenderID: senderID,
+	}, "notify_new_message")
+}
+
+// Signals are relayed and kept as receipts, every field must be bounded
+func validSignal(signal *x3dh_core.EphemeralSignal) *api.Error {
+	if !signal.Validate() {
+		return api.NewError(api.ErrCodeInvalidRequest, "invalid signal keys, nonce or salt")
+	}
+	if len(signal.Ciphertext) > maxSignalSize {
+		return api.NewError(api.ErrCodeMessageTooLarge, fmt.Sprint("signals are limited to ", maxSignalSize, " bytes"))
+	}
+	return nil
+}
+
+func handleSignalEphemeral(req *Request, params *api.RequestSignalEphemeral) (*api.ResponseSignalEphemeral, *api.Error) {
+	client := req.Client
+	if params.RecipientID == "" {
+		return nil, api.NewError(api.ErrCodeInvalidRequest, "recipient_id is required")
+	}
+	if apiErr := validSignal(&params.Signal); apiErr != nil {
+		return nil, apiErr
+	}
+	// Only relayed, signals never reach the store
+	req.AfterResponse(func() {
+		client.server.SendNotificationToUser(params.RecipientID, buildNotification(&api.NotifySignal{
+			SenderID: client.username,
+			Signal:   params.Signal,
+		}, "notify_signal"))
+	})
+	return &api.ResponseSignalEphemeral{
+		Success: true,
+	}, nil
+}
+
+func handleReceiveMessage(req *Request, params *api.RequestReceiveMsg) (*api.ResponseReceiveMsg, *api.Error) {
+	client := req.Client
+	// Oldest message, stays queued until acknowledged
+	messageData, ok, err := client.server.X3DHServer.GetMessage(client.username)
+	if err != nil {
+		fmt.Println("Error getting message for user", client.username)
+		return nil, internalError()
+	}
+	if !ok {
+		fmt.Println("User", client.username, "requested message but none available")
+		return &api.ResponseReceiveMsg{
+			Success: false,
+		}, nil
+	}
+	fmt.Println("User", client.username, "received message", messageData.ID, "from user", messageData.SenderID)
+	return &api.ResponseReceiveMsg{
+		Success:     true,
+		MessageID:   messageData.ID,
+		Timestamp:   messageData.Timestamp,
+		SenderID:    messageData.SenderID,
+		MessageData: messageData.Message,
+	}, nil
+}
+
+func handleReceiveMessages(req *Request, params *api.RequestReceiveMsgs) (*api.ResponseReceiveMsgs, *api.Error) {
+	client := req.Client
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultMessageBatch
+	}
+	if limit > maxMessageBatch {
+		limit = maxMessageBatch
+	}
+	// One extra to know if there are more
+	messages, err := client.server.X3DHServer.ListMessages(client.username, params.AfterID, limit+1)
+	if err != nil {
+		fmt.Println("Error listing messages for user", client.username)
+		return nil, internalError()
+	}
+	more := len(messages) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	batch := make([]api.QueuedMessage, 0, len(messages))
+	for _, messageData := range messages {
+		batch = append(batch, toQueuedMessage(messageData))
+	}
+	cursor := params.AfterID
+	if len(batch) > 0 {
+		cursor = batch[len(batch)-1].MessageID
+	}
+	fmt.Println("User", client.username, "received", len(batch), "messages, more:", more)
+	return &api.ResponseReceiveMsgs{
+		Success:  true,
+		Messages: batch,
+		Cursor:   cursor,
+		More:     more,
+	}, nil
+}
+
+func handleSubscribeMessages(req *Request, params *api.RequestSubscribeMsgs) (*api.ResponseSubscribeMsgs, *api.Error) {
+	client := req.Client
+	client.push.Store(params.Push)
+	fmt.Println("User", client.username, "set message push to", params.Push)
+	if params.Push {
+		req.AfterResponse(client.PushQueuedMessages)
+	}
+	return &api.ResponseSubscribeMsgs{
+		Success: true,
+		Push:    params.Push,
+	}, nil
+}
+
+func handleAckMessage(req *Request, params *api.RequestAckMsg) (*api.ResponseAckMsg, *api.Error) {
+	client := req.Client
+	// Remove from queue (only the recipient can acknowledge)
+	messageData, ok, err := client.server.X3DHServer.AckMessage(client.username, params.MessageID)
+	if err != nil {
+		fmt.Println("Error acknowledging message", params.MessageID, "for user", client.username)
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "acknowledged message", params.MessageID, ":", ok)
+	// Tell the sender it was delivered
+	if ok {
+		// Allows one read receipt for it
+		err = client.server.X3DHServer.RecordDelivery(messageData)
+		if err != nil {
+			fmt.Println("Error recording delivery of message", messageData.ID, "to user", client.username, ":", err)
+		}
+		req.AfterResponse(func() {
+			err := client.server.SendReceipt(x3dh_server.ReceiptData{
+				OwnerID:   messageData.SenderID,
+				FromID:    client.username,
+				Type:      x3dh_core.ReceiptDelivered,
+				MessageID: messageData.ID,
+			})
+			// Senders that deleted their account get no receipts
+			if err != nil && err != x3dh_server.ErrClientNotFound {
+				fmt.Println("Error sending delivery receipt for message", messageData.ID, "to user", messageData.SenderID, ":", err)
+			}
+		})
+	}
+	return &api.ResponseAckMsg{
+		Success:   ok,
+		MessageID: params.MessageID,
+	}, nil
+}
+
+func handleUserStatus(req *Request, params *api.RequestUserStatus) (*api.ResponseUserStatus, *api.Error) {
+	client := req.Client
+	// Check if self is registered
+	registered, err := client.server.X3DHServer.IsClientRegistered(client.username)
+	if err != nil {
+		fmt.Println("Error checking if user", client.username, "is registered")
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "checked if self is registered")
+
+	// If registered, notify after the response if otp is running low
+	if registered {
+		req.AfterResponse(client.notifyLowOTPs)
+	}
+	return &api.ResponseUserStatus{
+		Success: registered,
+	}, nil
+}
+
+func (client *WsClient) notifyLowOTPs() {
+	count, err := client.server.X3DHServer.GetRemainingOTPCount(client.username)
+	if err != nil {
+		fmt.Println("Error getting remaining OTP count for user", client.username)
+		return
+	}
+	if count < client.server.lowOTPThreshold {
+		// Notify user
+		fmt.Println("Notifying user", client.username, "that OTP is running low")
+		// Send notification
+		notificationBytes := getLowOTPNotification()
+		if notificationBytes != nil {
+			client.sendWait(notificationBytes)
+		}
+	}
+}
+
+func handleRotateIdentity(req *Request, params *api.RequestRotateIdentity) (*api.ResponseRotateIdentity, *api.Error) {
+	client := req.Client
+	if !params.Rotation.IsSigned() && !client.server.verifyPassword(client.username, params.Password) {
+		// Unsigned resets are only proven by the account password
+		logSecurityEvent(client.username, "rotation_rejected", "identity reset without valid password")
+		return nil, api.NewError(api.ErrCodeInvalidPassword, "an identity reset requires the account password")
+	}
+	// Replace identity (the old key must still be the stored one)
+	err := client.server.X3DHServer.RotateIdentity(client.username, params.Bundle, params.Rotation)
+	switch err {
+	case nil:
+		fmt.Println("User", client.username, "changed identity key, signed:", params.Rotation.IsSigned())
+	case x3dh_server.ErrInvalidBundle:
+		logSecurityEvent(client.username, "rotation_rejected", "invalid signed pre key signature")
+		return nil, api.NewError(api.ErrCodeInvalidBundle, err.Error())
+	case x3dh_server.ErrInvalidRotation, x3dh_server.ErrIdentityMismatch, x3dh_server.ErrClientNotFound:
+		logSecurityEvent(client.username, "rotation_rejected", err.Error())
+		return nil, api.NewError(api.ErrCodeInvalidRotation, err.Error())
+	default:
+		fmt.Println("User", client.username, "failed to change identity key:", err)
+		return nil, internalError()
+	}
+	// Notify connected contacts, others notice on their next bundle fetch
+	notificationBytes := buildNotification(&api.NotifyIdentityChanged{
+		UserID:   client.username,
+		Rotation: params.Rotation,
+	}, "notify_identity_changed")
+	req.AfterResponse(func() {
+		client.server.NotifyContacts(client.username, notificationBytes)
+	})
+	return &api.ResponseRotateIdentity{
+		Success: true,
+	}, nil
+}
+
+func handleIdentityHistory(req *Request, params *api.RequestIdentityHistory) (*api.ResponseIdentityHistory, *api.Error) {
+	client := req.Client
+	// Get continuity statements
+	rotations, ok, err := client.server.X3DHServer.GetIdentityRotations(params.UserID)
+	if err != nil {
+		fmt.Println("Db error getting identity history for user", params.UserID)
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "requested identity history for user", params.UserID, ":", ok)
+	return &api.ResponseIdentityHistory{
+		Success:   ok,
+		UserID:    params.UserID,
+		Rotations: rotations,
+	}, nil
+}
+
+func getIdentityDeletedNotification(username string) []byte {
+	return buildNotification(&api.NotifyIdentityDeleted{
+		UserID: username,
+	}, "notify_identity_deleted")
+}
+
+func handleDeleteAccount(req *Request, params *api.RequestDeleteAccount) (*api.ResponseDeleteAccount, *api.Error) {
+	client := req.Client
+	if params.ConfirmUsername != client.username {
+		return nil, api.NewError(api.ErrCodeNotConfirmed, "confirm_username must be your username")
+	}
+	if !client.server.verifyPassword(client.username, params.Password) {
+		logSecurityEvent(client.username, "delete_rejected", "account deletion without valid password")
+		return nil, api.NewError(api.ErrCodeInvalidPassword, "deleting the account requires the account password")
+	}
+	// Account, bundle, rotations and queued messages
+	_, err := client.server.X3DHServer.DeleteAccount(client.username)
+	if err != nil {
+		fmt.Println("Error deleting account of user", client.username, ":", err)
+		return nil, internalError()
+	}
+	logSecurityEvent(client.username, "account_deleted", "deleted by owner")
+	req.AfterResponse(func() {
+		client.server.RemoveUser(client.username)
+	})
+	return &api.ResponseDeleteAccount{
+		Success: true,
+	}, nil
+}
+
+func handleSetPresence(req *Request, params *api.RequestSetPresence) (*api.ResponseSetPresence, *api.Error) {
+	client := req.Client
+	presence := x3dh_server.PresenceSettings{
+		Visibility:    params.Visibility,
+		ShareLastSeen: params.ShareLastSeen,
+		Contacts:      params.Contacts,
+	}
+	_, err := client.server.X3DHServer.SetUserPresence(client.username, presence)
+	switch err {
+	case nil:
+	case x3dh_server.ErrInvalidPresence:
+		return nil, api.NewError(api.ErrCodeInvalidRequest, "visibility must be nobody, contacts (with at most 1000 contacts) or everyone")
+	default:
+		fmt.Println("Error setting presence of user", client.username, ":", err)
+		return nil, internalError()
+	}
+	client.server.updatePresence(client.username, presence)
+	fmt.Println("User", client.username, "set presence visibility to", params.Visibility)
+	// Watchers that can no longer see it get unknown
+	req.AfterResponse(func() {
+		client.server.NotifyPresence(client.username)
+	})
+	return &api.ResponseSetPresence{
+		Success: true,
+	}, nil
+}
+
+func handleSubscribePresence(req *Request, params *api.RequestSubscribePresence) (*api.ResponseSubscribePresence, *api.Error) {
+	client := req.Client
+	if len(params.UserIDs) > maxPresenceSubscriptions {
+		return nil, api.NewError(api.ErrCodeInvalidRequest, fmt.Sprint("at most ", maxPresenceSubscriptions, " users can be watched"))
+	}
+	users := slices.Clone(params.UserIDs)
+	slices.Sort(users)
+	users = slices.Compact(users)
+	client.server.SetPresenceSubscription(client, users)
+	presence, err := client.server.GetPresence(client.username, users)
+	if err != nil {
+		fmt.Println("Error getting presence for user", client.username, ":", err)
+		return nil, internalError()
+	}
+	fmt.Println("User", client.username, "watches presence of", len(users), "users")
+	return &api.ResponseSubscribePresence{
+		Success:  true,
+		Presence: presence,
+	}, nil
+}
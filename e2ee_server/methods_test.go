@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	api "tux.tech/e2ee/api"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Server on the memory store, without listeners
+func newTestServer(t *testing.T) *WsServer {
+	t.Helper()
+	config := DefaultConfig()
+	config.Store.Backend = x3dh_server.BackendMemory
+	server, err := NewWsServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.X3DHServer.Close() })
+	return server
+}
+
+// Connection of alice on server before hello
+func testClientOf(server *WsServer) *WsClient {
+	client := testClient("alice", 0)
+	client.server = server
+	return client
+}
+
+func testHello(version int) *api.RequestHello {
+	return &api.RequestHello{
+		ProtocolVersion:    version,
+		MinProtocolVersion: api.MinProtocolVersion,
+		CipherSuites:       []string{api.CipherSuiteX25519AESGCM},
+		Encodings:          []string{api.EncodingJSON},
+		Client:             "test",
+	}
+}
+
+// Send hello through the registry of server, returns the response or error
+func sendHello(t *testing.T, server *WsServer, client *WsClient, hello *api.RequestHello) (*api.ResponseHello, *api.Error) {
+	t.Helper()
+	params, err := json.Marshal(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.handlers.Dispatch(client, &api.InboundMessage{ID: "1", Method: "hello", Params: params})
+	response := nextFrame(t, client)
+	if response == nil {
+		t.Fatalf("connection closed without a response")
+	}
+	if response.Error != nil {
+		return nil, response.Error
+	}
+	result := &api.ResponseHello{}
+	if err := json.Unmarshal(response.Params, result); err != nil {
+		t.Fatal(err)
+	}
+	return result, nil
+}
+
+func TestHelloNegotiation(t *testing.T) {
+	server := newTestServer(t)
+	tests := []struct {
+		name  string
+		hello func(hello *api.RequestHello)
+		// Zero if the client is rejected
+		wantVersion int
+		wantCipher  string
+	}{
+		{"current client", func(hello *api.RequestHello) {}, api.ProtocolVersion, api.CipherSuiteX25519AESGCM},
+		{"older client", func(hello *api.RequestHello) { hello.ProtocolVersion = api.MinProtocolVersion }, api.MinProtocolVersion, api.CipherSuiteX25519AESGCM},
+		{"newer client", func(hello *api.RequestHello) { hello.ProtocolVersion = api.ProtocolVersion + 3 }, api.ProtocolVersion, api.CipherSuiteX25519AESGCM},
+		{"below the minimum", func(hello *api.RequestHello) {
+			hello.ProtocolVersion, hello.MinProtocolVersion = api.MinProtocolVersion-1, 0
+		}, 0, ""},
+		{"above the maximum", func(hello *api.RequestHello) {
+			hello.ProtocolVersion, hello.MinProtocolVersion = api.ProtocolVersion+3, api.ProtocolVersion+1
+		}, 0, ""},
+		{"preferred cipher first", func(hello *api.RequestHello) {
+			hello.CipherSuites = []string{"x3dh-x448-chacha20", api.CipherSuiteX25519AESGCM}
+		}, api.ProtocolVersion, api.CipherSuiteX25519AESGCM},
+		{"no common cipher", func(hello *api.RequestHello) { hello.CipherSuites = []string{"x3dh-x448-chacha20"} }, 0, ""},
+		{"no cipher", func(hello *api.RequestHello) { hello.CipherSuites = nil }, 0, ""},
+		{"no common encoding", func(hello *api.RequestHello) { hello.Encodings = []string{"cbor"} }, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := testClientOf(server)
+			hello := testHello(api.ProtocolVersion)
+			tt.hello(hello)
+			response, apiErr := sendHello(t, server, client, hello)
+			if tt.wantVersion == 0 {
+				if apiErr == nil || apiErr.Code != api.ErrCodeIncompatible {
+					t.Fatalf("hello = %+v, %+v; want %s", response, apiErr, api.ErrCodeIncompatible)
+				}
+				// Rejected clients are disconnected after the error
+				if len(client.send) != 1 || nextFrame(t, client) != nil {
+					t.Fatalf("incompatible client was not disconnected")
+				}
+				if client.protocolVersion != 0 {
+					t.Fatalf("protocol version = %d after rejection; want 0", client.protocolVersion)
+				}
+				return
+			}
+			if apiErr != nil {
+				t.Fatalf("hello = %+v; want a response", apiErr)
+			}
+			if response.ProtocolVersion != tt.wantVersion || response.CipherSuite != tt.wantCipher || response.Encoding != api.EncodingJSON {
+				t.Fatalf("hello = %d, %s, %s; want %d, %s, %s", response.ProtocolVersion, response.CipherSuite, response.Encoding, tt.wantVersion, tt.wantCipher, api.EncodingJSON)
+			}
+			if client.protocolVersion != tt.wantVersion {
+				t.Fatalf("connection version = %d; want %d", client.protocolVersion, tt.wantVersion)
+			}
+			if response.Limits.MaxSignalSize != maxSignalSize || response.Limits.MaxMessageBatch != maxMessageBatch {
+				t.Fatalf("limits = %+v; want the signal and batch limits", response.Limits)
+			}
+		})
+	}
+
+	// Once per connection
+	client := testClientOf(server)
+	if _, apiErr := sendHello(t, server, client, testHello(api.ProtocolVersion)); apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	if _, apiErr := sendHello(t, server, client, testHello(api.ProtocolVersion)); apiErr == nil || apiErr.Code != api.ErrCodeInvalidRequest {
+		t.Fatalf("second hello = %+v; want %s", apiErr, api.ErrCodeInvalidRequest)
+	}
+}
+
+// Clients gate features on the method list, it must match the version
+func TestHelloMethods(t *testing.T) {
+	server := newTestServer(t)
+	for version := api.MinProtocolVersion; version <= api.ProtocolVersion; version++ {
+		client := testClientOf(server)
+		response, apiErr := sendHello(t, server, client, testHello(version))
+		if apiErr != nil {
+			t.Fatalf("hello version %d = %+v", version, apiErr)
+		}
+		if !slices.IsSorted(response.Methods) {
+			t.Fatalf("methods at version %d = %v; want them sorted", version, response.Methods)
+		}
+		for method, introduced := range api.MethodVersions {
+			if listed := slices.Contains(response.Methods, method); listed != (introduced <= version) {
+				t.Errorf("method %s (version %d) listed at version %d = %v; want %v", method, introduced, version, listed, !listed)
+			}
+		}
+		if len(response.Methods) != len(api.MethodsForVersion(version)) {
+			t.Fatalf("methods at version %d = %v; want only known methods", version, response.Methods)
+		}
+	}
+
+	// Every listed method has a handler
+	for method := range api.MethodVersions {
+		if _, ok := server.handlers.handlers[method]; !ok {
+			t.Errorf("method %s has no handler", method)
+		}
+	}
+	// Features the client checks for
+	response, _ := sendHello(t, server, testClientOf(server), testHello(2))
+	if !slices.Contains(response.Methods, "subscribe_presence") || slices.Contains(response.Methods, "signal_ephemeral") || slices.Contains(response.Methods, "subscribe_receipts") {
+		t.Fatalf("methods at version 2 = %v; want presence without signals and receipts", response.Methods)
+	}
+	response, _ = sendHello(t, server, testClientOf(server), testHello(4))
+	if !slices.Contains(response.Methods, "signal_ephemeral") || !slices.Contains(response.Methods, "subscribe_receipts") {
+		t.Fatalf("methods at version 4 = %v; want signals and receipts", response.Methods)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	api "tux.tech/e2ee/api"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Users one connection can watch
+const maxPresenceSubscriptions = 1000
+
+// Replace the users a connection watches
+func (server *WsServer) SetPresenceSubscription(client *WsClient, users []string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.unwatchLocked(client)
+	for _, user := range users {
+		if server.watchers[user] == nil {
+			server.watchers[user] = make(map[*WsClient]bool)
+		}
+		server.watchers[user][client] = true
+	}
+	client.watching = users
+}
+
+// Drop all subscriptions of a connection, server.mu must be held
+func (server *WsServer) unwatchLocked(client *WsClient) {
+	for _, user := range client.watching {
+		delete(server.watchers[user], client)
+		if len(server.watchers[user]) == 0 {
+			delete(server.watchers, user)
+		}
+	}
+	client.watching = nil
+}
+
+func (server *WsServer) isOnline(user string) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for client := range server.clients {
+		if client.username == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Presence of users as seen by viewer
+func (server *WsServer) GetPresence(viewer string, users []string) ([]api.Presence, error) {
+	result := make([]api.Presence, 0, len(users))
+	for _, username := range users {
+		user, ok, err := server.X3DHServer.GetUser(username)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, presenceOf(viewer, username, user, ok, server.isOnline(username)))
+	}
+	return result, nil
+}
+
+// Unknown unless the user exists and lets viewer see it
+func presenceOf(viewer string, username string, user x3dh_server.UserRecord, exists bool, online bool) api.Presence {
+	presence := api.Presence{
+		UserID: username,
+		Status: api.StatusUnknown,
+	}
+	if !exists || !user.Presence.VisibleTo(viewer) {
+		return presence
+	}
+	if online {
+		presence.Status = api.StatusOnline
+		return presence
+	}
+	presence.Status = api.StatusOffline
+	if user.Presence.ShareLastSeen && !user.LastSeen.IsZero() {
+		lastSeen := user.LastSeen
+		presence.LastSeen = &lastSeen
+	}
+	return presence
+}
+
+// Send the current presence of a user to every connection watching it. Called
+// when its first connection opens, its last one closes or its settings change.
+func (server *WsServer) NotifyPresence(username string) {
+	watchers := server.selectWatchers(username)
+	if len(watchers) == 0 {
+		return
+	}
+	user, ok, err := server.X3DHServer.GetUser(username)
+	if err != nil {
+		fmt.Println("Error getting presence of user", username, ":", err)
+		return
+	}
+	online := server.isOnline(username)
+	for _, watcher := range watchers {
+		notificationBytes := buildNotification(&api.NotifyPresence{
+			Presence: presenceOf(watcher.username, username, user, ok, online),
+		}, "notify_presence")
+		if notificationBytes != nil {
+			watcher.trySend(notificationBytes)
+		}
+	}
+}
+
+func (server *WsServer) selectWatchers(username string) []*WsClient {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	watchers := make([]*WsClient, 0, len(server.watchers[username]))
+	for client := range server.watchers[username] {
+		watchers = append(watchers, client)
+	}
+	return watchers
+}
+
+// Keep the settings of a connected user in sync after set_presence
+func (server *WsServer) updatePresence(username string, presence x3dh_server.PresenceSettings) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, connected := server.presence[username]; connected {
+		server.presence[username] = presence
+	}
+}
+
+// Settings of username, from memory while it is connected
+func (server *WsServer) presenceSettings(username string) (x3dh_server.PresenceSettings, error) {
+	server.mu.Lock()
+	presence, connected := server.presence[username]
+	server.mu.Unlock()
+	if connected {
+		return presence, nil
+	}
+	user, _, err := server.X3DHServer.GetUser(username)
+	return user.Presence, err
+}
+
+// Connections of other users that have username as a contact, as far as the
+// server can tell: they watch its presence and may see it, or share their own
+// presence with it. Users it cannot link notice changes when they next fetch
+// a bundle.
+func (server *WsServer) contactConnections(username string) []*WsClient {
+	presence, err := server.presenceSettings(username)
+	if err != nil {
+		// Sharing users are still found
+		fmt.Println("Error getting presence of user", username, ":", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	contacts := make([]*WsClient, 0)
+	for client := range server.clients {
+		if client.username == username {
+			continue
+		}
+		watching := server.watchers[username][client] && presence.VisibleTo(client.username)
+		if watching || slices.Contains(server.presence[client.username].Contacts, username) {
+			contacts = append(contacts, client)
+		}
+	}
+	return contacts
+}
+
+// Send a notification about username to the connections of its contacts
+func (server *WsServer) NotifyContacts(username string, message []byte) {
+	if message == nil {
+		return
+	}
+	for _, client := range server.contactConnections(username) {
+		client.trySend(message)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	x3dh_core "tux.tech/x3dh/core"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Create the account of username with presence and open a connection for it
+func connectWithPresence(t *testing.T, server *WsServer, username string, presence x3dh_server.PresenceSettings) *WsClient {
+	t.Helper()
+	if _, err := server.X3DHServer.CreateUser(x3dh_server.UserRecord{Username: username}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.X3DHServer.SetUserPresence(username, presence); err != nil {
+		t.Fatal(err)
+	}
+	client := testClient(username, 0)
+	client.server = server
+	if _, err := server.SetClient(client, presence); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func contactNames(server *WsServer, username string) []string {
+	names := make([]string, 0)
+	for _, client := range server.contactConnections(username) {
+		names = append(names, client.username)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestContactConnections(t *testing.T) {
+	server := newTestServer(t)
+	contactsOnly := func(contacts ...string) x3dh_server.PresenceSettings {
+		return x3dh_server.PresenceSettings{Visibility: x3dh_core.PresenceContacts, Contacts: contacts}
+	}
+	alice := connectWithPresence(t, server, "alice", contactsOnly("bob"))
+	bob := connectWithPresence(t, server, "bob", x3dh_server.PresenceSettings{})
+	carol := connectWithPresence(t, server, "carol", x3dh_server.PresenceSettings{})
+	// Shares its presence with alice without watching
+	connectWithPresence(t, server, "dave", contactsOnly("alice"))
+	connectWithPresence(t, server, "eve", x3dh_server.PresenceSettings{})
+	// Watching alice only counts if alice lets the watcher see it
+	server.SetPresenceSubscription(bob, []string{"alice"})
+	server.SetPresenceSubscription(carol, []string{"alice"})
+
+	if got, want := contactNames(server, "alice"), []string{"bob", "dave"}; !slices.Equal(got, want) {
+		t.Fatalf("contacts of alice = %v; want %v", got, want)
+	}
+	// Other connections of alice are not its contacts
+	if got := contactNames(server, "dave"); !slices.Equal(got, []string{}) {
+		t.Fatalf("contacts of dave = %v; want none", got)
+	}
+
+	// Settings changed by set_presence apply right away
+	everyone := x3dh_server.PresenceSettings{Visibility: x3dh_core.PresenceEveryone}
+	server.updatePresence("alice", everyone)
+	if got, want := contactNames(server, "alice"), []string{"bob", "carol", "dave"}; !slices.Equal(got, want) {
+		t.Fatalf("contacts of alice visible to everyone = %v; want %v", got, want)
+	}
+	server.updatePresence("dave", x3dh_server.PresenceSettings{})
+	if got, want := contactNames(server, "alice"), []string{"bob", "carol"}; !slices.Equal(got, want) {
+		t.Fatalf("contacts of alice after dave stopped sharing = %v; want %v", got, want)
+	}
+
+	// Once disconnected, the settings of alice come from the store
+	server.UnsetClient(alice)
+	if _, ok := server.presence["alice"]; ok {
+		t.Fatalf("presence of alice kept after its last connection closed")
+	}
+	server.updatePresence("alice", everyone)
+	if _, ok := server.presence["alice"]; ok {
+		t.Fatalf("presence of a disconnected user cached by updatePresence")
+	}
+	if got, want := contactNames(server, "alice"), []string{"bob"}; !slices.Equal(got, want) {
+		t.Fatalf("contacts of disconnected alice = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errServerClosing = errors.New("server is shutting down")
+
+// How often Shutdown checks whether every connection is closed
+const drainPollInterval = 50 * time.Millisecond
+
+// Close frame telling clients to reconnect later or elsewhere
+func goingAwayFrame() []byte {
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "server going away")
+}
+
+// Start handling a request, false once Shutdown started
+func (server *WsServer) beginRequest() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.closing {
+		return false
+	}
+	server.inflight.Add(1)
+	return true
+}
+
+func (server *WsServer) endRequest() {
+	server.inflight.Done()
+}
+
+// Refuse new connections and requests, wait for running requests (and the
+// notifications they send) and close every connection with a going away
+// frame once its queued frames are written. Connections still open when ctx
+// is done are dropped. The HTTP listener must be shut down separately.
+func (server *WsServer) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.closing = true
+	server.mu.Unlock()
+
+	err := waitContext(ctx, server.inflight.Wait)
+	if err != nil {
+		fmt.Println("Requests still running at shutdown:", err)
+	}
+	everyClient := func(client *WsClient) bool { return true }
+	clients := server.selectClients(everyClient)
+	fmt.Println("Closing", len(clients), "connections")
+	for _, client := range clients {
+		client.GoAway()
+	}
+	err = server.waitDrained(ctx)
+	if err != nil {
+		// Out of time, drop the rest
+		for _, client := range server.selectClients(everyClient) {
+			client.stop()
+		}
+	}
+	return err
+}
+
+// Wait until every connection is gone (their ReadPump unregistered them)
+func (server *WsServer) waitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		server.mu.Lock()
+		remaining := len(server.clients)
+		server.mu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run wait, giving up when ctx is done
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	api "tux.tech/e2ee/api"
+	x3dh_server "tux.tech/x3dh/server"
+)
+
+// Send a request over conn and read frames up to its response, skipping
+// notifications
+func roundTrip(t *testing.T, conn *websocket.Conn, id string, method string, params interface{}) *api.OutboundMessage {
+	t.Helper()
+	send(t, conn, id, method, params)
+	return readResponse(t, conn, id)
+}
+
+func send(t *testing.T, conn *websocket.Conn, id string, method string, params interface{}) {
+	t.Helper()
+	marshalled, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(&api.InboundMessage{ID: id, Method: method, Params: marshalled}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readResponse(t *testing.T, conn *websocket.Conn, id string) *api.OutboundMessage {
+	t.Helper()
+	for {
+		message := &api.OutboundMessage{}
+		if err := conn.ReadJSON(message); err != nil {
+			t.Fatalf("reading the response to %s: %v", id, err)
+		}
+		if message.ID == id {
+			return message
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := newTestServer(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server.handlers.Handle("status", func(req *Request) (interface{}, *api.Error) {
+		close(started)
+		<-release
+		return struct{}{}, nil
+	})
+	url := newTestListener(t, server)
+	conn := dialTestClient(t, server, url, "alice")
+	if response := roundTrip(t, conn, "1", "hello", testHello(api.ProtocolVersion)); response.Error != nil {
+		t.Fatalf("hello = %+v", response.Error)
+	}
+
+	send(t, conn, "2", "status", struct{}{})
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+	// New connections are refused once Shutdown started
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.closing
+	})
+	if _, err := server.SetClient(testClient("bob", 0), x3dh_server.PresenceSettings{}); !errors.Is(err, errServerClosing) {
+		t.Fatalf("SetClient during shutdown = %v; want %v", err, errServerClosing)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown = %v before the running request finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The running request is answered before the connection closes
+	close(release)
+	if response := readResponse(t, conn, "2"); response.Error != nil {
+		t.Fatalf("status during shutdown = %+v; want a response", response.Error)
+	}
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Fatalf("connection closed with %v; want going away", err)
+			}
+			break
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if counts := server.sessionCounts(); len(counts) != 0 {
+		t.Fatalf("sessions after shutdown = %v; want none", counts)
+	}
+	if _, err := server.SetClient(testClient("bob", 0), x3dh_server.PresenceSettings{}); !errors.Is(err, errServerClosing) {
+		t.Fatalf("SetClient after shutdown = %v; want %v", err, errServerClosing)
+	}
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
+	api "tux.tech/e2ee/api"
 	x3dh_server "tux.tech/x3dh/server"
 )
 
@@ -21,47 +21,252 @@ var upgrader = websocket.Upgrader{
 }
 
 type WsServer struct {
-	dbClient   *mongo.Client
-	X3DHServer x3dh_server.Server
+	X3DHServer *x3dh_server.Server
 	clients    map[*WsClient]bool
 	mu         sync.Mutex
+	handlers   *HandlerRegistry
+	metrics    *Metrics
+	// Connections watching the presence of each user, guarded by mu
+	watchers map[string]map[*WsClient]bool
+	// Presence settings of connected users, guarded by mu. Kept in sync by
+	// set_presence so finding contacts needs no storage lookups.
+	presence map[string]x3dh_server.PresenceSettings
+	// Set by Shutdown, guarded by mu
+	closing bool
+	// Requests being handled
+	inflight sync.WaitGroup
+	// Users with fewer one time pre keys left are asked for more
+	lowOTPThreshold int
 }
 
-func NewWsServer() *WsServer {
-	// Connect to MongoDB
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.Background(), clientOptions)
+func NewWsServer(config Config) (*WsServer, error) {
+	// Open storage backend
+	x3dhServer, err := x3dh_server.NewServer(config.StoreConfig())
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	metrics := NewMetrics()
 	return &WsServer{
 		clients:    make(map[*WsClient]bool),
-		X3DHServer: *x3dh_server.NewServer(),
-		dbClient:   client,
-	}
+		X3DHServer: x3dhServer,
+		handlers:   newHandlerRegistry(metrics),
+		metrics:    metrics,
+		watchers:   make(map[string]map[*WsClient]bool),
+		presence:   make(map[string]x3dh_server.PresenceSettings),
+
+		lowOTPThreshold: config.LowOTPThreshold,
+	}, nil
 }
 
-func (server *WsServer) SetClient(client *WsClient) {
+// Returns true for the first connection of the user, errServerClosing once
+// Shutdown started. presence is what the user had when authenticated, it is
+// kept until its last connection closes.
+func (server *WsServer) SetClient(client *WsClient, presence x3dh_server.PresenceSettings) (bool, error) {
 	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.closing {
+		return false, errServerClosing
+	}
 	server.clients[client] = true
-	server.mu.Unlock()
+	first := server.countSessionsLocked(client.username) == 1
+	// Other connections kept it up to date since
+	if first {
+		server.presence[client.username] = presence
+	}
+	return first, nil
 }
 
-func (server *WsServer) UnsetClient(client *WsClient) {
+// Returns true if it was the last connection of the user
+func (server *WsServer) UnsetClient(client *WsClient) bool {
 	server.mu.Lock()
+	defer server.mu.Unlock()
 	delete(server.clients, client)
-	server.mu.Unlock()
+	server.unwatchLocked(client)
+	last := server.countSessionsLocked(client.username) == 0
+	if last {
+		delete(server.presence, client.username)
+	}
+	return last
 }
 
-func (server *WsServer) SendNotificationToUser(user string, message []byte) {
-	server.mu.Lock()
+func (server *WsServer) countSessionsLocked(user string) int {
+	count := 0
 	for client := range server.clients {
 		if client.username == user {
-			client.send <- message
+			count++
+		}
+	}
+	return count
+}
+
+// Connections matching filter. Frames are sent to the copy, never while
+// holding the lock.
+func (server *WsServer) selectClients(filter func(client *WsClient) bool) []*WsClient {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	selected := make([]*WsClient, 0)
+	for client := range server.clients {
+		if filter(client) {
+			selected = append(selected, client)
+		}
+	}
+	return selected
+}
+
+func (server *WsServer) clientsOf(user string) []*WsClient {
+	return server.selectClients(func(client *WsClient) bool {
+		return client.username == user
+	})
+}
+
+func (server *WsServer) SendNotificationToUser(user string, message []byte) {
+	if message == nil {
+		return
+	}
+	for _, client := range server.clientsOf(user) {
+		client.trySend(message)
+	}
+}
+
+// Push a new message to connections that subscribed, announce it to the others
+func (server *WsServer) DeliverMessage(user string, messageData x3dh_server.MessageData) {
+	pushed := getMessageNotification(messageData)
+	announced := getNewMessageNotification(messageData.SenderID)
+	if pushed == nil || announced == nil {
+		return
+	}
+	for _, client := range server.clientsOf(user) {
+		if client.push.Load() {
+			client.trySend(pushed)
+		} else {
+			client.trySend(announced)
+		}
+	}
+}
+
+// Send a receipt to the connections of its owner that subscribed to receipts,
+// or keep it until the owner subscribes if there are none
+func (server *WsServer) SendReceipt(receipt x3dh_server.ReceiptData) error {
+	subscribers := server.selectClients(func(client *WsClient) bool {
+		return client.username == receipt.OwnerID && client.receipts.Load()
+	})
+	if len(subscribers) == 0 {
+		_, err := server.X3DHServer.KeepReceipt(receipt)
+		return err
+	}
+	receipt.Timestamp = time.Now().UTC()
+	notificationBytes := buildNotification(&api.NotifyReceipt{
+		Receipt: toReceipt(receipt),
+	}, "notify_receipt")
+	if notificationBytes == nil {
+		return nil
+	}
+	for _, client := range subscribers {
+		client.trySend(notificationBytes)
+	}
+	return nil
+}
+
+// Purge expired messages every interval and tell connected senders, and drop
+// receipts and deliveries as old. Runs until ctx is done.
+func (server *WsServer) RunPurgeJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		receipts, err := server.X3DHServer.PurgeExpiredReceipts()
+		if err != nil {
+			fmt.Println("Error purging expired receipts:", err)
+		}
+		if receipts > 0 {
+			fmt.Println("Purged", receipts, "expired receipts and deliveries")
+		}
+		purged, err := server.X3DHServer.PurgeExpiredMessages()
+		if err != nil {
+			fmt.Println("Error purging expired messages:", err)
+		}
+		if len(purged) == 0 {
+			continue
+		}
+		fmt.Println("Purged", len(purged), "expired messages")
+		for _, messageData := range purged {
+			notificationBytes := buildNotification(&api.NotifyMessageExpired{
+				MessageID:   messageData.ID,
+				RecipientID: messageData.RecipientID,
+				Error:       api.ErrCodeMessageExpired,
+			}, "notify_message_expired")
+			server.SendNotificationToUser(messageData.SenderID, notificationBytes)
+		}
+	}
+}
+
+// Close every connection of a user once pending messages are written,
+// returns how many were closed
+func (server *WsServer) DisconnectUser(user string) int {
+	clients := server.clientsOf(user)
+	for _, client := range clients {
+		client.Close()
+	}
+	return len(clients)
+}
+
+// Tell the contacts of a deleted account it is gone and close its connections
+func (server *WsServer) RemoveUser(user string) {
+	server.NotifyContacts(user, getIdentityDeletedNotification(user))
+	server.DisconnectUser(user)
+}
+
+// Delete accounts inactive for longer than the configured TTL every interval.
+// Runs until ctx is done.
+func (server *WsServer) RunExpiryJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Long lived connections count as activity
+		for _, user := range server.connectedUsers() {
+			if err := server.X3DHServer.TouchUser(user); err != nil {
+				fmt.Println("Error updating last seen for user", user, ":", err)
+			}
+		}
+		expired, err := server.X3DHServer.ExpireInactiveAccounts()
+		if err != nil {
+			fmt.Println("Error expiring inactive accounts:", err)
+		}
+		for _, user := range expired {
+			logSecurityEvent(user, "account_deleted", "inactive")
+			server.RemoveUser(user)
 		}
 	}
-	server.mu.Unlock()
+}
+
+func (server *WsServer) connectedUsers() []string {
+	sessions := server.sessionCounts()
+	users := make([]string, 0, len(sessions))
+	for user := range sessions {
+		users = append(users, user)
+	}
+	return users
+}
+
+// Open connections per user
+func (server *WsServer) sessionCounts() map[string]int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	sessions := make(map[string]int)
+	for client := range server.clients {
+		sessions[client.username]++
+	}
+	return sessions
 }
 
 func (server *WsServer) hashPassword(password string) (string, error) {
@@ -77,38 +282,75 @@ func (server *WsServer) checkPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func (server *WsServer) authenticateUser(username, password string) bool {
-	collection := server.dbClient.Database("x3dh_auth").Collection("users")
+// Rejected uploads, failed logins and other events worth auditing, prefixed so
+// they can be filtered from the rest of the log
+func logSecurityEvent(username string, event string, detail string) {
+	fmt.Println(time.Now().UTC().Format(time.RFC3339), "SECURITY", event, "user="+username, detail)
+}
 
-	// Find the user in the database
-	var result struct {
-		Username string `bson:"username"`
-		Password string `bson:"password"`
+// Check the password of an existing user (re-confirmation of sensitive requests)
+func (server *WsServer) verifyPassword(username, password string) bool {
+	user, ok, err := server.X3DHServer.GetUser(username)
+	if err != nil || !ok {
+		return false
 	}
-	err := collection.FindOne(context.Background(), bson.M{"username": username}).Decode(&result)
+	return server.checkPasswordHash(password, user.PasswordHash)
+}
+
+var (
+	errInvalidAuth      = errors.New("invalid auth")
+	errAccountSuspended = errors.New("account suspended")
+)
+
+// The account of username, created on first use
+func (server *WsServer) authenticateUser(username, password string) (x3dh_server.UserRecord, error) {
+	// Find the user in the database
+	user, ok, err := server.X3DHServer.GetUser(username)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// User does not exist, create a new user
-			hashedPassword, err := server.hashPassword(password)
-			if err != nil {
-				fmt.Println("Error hashing password:", err)
-				return false
-			}
+		fmt.Println("Error finding user:", err)
+		return x3dh_server.UserRecord{}, errInvalidAuth
+	}
+	if !ok {
+		// User does not exist, create a new user
+		hashedPassword, err := server.hashPassword(password)
+		if err != nil {
+			fmt.Println("Error hashing password:", err)
+			return x3dh_server.UserRecord{}, errInvalidAuth
+		}
 
-			newUser := bson.M{"username": username, "password": hashedPassword}
-			_, err = collection.InsertOne(context.Background(), newUser)
-			if err != nil {
-				fmt.Println("Error creating new user:", err)
-				return false
-			}
-			return true
+		user = x3dh_server.UserRecord{
+			Username:     username,
+			PasswordHash: hashedPassword,
+		}
+		created, err := server.X3DHServer.CreateUser(user)
+		if err != nil {
+			fmt.Println("Error creating new user:", err)
+			return x3dh_server.UserRecord{}, errInvalidAuth
+		}
+		if created {
+			return user, nil
+		}
+		// Created concurrently by another connection, check against that one
+		user, ok, err = server.X3DHServer.GetUser(username)
+		if err != nil || !ok {
+			fmt.Println("Error finding user:", err)
+			return x3dh_server.UserRecord{}, errInvalidAuth
 		}
-		fmt.Println("Error finding user:", err)
-		return false
 	}
 
 	// Check if the password matches the hashed password
-	return server.checkPasswordHash(password, result.Password)
+	if !server.checkPasswordHash(password, user.PasswordHash) {
+		logSecurityEvent(username, "auth_failed", "wrong password")
+		return x3dh_server.UserRecord{}, errInvalidAuth
+	}
+	if user.Suspended {
+		logSecurityEvent(username, "auth_failed", "account suspended")
+		return x3dh_server.UserRecord{}, errAccountSuspended
+	}
+	if err := server.X3DHServer.TouchUser(username); err != nil {
+		fmt.Println("Error updating last seen for user", username, ":", err)
+	}
+	return user, nil
 }
 
 func (server *WsServer) connnect(w http.ResponseWriter, r *http.Request) {
@@ -122,7 +364,12 @@ func (server *WsServer) connnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authenticate user
-	if !server.authenticateUser(user, password) {
+	account, err := server.authenticateUser(user, password)
+	if err == errAccountSuspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Invalid auth", http.StatusUnauthorized)
 		return
 	}
@@ -136,9 +383,18 @@ func (server *WsServer) connnect(w http.ResponseWriter, r *http.Request) {
 
 	client := NewWsClient(user, server, conn)
 
-	server.SetClient(client)
+	first, err := server.SetClient(client, account.Presence)
+	if err != nil {
+		// Shutdown started while upgrading
+		conn.WriteControl(websocket.CloseMessage, goingAwayFrame(), time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
 
 	fmt.Println("New connection from", user)
 	go client.WritePump()
 	go client.ReadPump()
+	if first {
+		server.NotifyPresence(user)
+	}
 }
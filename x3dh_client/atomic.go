@@ -0,0 +1,50 @@
+package x3dh_client
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write data to a temporary file next to the target, sync it and rename it over
+// the target. A crash leaves either the old or the new contents, never a mix.
+func WriteFileAtomic(target_filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(target_filename)
+	// Create temporary file in the same directory (rename must not cross filesystems)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target_filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	// Remove the temporary file on any failure
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	// Write and flush to disk
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Replace the target
+	if err := os.Rename(tmpName, target_filename); err != nil {
+		return err
+	}
+	committed = true
+	// Persist the rename (best effort, not supported on every platform)
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package x3dh_client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Temporary files of WriteFileAtomic left in dir
+func leftoverTempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover := make([]string, 0)
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			leftover = append(leftover, entry.Name())
+		}
+	}
+	return leftover
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "client.json")
+	if err := os.WriteFile(target, []byte("old contents, longer than the new ones"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(target, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("contents = %q; want %q", data, "new")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("mode = %v; want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if leftover := leftoverTempFiles(t, dir); len(leftover) != 0 {
+		t.Fatalf("temporary files left: %v", leftover)
+	}
+
+	// New files get perm as well, regardless of the umask
+	created := filepath.Join(dir, "contact.json")
+	if err := WriteFileAtomic(created, []byte("{}"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(created); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatalf("new file = %v, %v; want mode %v", info, err, os.FileMode(0640))
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	// A non empty directory cannot be replaced by a file
+	target := filepath.Join(dir, "client.json")
+	if err := os.MkdirAll(filepath.Join(target, "keep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(target, []byte("new"), 0600); err == nil {
+		t.Fatalf("WriteFileAtomic over a directory = nil; want an error")
+	}
+	if leftover := leftoverTempFiles(t, dir); len(leftover) != 0 {
+		t.Fatalf("temporary files left after a failed write: %v", leftover)
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Fatalf("target after a failed write = %v, %v; want it unchanged", info, err)
+	}
+
+	// Missing directory
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "client.json"), []byte("new"), 0600); err == nil {
+		t.Fatalf("WriteFileAtomic in a missing directory = nil; want an error")
+	}
+}
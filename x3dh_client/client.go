@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	"go.step.sm/crypto/x25519"
 	X3DHCore "tux.tech/x3dh/core"
 )
 
@@ -20,6 +22,19 @@ type X3DHClient struct {
 	OneTimePreKeys []X3DHCore.X3DHFullOTP `json:"oneTimePreKeys"`
 	// Counter
 	OTPCounter int `json:"otpCounter"`
+	// Identity change not yet confirmed by the server
+	PendingRotation *X3DHCore.X3DHIdentityRotation `json:"pendingRotation,omitempty"`
+	// Identities replaced by rotations, newest last. Messages queued before a
+	// rotation were encrypted for them.
+	RetiredIdentities []RetiredIdentity `json:"retiredIdentities,omitempty"`
+}
+
+// Keys of a replaced identity, kept until no message for them can be queued
+type RetiredIdentity struct {
+	IdentityKey  X3DHCore.X3DHFullIK  `json:"identityKey"`
+	SignedPreKey X3DHCore.X3DHFullSPK `json:"signedPreKey"`
+	// Unix time of the rotation
+	RetiredAt int64 `json:"retiredAt"`
 }
 
 func NewClient() *X3DHClient {
@@ -49,8 +64,8 @@ func (c *X3DHClient) SaveClient(target_filename string) error {
 	if err != nil {
 		return err
 	}
-	// Write the data to the file
-	err = os.WriteFile(target_filename, data, 0644)
+	// Write the data to the file (private keys, owner only)
+	err = WriteFileAtomic(target_filename, data, 0600)
 	if err != nil {
 		return err
 	}
@@ -189,14 +204,34 @@ func (c *X3DHClient) BuildMessage(pkb *X3DHCore.X3DHKeyBundle, msg []byte) (*X3D
 	return im, nil
 }
 
+// Decrypt with the current identity, or a retired one if the message was
+// encrypted before a rotation
 func (c *X3DHClient) RecieveMessage(im *X3DHCore.InitialMessage) ([]byte, error) {
+	plaintext, err := c.receiveMessageWith(&c.IdentityKey, &c.SignedPreKey, im)
+	if err == nil {
+		return plaintext, nil
+	}
+	for i := len(c.RetiredIdentities) - 1; i >= 0; i-- {
+		retired := &c.RetiredIdentities[i]
+		plaintext, retiredErr := c.receiveMessageWith(&retired.IdentityKey, &retired.SignedPreKey, im)
+		if retiredErr == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *X3DHClient) receiveMessageWith(ik *X3DHCore.X3DHFullIK, spk *X3DHCore.X3DHFullSPK, im *X3DHCore.InitialMessage) ([]byte, error) {
+	if im.OneTimePreKeyID < 0 || im.OneTimePreKeyID >= len(c.OneTimePreKeys) {
+		return nil, errors.New("unknown one time pre key")
+	}
 	// Generate shared secret
 	// kb.signedPreKey to []byte
-	dh1, err := c.SignedPreKey.SignedPreKey.PrivateKey.SharedKey(im.IdentityKey)
+	dh1, err := spk.SignedPreKey.PrivateKey.SharedKey(im.IdentityKey)
 	if err != nil {
 		return nil, err
 	}
-	dh2, err := c.IdentityKey.IdentityKey.PrivateKey.SharedKey(im.EphemeralKey)
+	dh2, err := ik.IdentityKey.PrivateKey.SharedKey(im.EphemeralKey)
 	if err != nil {
 		return nil, err
 	}
@@ -212,7 +247,7 @@ func (c *X3DHClient) RecieveMessage(im *X3DHCore.InitialMessage) ([]byte, error)
 	// Build AD
 	ad := []byte{}
 	ad = append(ad, im.IdentityKey[:]...)
-	ad = append(ad, c.IdentityKey.IdentityKey.PublicKey[:]...)
+	ad = append(ad, ik.IdentityKey.PublicKey[:]...)
 	// Decrypt the message with the shared secret using AEAD schema (msg encrypted + ad)
 	plaintext, err := X3DHCore.DecryptAEAD(
 		sharedSecret,
@@ -228,6 +263,69 @@ func (c *X3DHClient) RecieveMessage(im *X3DHCore.InitialMessage) ([]byte, error)
 	return plaintext, nil
 }
 
+// Encrypt a signal for the holder of recipientIK. The shared secret combines
+// both identity keys, so only the sender could have built it.
+func (c *X3DHClient) BuildSignal(recipientIK x25519.PublicKey, msg []byte) (*X3DHCore.EphemeralSignal, error) {
+	// Generate Ephermal Key
+	ephemeralKey, err := X3DHCore.GenerateKeyPairX25519()
+	if err != nil {
+		return nil, err
+	}
+	// Generate shared secret
+	dh1, err := c.IdentityKey.IdentityKey.SharedKey(recipientIK)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := ephemeralKey.SharedKey(recipientIK)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret := []byte{}
+	sharedSecret = append(sharedSecret, dh1[:]...)
+	sharedSecret = append(sharedSecret, dh2[:]...)
+	// Build AD
+	ad := signalAD(c.IdentityKey.IdentityKey.PublicKey, recipientIK)
+	salt, nonce, ciphertext, err := X3DHCore.EncryptAEAD(sharedSecret, msg, ad)
+	if err != nil {
+		return nil, err
+	}
+	return &X3DHCore.EphemeralSignal{
+		IdentityKey:  c.IdentityKey.IdentityKey.PublicKey,
+		EphemeralKey: ephemeralKey.PublicKey,
+		Ciphertext:   ciphertext,
+		Nonce:        nonce,
+		Salt:         salt,
+	}, nil
+}
+
+// Decrypt a signal. The caller must check that signal.IdentityKey is the
+// pinned key of the sender.
+func (c *X3DHClient) ReceiveSignal(signal *X3DHCore.EphemeralSignal) ([]byte, error) {
+	// Generate shared secret
+	dh1, err := c.IdentityKey.IdentityKey.PrivateKey.SharedKey(signal.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := c.IdentityKey.IdentityKey.PrivateKey.SharedKey(signal.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret := []byte{}
+	sharedSecret = append(sharedSecret, dh1[:]...)
+	sharedSecret = append(sharedSecret, dh2[:]...)
+	// Build AD
+	ad := signalAD(signal.IdentityKey, c.IdentityKey.IdentityKey.PublicKey)
+	return X3DHCore.DecryptAEAD(sharedSecret, signal.Salt, signal.Nonce, signal.Ciphertext, ad)
+}
+
+// Sender and recipient key, labelled so a signal cannot pass as a message
+func signalAD(senderIK, recipientIK x25519.PublicKey) []byte {
+	ad := []byte("ephemeral-signal")
+	ad = append(ad, senderIK[:]...)
+	ad = append(ad, recipientIK[:]...)
+	return ad
+}
+
 func (c *X3DHClient) BatchGenerateOTPs(n int) ([]X3DHCore.X3DHPublicOTP, error) {
 	for i := 0; i < n; i++ {
 		err := c.generateOneTimePreKey()
@@ -243,3 +341,65 @@ func (c *X3DHClient) BatchGenerateOTPs(n int) ([]X3DHCore.X3DHPublicOTP, error)
 	// Return the OTP set
 	return otp_set, nil
 }
+
+// Replace the identity key and signed pre key. With signed set, the old identity
+// key vouches for the new one; otherwise the change is an unsigned reset.
+// The change stays pending until ClearPendingRotation is called.
+func (c *X3DHClient) RotateIdentity(signed bool) error {
+	// New Identity Key
+	ik, err := X3DHCore.GenerateFullIK()
+	if err != nil {
+		return err
+	}
+	// Continuity statement
+	timestamp := time.Now().Unix()
+	var rotation *X3DHCore.X3DHIdentityRotation
+	if signed {
+		rotation, err = X3DHCore.SignIdentityRotation(c.IdentityKey.IdentityKey, ik.IdentityKey.PublicKey, timestamp)
+		if err != nil {
+			return err
+		}
+	} else {
+		rotation = X3DHCore.NewIdentityReset(c.IdentityKey.IdentityKey.PublicKey, ik.IdentityKey.PublicKey, timestamp)
+	}
+	// New Signed Pre Key
+	spk, err := X3DHCore.GenerateFullSPK(ik.IdentityKey)
+	if err != nil {
+		return err
+	}
+	// Swap keys, the old ones still decrypt messages queued for them
+	c.RetiredIdentities = append(c.RetiredIdentities, RetiredIdentity{
+		IdentityKey:  c.IdentityKey,
+		SignedPreKey: c.SignedPreKey,
+		RetiredAt:    timestamp,
+	})
+	c.IdentityKey = *ik
+	c.SignedPreKey = *spk
+	c.PendingRotation = rotation
+	return nil
+}
+
+func (c *X3DHClient) ClearPendingRotation() {
+	c.PendingRotation = nil
+}
+
+// Drop the keys of retired identities. Only call this once the rotation is
+// confirmed and the message queue was drained, returns how many were dropped.
+func (c *X3DHClient) ForgetRetiredIdentities() int {
+	dropped := len(c.RetiredIdentities)
+	c.RetiredIdentities = nil
+	return dropped
+}
+
+// Bundle for the current identity with n freshly generated one time pre keys
+func (c *X3DHClient) GetRotationBundle(n int) (*X3DHCore.X3DHClientBundle, error) {
+	otp_set, err := c.BatchGenerateOTPs(n)
+	if err != nil {
+		return nil, err
+	}
+	return &X3DHCore.X3DHClientBundle{
+		IK:     *c.IdentityKey.PublicIK(),
+		SPK:    *c.SignedPreKey.PublicSPK(),
+		OtpSet: otp_set,
+	}, nil
+}
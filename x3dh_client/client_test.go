@@ -0,0 +1,118 @@
+package x3dh_client
+
+import (
+	"path/filepath"
+	"testing"
+
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+func testClient(t *testing.T, username string) *X3DHClient {
+	t.Helper()
+	c, err := InitClient(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Bundle of the current identity of c, as the server hands it out
+func keyBundle(c *X3DHClient, otp int) *X3DHCore.X3DHKeyBundle {
+	return &X3DHCore.X3DHKeyBundle{
+		IK:  *c.IdentityKey.PublicIK(),
+		SPK: *c.SignedPreKey.PublicSPK(),
+		OTP: *c.OneTimePreKeys[otp].PublicOTP(),
+	}
+}
+
+func buildMessage(t *testing.T, sender *X3DHClient, bundle *X3DHCore.X3DHKeyBundle, text string) *X3DHCore.InitialMessage {
+	t.Helper()
+	im, err := sender.BuildMessage(bundle, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+func TestRotateIdentity(t *testing.T) {
+	alice := testClient(t, "alice")
+	bob := testClient(t, "bob")
+	oldIK := alice.IdentityKey.IdentityKey.PublicKey
+	// Queued for alice before the rotation
+	queued := buildMessage(t, bob, keyBundle(alice, 0), "before rotation")
+
+	if err := alice.RotateIdentity(true); err != nil {
+		t.Fatal(err)
+	}
+	if alice.PendingRotation == nil || !alice.PendingRotation.IsSigned() {
+		t.Fatalf("pending rotation = %+v; want a signed one", alice.PendingRotation)
+	}
+	if alice.IdentityKey.IdentityKey.PublicKey.Equal(oldIK) {
+		t.Fatalf("identity key unchanged by the rotation")
+	}
+	if len(alice.RetiredIdentities) != 1 || !alice.RetiredIdentities[0].IdentityKey.IdentityKey.PublicKey.Equal(oldIK) {
+		t.Fatalf("retired identities = %d; want the old identity", len(alice.RetiredIdentities))
+	}
+	current := buildMessage(t, bob, keyBundle(alice, 1), "after rotation")
+
+	// Both decrypt while the old identity is kept, also after a restart
+	path := filepath.Join(t.TempDir(), "alice.json")
+	if err := alice.SaveClient(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*X3DHClient{alice, loaded} {
+		for im, want := range map[*X3DHCore.InitialMessage]string{queued: "before rotation", current: "after rotation"} {
+			plaintext, err := c.RecieveMessage(im)
+			if err != nil || string(plaintext) != want {
+				t.Fatalf("RecieveMessage = %q, %v; want %q", plaintext, err, want)
+			}
+		}
+	}
+
+	alice.ClearPendingRotation()
+	if alice.PendingRotation != nil {
+		t.Fatalf("pending rotation kept after ClearPendingRotation")
+	}
+	if dropped := alice.ForgetRetiredIdentities(); dropped != 1 {
+		t.Fatalf("ForgetRetiredIdentities = %d; want 1", dropped)
+	}
+	if plaintext, err := alice.RecieveMessage(queued); err == nil {
+		t.Fatalf("message for a forgotten identity decrypted to %q", plaintext)
+	}
+	if plaintext, err := alice.RecieveMessage(current); err != nil || string(plaintext) != "after rotation" {
+		t.Fatalf("RecieveMessage after forgetting = %q, %v; want %q", plaintext, err, "after rotation")
+	}
+}
+
+// Messages for any retired identity decrypt, not only the last one
+func TestRotateIdentityTwice(t *testing.T) {
+	alice := testClient(t, "alice")
+	bob := testClient(t, "bob")
+	messages := make([]*X3DHCore.InitialMessage, 0)
+	for i, signed := range []bool{true, false} {
+		messages = append(messages, buildMessage(t, bob, keyBundle(alice, i), "message"))
+		if err := alice.RotateIdentity(signed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if alice.PendingRotation.IsSigned() {
+		t.Fatalf("pending rotation signed; want the unsigned reset")
+	}
+	for i, im := range messages {
+		if _, err := alice.RecieveMessage(im); err != nil {
+			t.Fatalf("message before rotation %d: %v", i, err)
+		}
+	}
+	if dropped := alice.ForgetRetiredIdentities(); dropped != 2 {
+		t.Fatalf("ForgetRetiredIdentities = %d; want 2", dropped)
+	}
+	for i, im := range messages {
+		if _, err := alice.RecieveMessage(im); err == nil {
+			t.Fatalf("message before rotation %d decrypted after forgetting", i)
+		}
+	}
+}
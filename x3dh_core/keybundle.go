@@ -16,6 +16,10 @@ type X3DHKeyBundle struct {
 }
 
 func (kb *X3DHKeyBundle) Validate() bool {
+	// x25519.Verify panics on malformed keys
+	if len(kb.IK.IdentityKey) != x25519.PublicKeySize || len(kb.SPK.SignedPreKey) != x25519.PublicKeySize {
+		return false
+	}
 	// Validate the signed pre key
 	valid := x25519.Verify(kb.IK.IdentityKey, kb.SPK.SignedPreKey, kb.SPK.SignedPreKeySignature)
 	return valid
@@ -4,15 +4,21 @@ import "go.step.sm/crypto/x25519"
 
 type InitialMessage struct {
 	// Identity Key
-	IdentityKey x25519.PublicKey `json:"identity_key"`
+	IdentityKey x25519.PublicKey `json:"identity_key" bson:"identity_key"`
 	// Ephemeral Key
-	EphemeralKey x25519.PublicKey `json:"ephemeral_key"`
+	EphemeralKey x25519.PublicKey `json:"ephemeral_key" bson:"ephemeral_key"`
 	// One Time Pre Key ID
-	OneTimePreKeyID int `json:"one_time_pre_key_id"`
+	OneTimePreKeyID int `json:"one_time_pre_key_id" bson:"one_time_pre_key_id"`
 	// AEAD
-	Ciphertext []byte `json:"ciphertext"`
-	AD         []byte `json:"ad"`
+	Ciphertext []byte `json:"ciphertext" bson:"ciphertext"`
+	AD         []byte `json:"ad" bson:"ad"`
 	// Nonce
-	Nonce []byte `json:"nonce"`
-	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce" bson:"nonce"`
+	Salt  []byte `json:"salt" bson:"salt"`
+}
+
+// Bytes of every variable length field, what a size limit has to count.
+// Payload hidden in the associated data is counted as well.
+func (im *InitialMessage) Size() int {
+	return len(im.IdentityKey) + len(im.EphemeralKey) + len(im.Ciphertext) + len(im.AD) + len(im.Nonce) + len(im.Salt)
 }
@@ -11,9 +11,9 @@ type X3DHFullOTP struct {
 
 type X3DHPublicOTP struct {
 	// One Time Pre Key
-	OneTimePreKey x25519.PublicKey `json:"key"`
+	OneTimePreKey x25519.PublicKey `json:"key" bson:"key"`
 	// One Time Pre Key ID
-	OneTimePreKeyID int `json:"id"`
+	OneTimePreKeyID int `json:"id" bson:"id"`
 }
 
 func (otp *X3DHFullOTP) PublicOTP() *X3DHPublicOTP {
@@ -0,0 +1,9 @@
+package x3dh_core
+
+// Presence visibility, shared by the api and the server store. Empty is the
+// same as PresenceNobody.
+const (
+	PresenceNobody   = "nobody"
+	PresenceContacts = "contacts"
+	PresenceEveryone = "everyone"
+)
@@ -0,0 +1,9 @@
+package x3dh_core
+
+// Receipt types, shared by the api and the server store
+const (
+	// Generated by the server when the recipient acknowledged the message
+	ReceiptDelivered = "delivered"
+	// Sent by the recipient, the read message IDs are in the signal
+	ReceiptRead = "read"
+)
@@ -0,0 +1,82 @@
+package x3dh_core
+
+import (
+	"encoding/binary"
+
+	"go.step.sm/crypto/x25519"
+)
+
+// Domain separation for rotation signatures
+const identityRotationContext = "X3DH-IDENTITY-ROTATION"
+
+// Continuity statement linking an identity key to its successor.
+// A rotation is signed by the old identity key, a reset carries no signature.
+type X3DHIdentityRotation struct {
+	// Previous Identity Key
+	OldIdentityKey x25519.PublicKey `json:"old_identity_key" bson:"old_identity_key"`
+	// New Identity Key
+	NewIdentityKey x25519.PublicKey `json:"new_identity_key" bson:"new_identity_key"`
+	// Unix time of the change
+	Timestamp int64 `json:"timestamp" bson:"timestamp"`
+	// Signature by the old identity key (empty for a reset)
+	Signature []byte `json:"signature,omitempty" bson:"signature,omitempty"`
+}
+
+func identityRotationPayload(oldKey, newKey x25519.PublicKey, timestamp int64) []byte {
+	payload := []byte(identityRotationContext)
+	payload = append(payload, oldKey[:]...)
+	payload = append(payload, newKey[:]...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(timestamp))
+	return payload
+}
+
+func SignIdentityRotation(oldKey KeyPairX25519, newKey x25519.PublicKey, timestamp int64) (*X3DHIdentityRotation, error) {
+	// Sign the new key with the old key
+	signature, err := oldKey.Sign(identityRotationPayload(oldKey.PublicKey, newKey, timestamp))
+	if err != nil {
+		return nil, err
+	}
+	// Return
+	return &X3DHIdentityRotation{
+		OldIdentityKey: oldKey.PublicKey,
+		NewIdentityKey: newKey,
+		Timestamp:      timestamp,
+		Signature:      signature,
+	}, nil
+}
+
+func NewIdentityReset(oldKey, newKey x25519.PublicKey, timestamp int64) *X3DHIdentityRotation {
+	return &X3DHIdentityRotation{
+		OldIdentityKey: oldKey,
+		NewIdentityKey: newKey,
+		Timestamp:      timestamp,
+	}
+}
+
+func (r *X3DHIdentityRotation) IsSigned() bool {
+	return len(r.Signature) > 0
+}
+
+// Check the signature of the old identity key. Resets never verify.
+func (r *X3DHIdentityRotation) Verify() bool {
+	if !r.IsSigned() || len(r.OldIdentityKey) != x25519.PublicKeySize || len(r.NewIdentityKey) != x25519.PublicKeySize {
+		return false
+	}
+	return x25519.Verify(r.OldIdentityKey, identityRotationPayload(r.OldIdentityKey, r.NewIdentityKey, r.Timestamp), r.Signature)
+}
+
+// Follow the chain of signed rotations starting at a pinned key and return the
+// last key reachable through valid signatures. Resets break the chain.
+func FollowIdentityRotations(pinned x25519.PublicKey, rotations []X3DHIdentityRotation) x25519.PublicKey {
+	current := pinned
+	for _, rotation := range rotations {
+		if !rotation.OldIdentityKey.Equal(current) {
+			continue
+		}
+		if !rotation.Verify() {
+			break
+		}
+		current = rotation.NewIdentityKey
+	}
+	return current
+}
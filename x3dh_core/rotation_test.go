@@ -0,0 +1,69 @@
+package x3dh_core
+
+import (
+	"testing"
+
+	"go.step.sm/crypto/x25519"
+)
+
+func testIdentityKeys(t *testing.T, n int) []KeyPairX25519 {
+	t.Helper()
+	keys := make([]KeyPairX25519, 0, n)
+	for i := 0; i < n; i++ {
+		ik, err := GenerateFullIK()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, ik.IdentityKey)
+	}
+	return keys
+}
+
+func signRotation(t *testing.T, oldKey KeyPairX25519, newKey x25519.PublicKey) X3DHIdentityRotation {
+	t.Helper()
+	rotation, err := SignIdentityRotation(oldKey, newKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *rotation
+}
+
+func TestFollowIdentityRotations(t *testing.T) {
+	keys := testIdentityKeys(t, 4)
+	a, b, c, d := keys[0], keys[1], keys[2], keys[3]
+	ab := signRotation(t, a, b.PublicKey)
+	bc := signRotation(t, b, c.PublicKey)
+
+	tests := []struct {
+		name      string
+		pinned    x25519.PublicKey
+		rotations []X3DHIdentityRotation
+		want      x25519.PublicKey
+	}{
+		{"no rotations", a.PublicKey, nil, a.PublicKey},
+		{"signed chain", a.PublicKey, []X3DHIdentityRotation{ab, bc}, c.PublicKey},
+		{"pinned mid chain", b.PublicKey, []X3DHIdentityRotation{ab, bc}, c.PublicKey},
+		{"reset breaks the chain", a.PublicKey, []X3DHIdentityRotation{ab, *NewIdentityReset(b.PublicKey, c.PublicKey, 2)}, b.PublicKey},
+		// Signed by d, not by the pinned key
+		{"forged signature", a.PublicKey, []X3DHIdentityRotation{{
+			OldIdentityKey: a.PublicKey,
+			NewIdentityKey: d.PublicKey,
+			Timestamp:      1,
+			Signature:      signRotation(t, d, d.PublicKey).Signature,
+		}}, a.PublicKey},
+		{"unrelated rotation", a.PublicKey, []X3DHIdentityRotation{signRotation(t, d, c.PublicKey)}, a.PublicKey},
+	}
+	for _, tt := range tests {
+		got := FollowIdentityRotations(tt.pinned, tt.rotations)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: FollowIdentityRotations reached a different key", tt.name)
+		}
+	}
+
+	// A tampered timestamp invalidates the signature
+	tampered := ab
+	tampered.Timestamp++
+	if tampered.Verify() {
+		t.Fatalf("rotation with a changed timestamp still verifies")
+	}
+}
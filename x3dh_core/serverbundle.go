@@ -1,12 +1,23 @@
 package x3dh_core
 
+import "go.step.sm/crypto/x25519"
+
 type X3DHClientBundle struct {
 	// Identity Key
-	IK X3DHPublicIK `json:"identity_key"`
+	IK X3DHPublicIK `json:"identity_key" bson:"identity_key"`
 	// Signed Pre Key
-	SPK X3DHPublicSPK `json:"signed_pre_key"`
+	SPK X3DHPublicSPK `json:"signed_pre_key" bson:"signed_pre_key"`
 	// One Time Pre Keys
-	OtpSet []X3DHPublicOTP `json:"one_time_pre_keys"`
+	OtpSet []X3DHPublicOTP `json:"one_time_pre_keys" bson:"one_time_pre_keys"`
+}
+
+// Check key sizes and that the signed pre key is signed by the identity key.
+// One time pre keys are not checked.
+func (b *X3DHClientBundle) Validate() bool {
+	if len(b.IK.IdentityKey) != x25519.PublicKeySize || len(b.SPK.SignedPreKey) != x25519.PublicKeySize {
+		return false
+	}
+	return x25519.Verify(b.IK.IdentityKey, b.SPK.SignedPreKey, b.SPK.SignedPreKeySignature)
 }
 
 type X3DHExpandeBundle struct {
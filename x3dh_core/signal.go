@@ -0,0 +1,30 @@
+package x3dh_core
+
+import "go.step.sm/crypto/x25519"
+
+// Short lived message between users that know each other's identity key
+// (e.g. typing indicators). It needs no key bundle, so no one time pre key is
+// used up, but it has no forward secrecy for the recipient: it can be
+// decrypted with the identity key alone.
+type EphemeralSignal struct {
+	// Identity Key of the sender
+	IdentityKey x25519.PublicKey `json:"identity_key" bson:"identity_key"`
+	// Ephemeral Key
+	EphemeralKey x25519.PublicKey `json:"ephemeral_key" bson:"ephemeral_key"`
+	// AEAD
+	Ciphertext []byte `json:"ciphertext" bson:"ciphertext"`
+	// Nonce
+	Nonce []byte `json:"nonce" bson:"nonce"`
+	Salt  []byte `json:"salt" bson:"salt"`
+}
+
+// AES-GCM standard nonce
+const signalNonceSize = 12
+
+// Check the sizes of the keys, nonce and salt. The ciphertext is not checked.
+func (s *EphemeralSignal) Validate() bool {
+	return len(s.IdentityKey) == x25519.PublicKeySize &&
+		len(s.EphemeralKey) == x25519.PublicKeySize &&
+		len(s.Nonce) == signalNonceSize &&
+		len(s.Salt) == saltSize
+}
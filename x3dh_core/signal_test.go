@@ -0,0 +1,34 @@
+package x3dh_core
+
+import "testing"
+
+func TestEphemeralSignalValidate(t *testing.T) {
+	valid := func() EphemeralSignal {
+		return EphemeralSignal{
+			IdentityKey:  make([]byte, 32),
+			EphemeralKey: make([]byte, 32),
+			Ciphertext:   make([]byte, 40),
+			Nonce:        make([]byte, signalNonceSize),
+			Salt:         make([]byte, saltSize),
+		}
+	}
+	signal := valid()
+	if !signal.Validate() {
+		t.Fatalf("Validate of a well formed signal = false; want true")
+	}
+	tests := map[string]func(s *EphemeralSignal){
+		"long identity key":  func(s *EphemeralSignal) { s.IdentityKey = make([]byte, 1<<20) },
+		"short identity key": func(s *EphemeralSignal) { s.IdentityKey = s.IdentityKey[:31] },
+		"long ephemeral key": func(s *EphemeralSignal) { s.EphemeralKey = make([]byte, 33) },
+		"missing nonce":      func(s *EphemeralSignal) { s.Nonce = nil },
+		"long nonce":         func(s *EphemeralSignal) { s.Nonce = make([]byte, 1<<20) },
+		"long salt":          func(s *EphemeralSignal) { s.Salt = make([]byte, 1<<20) },
+	}
+	for name, change := range tests {
+		signal := valid()
+		change(&signal)
+		if signal.Validate() {
+			t.Errorf("Validate with %s = true; want false", name)
+		}
+	}
+}
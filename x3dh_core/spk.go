@@ -11,9 +11,9 @@ type X3DHFullSPK struct {
 
 type X3DHPublicSPK struct {
 	// Signed Pre Key
-	SignedPreKey x25519.PublicKey `json:"key"`
+	SignedPreKey x25519.PublicKey `json:"key" bson:"key"`
 	// Signed Pre Key Signature
-	SignedPreKeySignature []byte `json:"signature"`
+	SignedPreKeySignature []byte `json:"signature" bson:"signature"`
 }
 
 func (spk *X3DHFullSPK) PublicSPK() *X3DHPublicSPK {
@@ -0,0 +1,683 @@
+package x3dh_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+var (
+	boltClientsBucket    = []byte("clients")
+	boltMessagesBucket   = []byte("messages")
+	boltReceiptsBucket   = []byte("receipts")
+	boltDeliveriesBucket = []byte("deliveries")
+	boltUsersBucket      = []byte("users")
+)
+
+// Store embedded in a single bbolt file. Client documents are JSON encoded and
+// keyed by client ID; every method runs in one transaction. Messages live in
+// one nested bucket per recipient, keyed by message ID so cursors iterate in order.
+// Receipts and deliveries are kept the same way, in one nested bucket per
+// owner and per recipient.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Do not block forever if another process holds the file
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltClientsBucket, boltMessagesBucket, boltReceiptsBucket, boltDeliveriesBucket, boltUsersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return boltBackfillLastSeen(tx, time.Now().UTC())
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Accounts created before last_seen was tracked never expire. Count them as
+// seen when the file is opened, so they expire after the TTL like the others.
+func boltBackfillLastSeen(tx *bolt.Tx, now time.Time) error {
+	bucket := tx.Bucket(boltUsersBucket)
+	// The bucket must not change while ForEach runs, collect the users first
+	unseen := make([]UserRecord, 0)
+	err := bucket.ForEach(func(_, value []byte) error {
+		var user UserRecord
+		if err := json.Unmarshal(value, &user); err != nil {
+			return err
+		}
+		if user.LastSeen.IsZero() {
+			unseen = append(unseen, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, user := range unseen {
+		user.LastSeen = now
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(user.Username), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltGetClient(tx *bolt.Tx, clientID string) (*ClientData, error) {
+	data := tx.Bucket(boltClientsBucket).Get([]byte(clientID))
+	if data == nil {
+		return nil, nil
+	}
+	clientData := &ClientData{}
+	err := json.Unmarshal(data, clientData)
+	if err != nil {
+		return nil, err
+	}
+	return clientData, nil
+}
+
+func boltPutClient(tx *bolt.Tx, clientID string, clientData *ClientData) error {
+	data, err := json.Marshal(clientData)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltClientsBucket).Put([]byte(clientID), data)
+}
+
+// Read-modify-write of one client inside a write transaction
+func (s *BoltStore) updateClient(clientID string, fn func(clientData *ClientData) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		clientData, err := boltGetClient(tx, clientID)
+		if err != nil {
+			return err
+		}
+		if clientData == nil {
+			return ErrClientNotFound
+		}
+		err = fn(clientData)
+		if err != nil {
+			return err
+		}
+		return boltPutClient(tx, clientID, clientData)
+	})
+}
+
+func (s *BoltStore) viewClient(clientID string) (*ClientData, error) {
+	var clientData *ClientData
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		clientData, err = boltGetClient(tx, clientID)
+		return err
+	})
+	return clientData, err
+}
+
+func (s *BoltStore) PutBundle(clientID string, bundle X3DHCore.X3DHClientBundle) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		clientData, err := boltGetClient(tx, clientID)
+		if err != nil {
+			return err
+		}
+		if clientData == nil {
+			clientData = NewClientData(bundle)
+		}
+		clientData.setBundle(bundle)
+		return boltPutClient(tx, clientID, clientData)
+	})
+}
+
+func (s *BoltStore) PutBundleForIdentity(clientID string, bundle X3DHCore.X3DHClientBundle) (bool, error) {
+	stored := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		clientData, err := boltGetClient(tx, clientID)
+		if err != nil {
+			return err
+		}
+		if clientData == nil {
+			clientData = NewClientData(bundle)
+		} else if !clientData.Bundle.IK.IdentityKey.Equal(bundle.IK.IdentityKey) {
+			return nil
+		}
+		clientData.setBundle(bundle)
+		stored = true
+		return boltPutClient(tx, clientID, clientData)
+	})
+	return stored, err
+}
+
+func (s *BoltStore) GetBundle(clientID string) (X3DHCore.X3DHClientBundle, bool, error) {
+	clientData, err := s.viewClient(clientID)
+	if err != nil || clientData == nil {
+		return X3DHCore.X3DHClientBundle{}, false, err
+	}
+	return clientData.Bundle, true, nil
+}
+
+func (s *BoltStore) ReplaceIdentity(clientID string, oldKey []byte, bundle X3DHCore.X3DHClientBundle, rotation X3DHCore.X3DHIdentityRotation) (bool, error) {
+	replaced := false
+	err := s.updateClient(clientID, func(clientData *ClientData) error {
+		if !bytes.Equal(clientData.Bundle.IK.IdentityKey, oldKey) {
+			return nil
+		}
+		clientData.setBundle(bundle)
+		clientData.Rotations = append(clientData.Rotations, rotation)
+		replaced = true
+		return nil
+	})
+	if err == ErrClientNotFound {
+		return false, nil
+	}
+	return replaced, err
+}
+
+func (s *BoltStore) GetRotations(clientID string) ([]X3DHCore.X3DHIdentityRotation, bool, error) {
+	clientData, err := s.viewClient(clientID)
+	if err != nil || clientData == nil {
+		return nil, false, err
+	}
+	return clientData.Rotations, true, nil
+}
+
+func (s *BoltStore) GetClient(clientID string) (ClientData, bool, error) {
+	clientData, err := s.viewClient(clientID)
+	if err != nil || clientData == nil {
+		return ClientData{}, false, err
+	}
+	return *clientData, true, nil
+}
+
+func (s *BoltStore) AppendOTPs(clientID string, otps []X3DHCore.X3DHPublicOTP, maxStored int) (OTPUploadResult, error) {
+	var result OTPUploadResult
+	err := s.updateClient(clientID, func(clientData *ClientData) error {
+		result = appendOTPs(clientData, otps, maxStored)
+		return nil
+	})
+	return result, err
+}
+
+// Write transactions are serialized by bbolt, so read-modify-write is atomic
+func (s *BoltStore) ClaimBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error) {
+	var keyBundle X3DHCore.X3DHKeyBundle
+	claimed := false
+	err := s.updateClient(clientID, func(clientData *ClientData) error {
+		if len(clientData.Bundle.OtpSet) == 0 {
+			return nil
+		}
+		keyBundle = X3DHCore.X3DHKeyBundle{
+			IK:  clientData.Bundle.IK,
+			SPK: clientData.Bundle.SPK,
+			OTP: clientData.Bundle.OtpSet[0],
+		}
+		clientData.Bundle.OtpSet = clientData.Bundle.OtpSet[1:]
+		claimed = true
+		return nil
+	})
+	if err == ErrClientNotFound {
+		return X3DHCore.X3DHKeyBundle{}, false, nil
+	}
+	return keyBundle, claimed, err
+}
+
+func (s *BoltStore) CountOTPs(clientID string) (int, error) {
+	clientData, err := s.viewClient(clientID)
+	if err != nil {
+		return 0, err
+	}
+	if clientData == nil {
+		return 0, ErrClientNotFound
+	}
+	return len(clientData.Bundle.OtpSet), nil
+}
+
+func (s *BoltStore) PushMessage(recipientID string, msg MessageData, maxQueued int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltClientsBucket).Get([]byte(recipientID)) == nil {
+			return ErrClientNotFound
+		}
+		queue, err := tx.Bucket(boltMessagesBucket).CreateBucketIfNotExists([]byte(recipientID))
+		if err != nil {
+			return err
+		}
+		if maxQueued > 0 && queue.Stats().KeyN >= maxQueued {
+			return ErrQueueFull
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return queue.Put([]byte(msg.ID), data)
+	})
+}
+
+func (s *BoltStore) ListMessages(clientID string, afterID string, limit int) ([]MessageData, error) {
+	messages := make([]MessageData, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltMessagesBucket).Bucket([]byte(clientID))
+		if queue == nil {
+			return nil
+		}
+		cursor := queue.Cursor()
+		key, value := cursor.Seek([]byte(afterID))
+		// Seek lands on afterID itself if it is still queued
+		if key != nil && string(key) == afterID {
+			key, value = cursor.Next()
+		}
+		for ; key != nil && (limit <= 0 || len(messages) < limit); key, value = cursor.Next() {
+			var msg MessageData
+			if err := json.Unmarshal(value, &msg); err != nil {
+				return err
+			}
+			messages = append(messages, msg)
+		}
+		return nil
+	})
+	return messages, err
+}
+
+func (s *BoltStore) AckMessage(clientID string, messageID string) (MessageData, bool, error) {
+	var msg MessageData
+	acked := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltMessagesBucket).Bucket([]byte(clientID))
+		if queue == nil {
+			return nil
+		}
+		data := queue.Get([]byte(messageID))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		acked = true
+		return queue.Delete([]byte(messageID))
+	})
+	if err != nil || !acked {
+		return MessageData{}, false, err
+	}
+	return msg, true, nil
+}
+
+func (s *BoltStore) PurgeMessages(before time.Time) ([]MessageData, error) {
+	purged := make([]MessageData, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Buckets must not change while ForEach runs, collect the queues first
+		clientIDs := make([][]byte, 0)
+		err := tx.Bucket(boltMessagesBucket).ForEach(func(clientID, _ []byte) error {
+			clientIDs = append(clientIDs, append([]byte{}, clientID...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, clientID := range clientIDs {
+			queue := tx.Bucket(boltMessagesBucket).Bucket(clientID)
+			if queue == nil {
+				continue
+			}
+			// IDs sort by time, stop at the first message that is new enough
+			cursor := queue.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.First() {
+				var msg MessageData
+				if err := json.Unmarshal(value, &msg); err != nil {
+					return err
+				}
+				if !msg.Timestamp.Before(before) {
+					break
+				}
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+				purged = append(purged, msg)
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func (s *BoltStore) CountMessages(clientID string) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltMessagesBucket).Bucket([]byte(clientID))
+		if queue != nil {
+			count = queue.Stats().KeyN
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltStore) ClearMessages(clientID string) (int, error) {
+	cleared := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(boltMessagesBucket)
+		queue := messages.Bucket([]byte(clientID))
+		if queue == nil {
+			return nil
+		}
+		cleared = queue.Stats().KeyN
+		return messages.DeleteBucket([]byte(clientID))
+	})
+	return cleared, err
+}
+
+func (s *BoltStore) PushReceipt(receipt ReceiptData, maxStored int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltClientsBucket).Get([]byte(receipt.OwnerID)) == nil {
+			return ErrClientNotFound
+		}
+		kept, err := tx.Bucket(boltReceiptsBucket).CreateBucketIfNotExists([]byte(receipt.OwnerID))
+		if err != nil {
+			return err
+		}
+		if err := boltEvictOldest(kept, maxStored); err != nil {
+			return err
+		}
+		data, err := json.Marshal(receipt)
+		if err != nil {
+			return err
+		}
+		return kept.Put([]byte(receipt.ID), data)
+	})
+}
+
+// Make room for one more entry in a bucket keyed by time ordered IDs
+func boltEvictOldest(bucket *bolt.Bucket, maxStored int) error {
+	if maxStored <= 0 {
+		return nil
+	}
+	cursor := bucket.Cursor()
+	for count := bucket.Stats().KeyN; count >= maxStored; count-- {
+		if key, _ := cursor.First(); key == nil {
+			break
+		}
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) TakeReceipts(ownerID string) ([]ReceiptData, error) {
+	receipts := make([]ReceiptData, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kept := tx.Bucket(boltReceiptsBucket).Bucket([]byte(ownerID))
+		if kept == nil {
+			return nil
+		}
+		err := kept.ForEach(func(_, value []byte) error {
+			var receipt ReceiptData
+			if err := json.Unmarshal(value, &receipt); err != nil {
+				return err
+			}
+			receipts = append(receipts, receipt)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltReceiptsBucket).DeleteBucket([]byte(ownerID))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+func (s *BoltStore) PushDelivery(delivery DeliveryData, maxStored int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		kept, err := tx.Bucket(boltDeliveriesBucket).CreateBucketIfNotExists([]byte(delivery.RecipientID))
+		if err != nil {
+			return err
+		}
+		if err := boltEvictOldest(kept, maxStored); err != nil {
+			return err
+		}
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return kept.Put([]byte(delivery.ID), data)
+	})
+}
+
+func (s *BoltStore) TakeDelivery(recipientID string, senderID string, messageID string) (bool, error) {
+	taken := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		kept := tx.Bucket(boltDeliveriesBucket).Bucket([]byte(recipientID))
+		if kept == nil {
+			return nil
+		}
+		cursor := kept.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var delivery DeliveryData
+			if err := json.Unmarshal(value, &delivery); err != nil {
+				return err
+			}
+			if delivery.SenderID == senderID && delivery.MessageID == messageID {
+				taken = true
+				return cursor.Delete()
+			}
+		}
+		return nil
+	})
+	return taken, err
+}
+
+func (s *BoltStore) PurgeReceipts(before time.Time) (int, error) {
+	purged := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltReceiptsBucket, boltDeliveriesBucket} {
+			count, err := boltPurgeBefore(tx.Bucket(name), before)
+			if err != nil {
+				return err
+			}
+			purged += count
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// Remove entries kept before the given time from every nested bucket
+func boltPurgeBefore(bucket *bolt.Bucket, before time.Time) (int, error) {
+	// Buckets must not change while ForEach runs, collect them first
+	names := make([][]byte, 0)
+	err := bucket.ForEach(func(name, _ []byte) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, name := range names {
+		kept := bucket.Bucket(name)
+		if kept == nil {
+			continue
+		}
+		// IDs sort by time, stop at the first entry that is new enough
+		cursor := kept.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.First() {
+			var entry struct{ Timestamp time.Time }
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return purged, err
+			}
+			if !entry.Timestamp.Before(before) {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *BoltStore) GetUser(username string) (UserRecord, bool, error) {
+	var user UserRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltUsersBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &user)
+	})
+	return user, found, err
+}
+
+func (s *BoltStore) CreateUser(user UserRecord) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		if bucket.Get([]byte(user.Username)) != nil {
+			return nil
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		created = true
+		return bucket.Put([]byte(user.Username), data)
+	})
+	return created, err
+}
+
+// Read-modify-write of one user, returns false if it does not exist
+func (s *BoltStore) updateUser(username string, fn func(user *UserRecord)) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		data := bucket.Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		var user UserRecord
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		fn(&user)
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		found = true
+		return bucket.Put([]byte(username), data)
+	})
+	return found, err
+}
+
+func (s *BoltStore) ListUsers() ([]UserRecord, error) {
+	users := make([]UserRecord, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Keys are iterated in sorted order
+		return tx.Bucket(boltUsersBucket).ForEach(func(key, value []byte) error {
+			var user UserRecord
+			if err := json.Unmarshal(value, &user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *BoltStore) SetUserSuspended(username string, suspended bool) (bool, error) {
+	return s.updateUser(username, func(user *UserRecord) {
+		user.Suspended = suspended
+	})
+}
+
+func (s *BoltStore) SetUserPresence(username string, presence PresenceSettings) (bool, error) {
+	return s.updateUser(username, func(user *UserRecord) {
+		user.Presence = presence
+	})
+}
+
+func (s *BoltStore) TouchUser(username string, at time.Time) error {
+	_, err := s.updateUser(username, func(user *UserRecord) {
+		user.LastSeen = at
+	})
+	return err
+}
+
+func (s *BoltStore) ListInactiveUsers(before time.Time) ([]string, error) {
+	usernames := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(key, value []byte) error {
+			var user UserRecord
+			if err := json.Unmarshal(value, &user); err != nil {
+				return err
+			}
+			if isInactive(user, before) {
+				usernames = append(usernames, string(key))
+			}
+			return nil
+		})
+	})
+	return usernames, err
+}
+
+func (s *BoltStore) DeleteUser(username string, inactiveBefore time.Time) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		data := bucket.Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		if !inactiveBefore.IsZero() {
+			var user UserRecord
+			if err := json.Unmarshal(data, &user); err != nil {
+				return err
+			}
+			if !isInactive(user, inactiveBefore) {
+				return nil
+			}
+		}
+		deleted = true
+		return bucket.Delete([]byte(username))
+	})
+	return deleted, err
+}
+
+func (s *BoltStore) DeleteClient(clientID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltClientsBucket).Delete([]byte(clientID))
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltMessagesBucket, boltReceiptsBucket, boltDeliveriesBucket} {
+			err = tx.Bucket(name).DeleteBucket([]byte(clientID))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
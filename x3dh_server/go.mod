@@ -4,7 +4,10 @@ go 1.22.2
 
 replace tux.tech/x3dh/core => ../x3dh_core
 
-require tux.tech/x3dh/core v0.0.0-00010101000000-000000000000
+require (
+	go.etcd.io/bbolt v1.3.10
+	tux.tech/x3dh/core v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/golang/snappy v0.0.4 // indirect
@@ -15,12 +18,13 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	go.mongodb.org/mongo-driver v1.16.0
-	go.step.sm/crypto v0.47.0 // indirect
+	go.step.sm/crypto v0.47.0
 	golang.org/x/crypto v0.23.0 // indirect
 )
@@ -0,0 +1,406 @@
+package x3dh_server
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+// Store kept in process memory. Everything is lost on restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	clients  map[string]*ClientData
+	messages map[string][]MessageData
+	receipts map[string][]ReceiptData
+	// Deliveries by recipient
+	deliveries map[string][]DeliveryData
+	users      map[string]UserRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		clients:    make(map[string]*ClientData),
+		messages:   make(map[string][]MessageData),
+		receipts:   make(map[string][]ReceiptData),
+		deliveries: make(map[string][]DeliveryData),
+		users:      make(map[string]UserRecord),
+	}
+}
+
+func copyBundle(bundle X3DHCore.X3DHClientBundle) X3DHCore.X3DHClientBundle {
+	bundle.OtpSet = append([]X3DHCore.X3DHPublicOTP{}, bundle.OtpSet...)
+	return bundle
+}
+
+func (s *MemoryStore) PutBundle(clientID string, bundle X3DHCore.X3DHClientBundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		c = NewClientData(bundle)
+		s.clients[clientID] = c
+	}
+	c.setBundle(bundle)
+	return nil
+}
+
+func (s *MemoryStore) PutBundleForIdentity(clientID string, bundle X3DHCore.X3DHClientBundle) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		c = NewClientData(bundle)
+		s.clients[clientID] = c
+	} else if !c.Bundle.IK.IdentityKey.Equal(bundle.IK.IdentityKey) {
+		return false, nil
+	}
+	c.setBundle(bundle)
+	return true, nil
+}
+
+func (s *MemoryStore) GetBundle(clientID string) (X3DHCore.X3DHClientBundle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		return X3DHCore.X3DHClientBundle{}, false, nil
+	}
+	return copyBundle(c.Bundle), true, nil
+}
+
+func (s *MemoryStore) ReplaceIdentity(clientID string, oldKey []byte, bundle X3DHCore.X3DHClientBundle, rotation X3DHCore.X3DHIdentityRotation) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok || !bytes.Equal(c.Bundle.IK.IdentityKey, oldKey) {
+		return false, nil
+	}
+	c.setBundle(bundle)
+	c.Rotations = append(c.Rotations, rotation)
+	return true, nil
+}
+
+func (s *MemoryStore) GetRotations(clientID string) ([]X3DHCore.X3DHIdentityRotation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]X3DHCore.X3DHIdentityRotation{}, c.Rotations...), true, nil
+}
+
+func (s *MemoryStore) GetClient(clientID string) (ClientData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		return ClientData{}, false, nil
+	}
+	clientData := *c
+	clientData.Bundle = copyBundle(c.Bundle)
+	clientData.Rotations = append([]X3DHCore.X3DHIdentityRotation{}, c.Rotations...)
+	return clientData, true, nil
+}
+
+func (s *MemoryStore) AppendOTPs(clientID string, otps []X3DHCore.X3DHPublicOTP, maxStored int) (OTPUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		return OTPUploadResult{}, ErrClientNotFound
+	}
+	return appendOTPs(c, otps, maxStored), nil
+}
+
+func (s *MemoryStore) ClaimBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok || len(c.Bundle.OtpSet) == 0 {
+		return X3DHCore.X3DHKeyBundle{}, false, nil
+	}
+	otp := c.Bundle.OtpSet[0]
+	c.Bundle.OtpSet = c.Bundle.OtpSet[1:]
+	return X3DHCore.X3DHKeyBundle{
+		IK:  c.Bundle.IK,
+		SPK: c.Bundle.SPK,
+		OTP: otp,
+	}, true, nil
+}
+
+func (s *MemoryStore) CountOTPs(clientID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[clientID]
+	if !ok {
+		return 0, ErrClientNotFound
+	}
+	return len(c.Bundle.OtpSet), nil
+}
+
+func (s *MemoryStore) PushMessage(recipientID string, msg MessageData, maxQueued int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[recipientID]; !ok {
+		return ErrClientNotFound
+	}
+	queue := s.messages[recipientID]
+	if maxQueued > 0 && len(queue) >= maxQueued {
+		return ErrQueueFull
+	}
+	// Keep the queue sorted by ID
+	i := sort.Search(len(queue), func(i int) bool { return queue[i].ID > msg.ID })
+	queue = append(queue, MessageData{})
+	copy(queue[i+1:], queue[i:])
+	queue[i] = msg
+	s.messages[recipientID] = queue
+	return nil
+}
+
+func (s *MemoryStore) ListMessages(clientID string, afterID string, limit int) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.messages[clientID]
+	i := sort.Search(len(queue), func(i int) bool { return queue[i].ID > afterID })
+	end := len(queue)
+	if limit > 0 && i+limit < end {
+		end = i + limit
+	}
+	return append([]MessageData{}, queue[i:end]...), nil
+}
+
+func (s *MemoryStore) AckMessage(clientID string, messageID string) (MessageData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.messages[clientID]
+	for i, msg := range queue {
+		if msg.ID == messageID {
+			s.messages[clientID] = append(queue[:i], queue[i+1:]...)
+			return msg, true, nil
+		}
+	}
+	return MessageData{}, false, nil
+}
+
+func (s *MemoryStore) PurgeMessages(before time.Time) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := make([]MessageData, 0)
+	for clientID, queue := range s.messages {
+		kept := make([]MessageData, 0, len(queue))
+		for _, msg := range queue {
+			if msg.Timestamp.Before(before) {
+				purged = append(purged, msg)
+			} else {
+				kept = append(kept, msg)
+			}
+		}
+		s.messages[clientID] = kept
+	}
+	return purged, nil
+}
+
+func (s *MemoryStore) CountMessages(clientID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages[clientID]), nil
+}
+
+func (s *MemoryStore) ClearMessages(clientID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cleared := len(s.messages[clientID])
+	delete(s.messages, clientID)
+	return cleared, nil
+}
+
+func (s *MemoryStore) PushReceipt(receipt ReceiptData, maxStored int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[receipt.OwnerID]; !ok {
+		return ErrClientNotFound
+	}
+	kept := s.receipts[receipt.OwnerID]
+	if maxStored > 0 && len(kept) >= maxStored {
+		kept = kept[len(kept)-maxStored+1:]
+	}
+	// Keep them sorted by ID
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].ID > receipt.ID })
+	kept = append(kept, ReceiptData{})
+	copy(kept[i+1:], kept[i:])
+	kept[i] = receipt
+	s.receipts[receipt.OwnerID] = kept
+	return nil
+}
+
+func (s *MemoryStore) TakeReceipts(ownerID string) ([]ReceiptData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	receipts := append([]ReceiptData{}, s.receipts[ownerID]...)
+	delete(s.receipts, ownerID)
+	return receipts, nil
+}
+
+func (s *MemoryStore) PushDelivery(delivery DeliveryData, maxStored int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.deliveries[delivery.RecipientID]
+	if maxStored > 0 && len(kept) >= maxStored {
+		kept = kept[len(kept)-maxStored+1:]
+	}
+	// Keep them sorted by ID
+	i := sort.Search(len(kept), func(i int) bool { return kept[i].ID > delivery.ID })
+	kept = append(kept, DeliveryData{})
+	copy(kept[i+1:], kept[i:])
+	kept[i] = delivery
+	s.deliveries[delivery.RecipientID] = kept
+	return nil
+}
+
+func (s *MemoryStore) TakeDelivery(recipientID string, senderID string, messageID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.deliveries[recipientID]
+	for i, delivery := range kept {
+		if delivery.SenderID == senderID && delivery.MessageID == messageID {
+			s.deliveries[recipientID] = append(kept[:i], kept[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryStore) PurgeReceipts(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for ownerID, receipts := range s.receipts {
+		kept := make([]ReceiptData, 0, len(receipts))
+		for _, receipt := range receipts {
+			if !receipt.Timestamp.Before(before) {
+				kept = append(kept, receipt)
+			}
+		}
+		purged += len(receipts) - len(kept)
+		s.receipts[ownerID] = kept
+	}
+	for recipientID, deliveries := range s.deliveries {
+		kept := make([]DeliveryData, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			if !delivery.Timestamp.Before(before) {
+				kept = append(kept, delivery)
+			}
+		}
+		purged += len(deliveries) - len(kept)
+		s.deliveries[recipientID] = kept
+	}
+	return purged, nil
+}
+
+func (s *MemoryStore) GetUser(username string) (UserRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	return user, ok, nil
+}
+
+func (s *MemoryStore) CreateUser(user UserRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.Username]; ok {
+		return false, nil
+	}
+	s.users[user.Username] = user
+	return true, nil
+}
+
+func (s *MemoryStore) ListUsers() ([]UserRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]UserRecord, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (s *MemoryStore) SetUserSuspended(username string, suspended bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return false, nil
+	}
+	user.Suspended = suspended
+	s.users[username] = user
+	return true, nil
+}
+
+func (s *MemoryStore) SetUserPresence(username string, presence PresenceSettings) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return false, nil
+	}
+	user.Presence = presence
+	s.users[username] = user
+	return true, nil
+}
+
+func (s *MemoryStore) TouchUser(username string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil
+	}
+	user.LastSeen = at
+	s.users[username] = user
+	return nil
+}
+
+func (s *MemoryStore) ListInactiveUsers(before time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usernames := make([]string, 0)
+	for username, user := range s.users {
+		if isInactive(user, before) {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+func (s *MemoryStore) DeleteUser(username string, inactiveBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return false, nil
+	}
+	if !inactiveBefore.IsZero() && !isInactive(user, inactiveBefore) {
+		return false, nil
+	}
+	delete(s.users, username)
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteClient(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, clientID)
+	delete(s.messages, clientID)
+	delete(s.receipts, clientID)
+	delete(s.deliveries, clientID)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
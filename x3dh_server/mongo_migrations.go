@@ -0,0 +1,427 @@
+package x3dh_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+var ErrMigrationsPending = errors.New("database schema is outdated, run the migrations")
+
+// Layout version written to every document. Documents without schema_version
+// predate explicit field names.
+const mongoDocumentVersion = 1
+
+// A schema change. Migrations run in order, each at most once per database,
+// and must be safe to run again if interrupted.
+type mongoMigration struct {
+	Version int
+	Name    string
+	Apply   func(ctx context.Context, s *MongoStore) error
+}
+
+var mongoMigrations = []mongoMigration{
+	{1, "explicit field names", migrateFieldNames},
+	{2, "indexes", createIndexes},
+	{3, "receipt indexes", createReceiptIndexes},
+	{4, "backfill last seen", backfillLastSeen},
+	{5, "delivery indexes", createDeliveryIndexes},
+	{6, "receipt signal field names", migrateSignalFieldNames},
+}
+
+// Entry of <database>.schema_migrations. AppliedAt stays empty while running,
+// which keeps a second server from running the same migration.
+type mongoMigrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	StartedAt time.Time `bson:"started_at"`
+	AppliedAt time.Time `bson:"applied_at,omitempty"`
+}
+
+func (s *MongoStore) migrationCol() *mongo.Collection {
+	return s.db.Collection("schema_migrations")
+}
+
+// Names of migrations not yet applied, in order
+func (s *MongoStore) PendingMigrations(ctx context.Context) ([]string, error) {
+	cursor, err := s.migrationCol().Find(ctx, bson.M{"applied_at": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	var records []mongoMigrationRecord
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+	pending := make([]string, 0)
+	for _, migration := range mongoMigrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration.Name)
+		}
+	}
+	return pending, nil
+}
+
+// Apply pending migrations in order, returns the names of those applied
+func (s *MongoStore) Migrate(ctx context.Context) ([]string, error) {
+	applied := make([]string, 0)
+	for _, migration := range mongoMigrations {
+		var record mongoMigrationRecord
+		err := s.migrationCol().FindOne(ctx, bson.M{"_id": migration.Version}).Decode(&record)
+		if err == nil && !record.AppliedAt.IsZero() {
+			continue
+		}
+		if err == nil {
+			return applied, fmt.Errorf("migration %d (%s) started at %s did not finish; if no other server is migrating, delete it from schema_migrations and retry",
+				migration.Version, migration.Name, record.StartedAt.Format(time.RFC3339))
+		}
+		if err != mongo.ErrNoDocuments {
+			return applied, err
+		}
+		// Claim it, the unique _id makes concurrent servers fail here
+		_, err = s.migrationCol().InsertOne(ctx, mongoMigrationRecord{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			StartedAt: time.Now().UTC(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			return applied, fmt.Errorf("migration %d (%s) is being applied by another server", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return applied, err
+		}
+		err = migration.Apply(ctx, s)
+		if err != nil {
+			// Release the claim so it can be retried
+			s.migrationCol().DeleteOne(ctx, bson.M{"_id": migration.Version})
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		_, err = s.migrationCol().UpdateOne(ctx,
+			bson.M{"_id": migration.Version},
+			bson.M{"$set": bson.M{"applied_at": time.Now().UTC()}},
+		)
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration.Name)
+	}
+	return applied, nil
+}
+
+// Migrate, or fail with ErrMigrationsPending if migrations are not applied
+// automatically
+func (s *MongoStore) prepareSchema(autoMigrate bool) error {
+	if autoMigrate {
+		_, err := s.Migrate(context.TODO())
+		return err
+	}
+	pending, err := s.PendingMigrations(context.TODO())
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %v", ErrMigrationsPending, pending)
+	}
+	return nil
+}
+
+// Layout before version 1, field names were the lowercased Go names. The
+// first upload path stored additional one time pre keys in bundle.otpSet
+// and messages were queued inside the client document.
+type legacyOTP struct {
+	OneTimePreKey   []byte `bson:"onetimeprekey"`
+	OneTimePreKeyID int    `bson:"onetimeprekeyid"`
+}
+
+type legacyBundle struct {
+	IK struct {
+		IdentityKey []byte `bson:"identitykey"`
+	} `bson:"ik"`
+	SPK struct {
+		SignedPreKey          []byte `bson:"signedprekey"`
+		SignedPreKeySignature []byte `bson:"signedprekeysignature"`
+	} `bson:"spk"`
+	OtpSet      []legacyOTP `bson:"otpset"`
+	ExtraOtpSet []legacyOTP `bson:"otpSet"`
+}
+
+type legacyRotation struct {
+	OldIdentityKey []byte `bson:"oldidentitykey"`
+	NewIdentityKey []byte `bson:"newidentitykey"`
+	Timestamp      int64  `bson:"timestamp"`
+	Signature      []byte `bson:"signature"`
+}
+
+type legacyInitialMessage struct {
+	IdentityKey     []byte `bson:"identitykey"`
+	EphemeralKey    []byte `bson:"ephemeralkey"`
+	OneTimePreKeyID int    `bson:"onetimeprekeyid"`
+	Ciphertext      []byte `bson:"ciphertext"`
+	AD              []byte `bson:"ad"`
+	Nonce           []byte `bson:"nonce"`
+	Salt            []byte `bson:"salt"`
+}
+
+type legacyClient struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	ClientID  string             `bson:"clientID"`
+	Bundle    legacyBundle       `bson:"bundle"`
+	Rotations []legacyRotation   `bson:"rotations"`
+	NextOTPID int                `bson:"nextotpid"`
+	Queue     []struct {
+		SenderID string               `bson:"senderid"`
+		Message  legacyInitialMessage `bson:"message"`
+	} `bson:"queue"`
+}
+
+type legacyMessage struct {
+	ID          string               `bson:"_id"`
+	RecipientID string               `bson:"recipient_id"`
+	SenderID    string               `bson:"sender_id"`
+	Message     legacyInitialMessage `bson:"message"`
+	Timestamp   time.Time            `bson:"timestamp"`
+}
+
+type mongoClient struct {
+	ID            primitive.ObjectID `bson:"_id"`
+	ClientID      string             `bson:"client_id"`
+	ClientData    `bson:",inline"`
+	SchemaVersion int `bson:"schema_version"`
+}
+
+func (otp legacyOTP) toOTP() X3DHCore.X3DHPublicOTP {
+	return X3DHCore.X3DHPublicOTP{
+		OneTimePreKey:   otp.OneTimePreKey,
+		OneTimePreKeyID: otp.OneTimePreKeyID,
+	}
+}
+
+func (msg legacyInitialMessage) toInitialMessage() X3DHCore.InitialMessage {
+	return X3DHCore.InitialMessage{
+		IdentityKey:     msg.IdentityKey,
+		EphemeralKey:    msg.EphemeralKey,
+		OneTimePreKeyID: msg.OneTimePreKeyID,
+		Ciphertext:      msg.Ciphertext,
+		AD:              msg.AD,
+		Nonce:           msg.Nonce,
+		Salt:            msg.Salt,
+	}
+}
+
+func (doc legacyClient) toClientData() ClientData {
+	clientData := ClientData{
+		Bundle: X3DHCore.X3DHClientBundle{
+			IK: X3DHCore.X3DHPublicIK{IdentityKey: doc.Bundle.IK.IdentityKey},
+			SPK: X3DHCore.X3DHPublicSPK{
+				SignedPreKey:          doc.Bundle.SPK.SignedPreKey,
+				SignedPreKeySignature: doc.Bundle.SPK.SignedPreKeySignature,
+			},
+			OtpSet: make([]X3DHCore.X3DHPublicOTP, 0, len(doc.Bundle.OtpSet)+len(doc.Bundle.ExtraOtpSet)),
+		},
+		NextOTPID: doc.NextOTPID,
+	}
+	// Keys from both sets, each ID once
+	seen := make(map[int]bool)
+	for _, otps := range [][]legacyOTP{doc.Bundle.OtpSet, doc.Bundle.ExtraOtpSet} {
+		for _, otp := range otps {
+			if seen[otp.OneTimePreKeyID] {
+				continue
+			}
+			seen[otp.OneTimePreKeyID] = true
+			clientData.Bundle.OtpSet = append(clientData.Bundle.OtpSet, otp.toOTP())
+		}
+	}
+	for _, rotation := range doc.Rotations {
+		clientData.Rotations = append(clientData.Rotations, X3DHCore.X3DHIdentityRotation{
+			OldIdentityKey: rotation.OldIdentityKey,
+			NewIdentityKey: rotation.NewIdentityKey,
+			Timestamp:      rotation.Timestamp,
+			Signature:      rotation.Signature,
+		})
+	}
+	clientData.NextOTPID = nextOTPID(&clientData)
+	return clientData
+}
+
+var unversioned = bson.M{"schema_version": bson.M{"$exists": false}}
+
+// Rewrite documents without schema_version with explicit snake_case names and
+// move messages queued in client documents to the messages collection
+func migrateFieldNames(ctx context.Context, s *MongoStore) error {
+	cursor, err := s.clientCol.Find(ctx, unversioned)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc legacyClient
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		// Queued messages first. If interrupted they may be moved twice with
+		// different IDs, but never lost.
+		migratedAt := time.Now().UTC()
+		for _, queued := range doc.Queue {
+			_, err = s.messageCol.InsertOne(ctx, mongoMessage{
+				ID:            newMessageID(),
+				RecipientID:   doc.ClientID,
+				SenderID:      queued.SenderID,
+				Message:       queued.Message.toInitialMessage(),
+				Timestamp:     migratedAt,
+				SchemaVersion: mongoDocumentVersion,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = s.clientCol.ReplaceOne(ctx, bson.M{"_id": doc.ID}, mongoClient{
+			ID:            doc.ID,
+			ClientID:      doc.ClientID,
+			ClientData:    doc.toClientData(),
+			SchemaVersion: mongoDocumentVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	cursor, err = s.messageCol.Find(ctx, unversioned)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc legacyMessage
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return err
+		}
+		_, err = s.messageCol.ReplaceOne(ctx, bson.M{"_id": doc.ID}, mongoMessage{
+			ID:            doc.ID,
+			RecipientID:   doc.RecipientID,
+			SenderID:      doc.SenderID,
+			Message:       doc.Message.toInitialMessage(),
+			Timestamp:     doc.Timestamp,
+			SchemaVersion: mongoDocumentVersion,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+
+	// Account fields always had explicit names
+	_, err = s.userCol.UpdateMany(ctx, unversioned, bson.M{"$set": bson.M{"schema_version": mongoDocumentVersion}})
+	return err
+}
+
+// Every lookup filters on client_id, username or recipient_id. The unique
+// indexes fail to build if duplicates were created before they existed.
+func createIndexes(ctx context.Context, s *MongoStore) error {
+	_, err := s.clientCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "client_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("clients: %w", err)
+	}
+	_, err = s.userCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		// Inactive account expiry
+		{Keys: bson.D{{Key: "last_seen", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	_, err = s.messageCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Queue order
+		{Keys: bson.D{{Key: "recipient_id", Value: 1}, {Key: "_id", Value: 1}}},
+		// Purge of expired messages
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("messages: %w", err)
+	}
+	return nil
+}
+
+// Receipts are fetched by owner in ID order
+func createReceiptIndexes(ctx context.Context, s *MongoStore) error {
+	_, err := s.receiptCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("receipts: %w", err)
+	}
+	return nil
+}
+
+// Accounts created before last_seen was tracked never expire. Count them as
+// seen when the migration runs, so they expire after the TTL like the others.
+func backfillLastSeen(ctx context.Context, s *MongoStore) error {
+	// Matches missing and null fields
+	_, err := s.userCol.UpdateMany(ctx,
+		bson.M{"last_seen": nil},
+		bson.M{"$set": bson.M{"last_seen": time.Now().UTC()}},
+	)
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	return nil
+}
+
+// Deliveries are looked up by recipient, sender and message, evicted by
+// recipient in ID order, and deliveries and receipts are purged by age
+func createDeliveryIndexes(ctx context.Context, s *MongoStore) error {
+	_, err := s.deliveryCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "recipient_id", Value: 1}, {Key: "sender_id", Value: 1}, {Key: "message_id", Value: 1}}},
+		{Keys: bson.D{{Key: "recipient_id", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "timestamp", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("deliveries: %w", err)
+	}
+	_, err = s.receiptCol.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "timestamp", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("receipts: %w", err)
+	}
+	return nil
+}
+
+// Signals of read receipts were stored with the lowercased Go names. Ciphertext,
+// nonce and salt already had their explicit names.
+func migrateSignalFieldNames(ctx context.Context, s *MongoStore) error {
+	_, err := s.receiptCol.UpdateMany(ctx,
+		bson.M{"signal.identitykey": bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{
+			"signal.identitykey":  "signal.identity_key",
+			"signal.ephemeralkey": "signal.ephemeral_key",
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("receipts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package x3dh_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+func TestMongoMigrations(t *testing.T) {
+	uri := os.Getenv("X3DH_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("X3DH_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	config := DefaultConfig()
+	config.URI = uri
+	config.Database = "x3dh_test_" + suffix
+	config.AuthDatabase = "x3dh_auth_test_" + suffix
+	config.AutoMigrate = false
+
+	s, err := NewMongoStore(config.URI, config.Database, config.AuthDatabase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	t.Cleanup(func() {
+		s.db.Drop(ctx)
+		s.userCol.Database().Drop(ctx)
+	})
+
+	// Documents as written before field names were explicit
+	bundle, _ := testBundle(t, 0, 1)
+	otp := testOTPs(t, 0)[0]
+	legacyOTPs := func(ids ...int) bson.A {
+		a := bson.A{}
+		for _, id := range ids {
+			a = append(a, bson.M{"onetimeprekey": otp.OneTimePreKey, "onetimeprekeyid": id})
+		}
+		return a
+	}
+	_, err = s.clientCol.InsertOne(ctx, bson.M{
+		"clientID": "alice",
+		"bundle": bson.M{
+			"ik":  bson.M{"identitykey": bundle.IK.IdentityKey},
+			"spk": bson.M{"signedprekey": bundle.SPK.SignedPreKey, "signedprekeysignature": bundle.SPK.SignedPreKeySignature},
+			// Keys appended by the first upload path landed in otpSet
+			"otpset": legacyOTPs(0, 1),
+			"otpSet": legacyOTPs(0, 1, 2),
+		},
+		"queue": bson.A{
+			bson.M{"senderid": "bob", "message": bson.M{"identitykey": bundle.IK.IdentityKey, "ciphertext": []byte("queued")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.messageCol.InsertOne(ctx, bson.M{
+		"_id":          newMessageID(),
+		"recipient_id": "alice",
+		"sender_id":    "carol",
+		"message":      bson.M{"onetimeprekeyid": 1, "ciphertext": []byte("stored")},
+		"timestamp":    time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read receipt stored before the signal had explicit field names
+	ik := bundle.IK.IdentityKey
+	_, err = s.receiptCol.InsertOne(ctx, bson.M{
+		"_id":      newMessageID(),
+		"owner_id": "alice",
+		"from_id":  "bob",
+		"type":     X3DHCore.ReceiptRead,
+		"signal": bson.M{
+			"identitykey":  ik,
+			"ephemeralkey": ik,
+			"ciphertext":   []byte("read"),
+			"nonce":        []byte("nonce"),
+			"salt":         []byte("salt"),
+		},
+		"timestamp":      time.Now().UTC(),
+		"schema_version": mongoDocumentVersion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Account created before last_seen was tracked
+	_, err = s.userCol.InsertOne(ctx, bson.M{"username": "dave", "password": "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening without migrating refuses the outdated schema
+	if _, err := NewStore(config); !errors.Is(err, ErrMigrationsPending) {
+		t.Fatalf("NewStore without AutoMigrate = %v; want ErrMigrationsPending", err)
+	}
+	applied, err := MigrateStore(config)
+	if err != nil || len(applied) != len(mongoMigrations) {
+		t.Fatalf("MigrateStore = %v, %v; want all migrations", applied, err)
+	}
+	if pending, err := s.PendingMigrations(ctx); err != nil || len(pending) != 0 {
+		t.Fatalf("PendingMigrations after Migrate = %v, %v; want none", pending, err)
+	}
+	if applied, err := s.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("second Migrate = %v, %v; want nothing applied", applied, err)
+	}
+
+	stored, ok, err := s.GetBundle("alice")
+	if err != nil || !ok || !stored.IK.IdentityKey.Equal(bundle.IK.IdentityKey) {
+		t.Fatalf("GetBundle after migration = %v, %v; want the legacy bundle", ok, err)
+	}
+	if len(stored.OtpSet) != 3 {
+		t.Fatalf("migrated OTPs = %d; want 3 (both sets, each ID once)", len(stored.OtpSet))
+	}
+	messages, err := s.ListMessages("alice", "", 0)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("ListMessages after migration = %d, %v; want 2", len(messages), err)
+	}
+	found := map[string]string{}
+	for _, msg := range messages {
+		found[msg.SenderID] = string(msg.Message.Ciphertext)
+	}
+	if found["bob"] != "queued" || found["carol"] != "stored" {
+		t.Fatalf("migrated messages = %v; want queued from bob and stored from carol", found)
+	}
+	if user, ok, err := s.GetUser("dave"); err != nil || !ok || user.LastSeen.IsZero() {
+		t.Fatalf("GetUser after migration = %+v, %v, %v; want last_seen set", user, ok, err)
+	}
+	receipts, err := s.TakeReceipts("alice")
+	if err != nil || len(receipts) != 1 || receipts[0].Signal == nil {
+		t.Fatalf("TakeReceipts after migration = %+v, %v; want the read receipt", receipts, err)
+	}
+	signal := receipts[0].Signal
+	if !signal.IdentityKey.Equal(ik) || !signal.EphemeralKey.Equal(ik) || string(signal.Ciphertext) != "read" || string(signal.Nonce) != "nonce" || string(signal.Salt) != "salt" {
+		t.Fatalf("migrated signal = %+v; want every field kept", signal)
+	}
+	// Unique index on client_id
+	_, err = s.clientCol.InsertOne(ctx, bson.M{"client_id": "alice"})
+	if err == nil {
+		t.Fatal("duplicate client_id inserted after migration")
+	}
+}
@@ -0,0 +1,684 @@
+package x3dh_server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+// Store backed by MongoDB. Bundles and rotations share one document per client
+// in <database>.clients, queued messages, receipts and deliveries are
+// documents of their own in <database>.messages, <database>.receipts and
+// <database>.deliveries and accounts live in <authDatabase>.users. Applied
+// schema migrations are recorded in <database>.schema_migrations.
+type MongoStore struct {
+	client     *mongo.Client
+	db         *mongo.Database
+	clientCol  *mongo.Collection
+	messageCol *mongo.Collection
+	receiptCol *mongo.Collection
+	// Deliveries allowing a read receipt
+	deliveryCol *mongo.Collection
+	userCol     *mongo.Collection
+}
+
+type mongoMessage struct {
+	ID            string                  `bson:"_id"`
+	RecipientID   string                  `bson:"recipient_id"`
+	SenderID      string                  `bson:"sender_id"`
+	Message       X3DHCore.InitialMessage `bson:"message"`
+	Timestamp     time.Time               `bson:"timestamp"`
+	SchemaVersion int                     `bson:"schema_version"`
+}
+
+type mongoReceipt struct {
+	ID            string                    `bson:"_id"`
+	OwnerID       string                    `bson:"owner_id"`
+	FromID        string                    `bson:"from_id"`
+	Type          string                    `bson:"type"`
+	MessageID     string                    `bson:"message_id,omitempty"`
+	Signal        *X3DHCore.EphemeralSignal `bson:"signal,omitempty"`
+	Timestamp     time.Time                 `bson:"timestamp"`
+	SchemaVersion int                       `bson:"schema_version"`
+}
+
+type mongoDelivery struct {
+	ID            string    `bson:"_id"`
+	RecipientID   string    `bson:"recipient_id"`
+	SenderID      string    `bson:"sender_id"`
+	MessageID     string    `bson:"message_id"`
+	Timestamp     time.Time `bson:"timestamp"`
+	SchemaVersion int       `bson:"schema_version"`
+}
+
+type mongoUser struct {
+	UserRecord    `bson:",inline"`
+	SchemaVersion int `bson:"schema_version"`
+}
+
+func (doc mongoMessage) toMessageData() MessageData {
+	return MessageData{
+		ID:          doc.ID,
+		RecipientID: doc.RecipientID,
+		SenderID:    doc.SenderID,
+		Message:     doc.Message,
+		Timestamp:   doc.Timestamp,
+	}
+}
+
+func (doc mongoReceipt) toReceiptData() ReceiptData {
+	return ReceiptData{
+		ID:        doc.ID,
+		OwnerID:   doc.OwnerID,
+		FromID:    doc.FromID,
+		Type:      doc.Type,
+		MessageID: doc.MessageID,
+		Signal:    doc.Signal,
+		Timestamp: doc.Timestamp,
+	}
+}
+
+func NewMongoStore(uri string, database string, authDatabase string) (*MongoStore, error) {
+	// Create connection to mongo
+	clientOptions := options.Client().ApplyURI(uri)
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early if the server is unreachable
+	err = client.Ping(context.TODO(), nil)
+	if err != nil {
+		client.Disconnect(context.TODO())
+		return nil, err
+	}
+
+	db := client.Database(database)
+	return &MongoStore{
+		client:      client,
+		db:          db,
+		clientCol:   db.Collection("clients"),
+		messageCol:  db.Collection("messages"),
+		receiptCol:  db.Collection("receipts"),
+		deliveryCol: db.Collection("deliveries"),
+		userCol:     client.Database(authDatabase).Collection("users"),
+	}, nil
+}
+
+func (s *MongoStore) findClient(clientID string) (ClientData, bool, error) {
+	var clientData ClientData
+	err := s.clientCol.FindOne(
+		context.TODO(),
+		bson.M{"client_id": clientID},
+	).Decode(&clientData)
+	if err == mongo.ErrNoDocuments {
+		return ClientData{}, false, nil
+	}
+	if err != nil {
+		return ClientData{}, false, err
+	}
+	return clientData, true, nil
+}
+
+// Attempts of the optimistic read-modify-writes of one time pre keys
+const mongoAppendRetries = 5
+
+var errConcurrentOTPUpload = errors.New("one time pre keys changed concurrently, try again")
+
+// Store a bundle, dropping one time pre keys already handed out. With
+// identityKey set, only if the stored identity key is that one; with create
+// set, a missing client is created. A rotation is recorded with the bundle.
+// Optimistic like AppendOTPs: the update only applies if no upload changed the
+// used IDs and no claim took a key that was kept.
+func (s *MongoStore) storeBundle(clientID string, identityKey []byte, create bool, bundle X3DHCore.X3DHClientBundle, rotation *X3DHCore.X3DHIdentityRotation) (bool, error) {
+	for attempt := 0; attempt < mongoAppendRetries; attempt++ {
+		clientData, ok, err := s.findClient(clientID)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if !create {
+				return false, nil
+			}
+			// Never overwrite a client created in between
+			result, err := s.clientCol.UpdateOne(
+				context.TODO(),
+				bson.M{"client_id": clientID},
+				bson.M{"$setOnInsert": bson.M{
+					"bundle":         bundle,
+					"next_otp_id":    nextOTPID(&ClientData{Bundle: bundle}),
+					"spk_updated_at": time.Now().UTC(),
+					"schema_version": mongoDocumentVersion,
+				}},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return false, err
+			}
+			if result.UpsertedCount > 0 {
+				return true, nil
+			}
+			continue
+		}
+		if identityKey != nil && !bytes.Equal(clientData.Bundle.IK.IdentityKey, identityKey) {
+			return false, nil
+		}
+		storedNext := clientData.NextOTPID
+		otps, unclaimed := bundleOTPs(&clientData, bundle.OtpSet)
+		clientData.Bundle = bundle
+		clientData.Bundle.OtpSet = otps
+		filter := bson.M{"client_id": clientID, "next_otp_id": storedNext}
+		if identityKey != nil {
+			filter["bundle.identity_key.identity_key"] = identityKey
+		}
+		if len(unclaimed) > 0 {
+			filter["bundle.one_time_pre_keys.id"] = bson.M{"$all": unclaimed}
+		}
+		update := bson.M{"$set": bson.M{
+			"bundle":         clientData.Bundle,
+			"next_otp_id":    nextOTPID(&clientData),
+			"spk_updated_at": time.Now().UTC(),
+		}}
+		if rotation != nil {
+			update["$push"] = bson.M{"rotations": rotation}
+		}
+		result, err := s.clientCol.UpdateOne(context.TODO(), filter, update)
+		if err != nil {
+			return false, err
+		}
+		if result.MatchedCount > 0 {
+			return true, nil
+		}
+	}
+	return false, errConcurrentOTPUpload
+}
+
+func (s *MongoStore) PutBundle(clientID string, bundle X3DHCore.X3DHClientBundle) error {
+	_, err := s.storeBundle(clientID, nil, true, bundle, nil)
+	return err
+}
+
+func (s *MongoStore) PutBundleForIdentity(clientID string, bundle X3DHCore.X3DHClientBundle) (bool, error) {
+	return s.storeBundle(clientID, bundle.IK.IdentityKey, true, bundle, nil)
+}
+
+func (s *MongoStore) GetBundle(clientID string) (X3DHCore.X3DHClientBundle, bool, error) {
+	clientData, ok, err := s.findClient(clientID)
+	return clientData.Bundle, ok, err
+}
+
+func (s *MongoStore) ReplaceIdentity(clientID string, oldKey []byte, bundle X3DHCore.X3DHClientBundle, rotation X3DHCore.X3DHIdentityRotation) (bool, error) {
+	// Only apply if the stored key is still the old one
+	return s.storeBundle(clientID, oldKey, false, bundle, &rotation)
+}
+
+func (s *MongoStore) GetRotations(clientID string) ([]X3DHCore.X3DHIdentityRotation, bool, error) {
+	clientData, ok, err := s.findClient(clientID)
+	return clientData.Rotations, ok, err
+}
+
+func (s *MongoStore) GetClient(clientID string) (ClientData, bool, error) {
+	return s.findClient(clientID)
+}
+
+func (s *MongoStore) AppendOTPs(clientID string, otps []X3DHCore.X3DHPublicOTP, maxStored int) (OTPUploadResult, error) {
+	for attempt := 0; attempt < mongoAppendRetries; attempt++ {
+		clientData, ok, err := s.findClient(clientID)
+		if err != nil {
+			return OTPUploadResult{}, err
+		}
+		if !ok {
+			return OTPUploadResult{}, ErrClientNotFound
+		}
+		// Decide on a copy, then apply only the accepted keys
+		storedNext := clientData.NextOTPID
+		stored := len(clientData.Bundle.OtpSet)
+		result := appendOTPs(&clientData, otps, maxStored)
+		if len(result.Accepted) == 0 {
+			return result, nil
+		}
+		accepted := clientData.Bundle.OtpSet[stored:]
+		// Only if no other upload got in between. Claims may run concurrently, they
+		// only lower the count.
+		filter := bson.M{"client_id": clientID, "next_otp_id": storedNext}
+		// Single $push so concurrent claims are never overwritten
+		update, err := s.clientCol.UpdateOne(
+			context.TODO(),
+			filter,
+			bson.M{
+				"$push": bson.M{"bundle.one_time_pre_keys": bson.M{"$each": accepted}},
+				"$set":  bson.M{"next_otp_id": clientData.NextOTPID},
+			},
+		)
+		if err != nil {
+			return OTPUploadResult{}, err
+		}
+		if update.MatchedCount > 0 {
+			return result, nil
+		}
+	}
+	return OTPUploadResult{}, errConcurrentOTPUpload
+}
+
+func (s *MongoStore) ClaimBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error) {
+	// Pop the first key and return the document as it was before, in one
+	// findAndModify. Only matches while at least one key is left.
+	var before ClientData
+	err := s.clientCol.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"client_id": clientID, "bundle.one_time_pre_keys.0": bson.M{"$exists": true}},
+		bson.M{"$pop": bson.M{"bundle.one_time_pre_keys": -1}},
+		options.FindOneAndUpdate().
+			SetReturnDocument(options.Before).
+			SetProjection(bson.M{"bundle.one_time_pre_keys": bson.M{"$slice": 1}, "rotations": 0}),
+	).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return X3DHCore.X3DHKeyBundle{}, false, nil
+	}
+	if err != nil {
+		return X3DHCore.X3DHKeyBundle{}, false, err
+	}
+	if len(before.Bundle.OtpSet) == 0 {
+		return X3DHCore.X3DHKeyBundle{}, false, nil
+	}
+	return X3DHCore.X3DHKeyBundle{
+		IK:  before.Bundle.IK,
+		SPK: before.Bundle.SPK,
+		OTP: before.Bundle.OtpSet[0],
+	}, true, nil
+}
+
+func (s *MongoStore) CountOTPs(clientID string) (int, error) {
+	clientData, ok, err := s.findClient(clientID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrClientNotFound
+	}
+	return len(clientData.Bundle.OtpSet), nil
+}
+
+// The queue limit is checked before inserting, concurrent senders may exceed it
+// by a few messages
+func (s *MongoStore) PushMessage(recipientID string, msg MessageData, maxQueued int) error {
+	count, err := s.clientCol.CountDocuments(
+		context.TODO(),
+		bson.M{"client_id": recipientID},
+	)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrClientNotFound
+	}
+	if maxQueued > 0 {
+		queued, err := s.messageCol.CountDocuments(
+			context.TODO(),
+			bson.M{"recipient_id": recipientID},
+			options.Count().SetLimit(int64(maxQueued)),
+		)
+		if err != nil {
+			return err
+		}
+		if queued >= int64(maxQueued) {
+			return ErrQueueFull
+		}
+	}
+	_, err = s.messageCol.InsertOne(context.TODO(), mongoMessage{
+		ID:            msg.ID,
+		RecipientID:   recipientID,
+		SenderID:      msg.SenderID,
+		Message:       msg.Message,
+		Timestamp:     msg.Timestamp,
+		SchemaVersion: mongoDocumentVersion,
+	})
+	return err
+}
+
+func (s *MongoStore) ListMessages(clientID string, afterID string, limit int) ([]MessageData, error) {
+	filter := bson.M{"recipient_id": clientID}
+	if afterID != "" {
+		filter["_id"] = bson.M{"$gt": afterID}
+	}
+	findOptions := options.Find().SetSort(bson.M{"_id": 1})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	cursor, err := s.messageCol.Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoMessage
+	err = cursor.All(context.TODO(), &docs)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]MessageData, 0, len(docs))
+	for _, doc := range docs {
+		messages = append(messages, doc.toMessageData())
+	}
+	return messages, nil
+}
+
+func (s *MongoStore) AckMessage(clientID string, messageID string) (MessageData, bool, error) {
+	var doc mongoMessage
+	err := s.messageCol.FindOneAndDelete(
+		context.TODO(),
+		bson.M{"_id": messageID, "recipient_id": clientID},
+	).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return MessageData{}, false, nil
+	}
+	if err != nil {
+		return MessageData{}, false, err
+	}
+	return doc.toMessageData(), true, nil
+}
+
+func (s *MongoStore) PurgeMessages(before time.Time) ([]MessageData, error) {
+	// Streamed, the expired messages may not fit in memory at once
+	cursor, err := s.messageCol.Find(
+		context.TODO(),
+		bson.M{"timestamp": bson.M{"$lt": before}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	// One by one, so messages acknowledged meanwhile are not reported
+	purged := make([]MessageData, 0)
+	for cursor.Next(context.TODO()) {
+		var doc mongoMessage
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return purged, err
+		}
+		result, err := s.messageCol.DeleteOne(context.TODO(), bson.M{"_id": doc.ID})
+		if err != nil {
+			return purged, err
+		}
+		if result.DeletedCount > 0 {
+			purged = append(purged, doc.toMessageData())
+		}
+	}
+	return purged, cursor.Err()
+}
+
+func (s *MongoStore) CountMessages(clientID string) (int, error) {
+	count, err := s.messageCol.CountDocuments(context.TODO(), bson.M{"recipient_id": clientID})
+	return int(count), err
+}
+
+func (s *MongoStore) ClearMessages(clientID string) (int, error) {
+	result, err := s.messageCol.DeleteMany(context.TODO(), bson.M{"recipient_id": clientID})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+// The limit is checked before inserting, like the message queue limit, so
+// concurrent pushes can keep a few more
+func (s *MongoStore) PushReceipt(receipt ReceiptData, maxStored int) error {
+	count, err := s.clientCol.CountDocuments(
+		context.TODO(),
+		bson.M{"client_id": receipt.OwnerID},
+	)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrClientNotFound
+	}
+	err = mongoEvictOldest(s.receiptCol, bson.M{"owner_id": receipt.OwnerID}, maxStored)
+	if err != nil {
+		return err
+	}
+	_, err = s.receiptCol.InsertOne(context.TODO(), mongoReceipt{
+		ID:            receipt.ID,
+		OwnerID:       receipt.OwnerID,
+		FromID:        receipt.FromID,
+		Type:          receipt.Type,
+		MessageID:     receipt.MessageID,
+		Signal:        receipt.Signal,
+		Timestamp:     receipt.Timestamp,
+		SchemaVersion: mongoDocumentVersion,
+	})
+	return err
+}
+
+func (s *MongoStore) TakeReceipts(ownerID string) ([]ReceiptData, error) {
+	cursor, err := s.receiptCol.Find(
+		context.TODO(),
+		bson.M{"owner_id": ownerID},
+		options.Find().SetSort(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoReceipt
+	err = cursor.All(context.TODO(), &docs)
+	if err != nil {
+		return nil, err
+	}
+	// One by one, so a concurrent call does not return the same receipt
+	receipts := make([]ReceiptData, 0, len(docs))
+	for _, doc := range docs {
+		result, err := s.receiptCol.DeleteOne(context.TODO(), bson.M{"_id": doc.ID})
+		if err != nil {
+			return receipts, err
+		}
+		if result.DeletedCount > 0 {
+			receipts = append(receipts, doc.toReceiptData())
+		}
+	}
+	return receipts, nil
+}
+
+// Make room for one more document matching filter, dropping the oldest
+func mongoEvictOldest(col *mongo.Collection, filter bson.M, maxStored int) error {
+	if maxStored <= 0 {
+		return nil
+	}
+	kept, err := col.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	if kept < int64(maxStored) {
+		return nil
+	}
+	cursor, err := col.Find(
+		context.TODO(),
+		filter,
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(kept-int64(maxStored)+1).SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var oldest []struct {
+		ID string `bson:"_id"`
+	}
+	err = cursor.All(context.TODO(), &oldest)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(oldest))
+	for _, doc := range oldest {
+		ids = append(ids, doc.ID)
+	}
+	_, err = col.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (s *MongoStore) PushDelivery(delivery DeliveryData, maxStored int) error {
+	err := mongoEvictOldest(s.deliveryCol, bson.M{"recipient_id": delivery.RecipientID}, maxStored)
+	if err != nil {
+		return err
+	}
+	_, err = s.deliveryCol.InsertOne(context.TODO(), mongoDelivery{
+		ID:            delivery.ID,
+		RecipientID:   delivery.RecipientID,
+		SenderID:      delivery.SenderID,
+		MessageID:     delivery.MessageID,
+		Timestamp:     delivery.Timestamp,
+		SchemaVersion: mongoDocumentVersion,
+	})
+	return err
+}
+
+func (s *MongoStore) TakeDelivery(recipientID string, senderID string, messageID string) (bool, error) {
+	result, err := s.deliveryCol.DeleteOne(
+		context.TODO(),
+		bson.M{"recipient_id": recipientID, "sender_id": senderID, "message_id": messageID},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) PurgeReceipts(before time.Time) (int, error) {
+	filter := bson.M{"timestamp": bson.M{"$lt": before}}
+	receipts, err := s.receiptCol.DeleteMany(context.TODO(), filter)
+	if err != nil {
+		return 0, err
+	}
+	deliveries, err := s.deliveryCol.DeleteMany(context.TODO(), filter)
+	if err != nil {
+		return int(receipts.DeletedCount), err
+	}
+	return int(receipts.DeletedCount + deliveries.DeletedCount), nil
+}
+
+func (s *MongoStore) GetUser(username string) (UserRecord, bool, error) {
+	var user UserRecord
+	err := s.userCol.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return UserRecord{}, false, nil
+	}
+	if err != nil {
+		return UserRecord{}, false, err
+	}
+	return user, true, nil
+}
+
+func (s *MongoStore) CreateUser(user UserRecord) (bool, error) {
+	// Upsert with $setOnInsert never overwrites an existing account
+	result, err := s.userCol.UpdateOne(
+		context.TODO(),
+		bson.M{"username": user.Username},
+		bson.M{"$setOnInsert": mongoUser{UserRecord: user, SchemaVersion: mongoDocumentVersion}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (s *MongoStore) ListUsers() ([]UserRecord, error) {
+	cursor, err := s.userCol.Find(context.TODO(), bson.M{}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]UserRecord, 0)
+	err = cursor.All(context.TODO(), &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoStore) SetUserSuspended(username string, suspended bool) (bool, error) {
+	result, err := s.userCol.UpdateOne(
+		context.TODO(),
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"suspended": suspended}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *MongoStore) SetUserPresence(username string, presence PresenceSettings) (bool, error) {
+	result, err := s.userCol.UpdateOne(
+		context.TODO(),
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"presence": presence}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (s *MongoStore) TouchUser(username string, at time.Time) error {
+	_, err := s.userCol.UpdateOne(
+		context.TODO(),
+		bson.M{"username": username},
+		bson.M{"$set": bson.M{"last_seen": at}},
+	)
+	return err
+}
+
+func (s *MongoStore) ListInactiveUsers(before time.Time) ([]string, error) {
+	// Missing last_seen never matches $lt
+	cursor, err := s.userCol.Find(
+		context.TODO(),
+		bson.M{"last_seen": bson.M{"$lt": before}},
+		options.Find().SetProjection(bson.M{"username": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserRecord
+	err = cursor.All(context.TODO(), &users)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(users))
+	for _, user := range users {
+		usernames = append(usernames, user.Username)
+	}
+	return usernames, nil
+}
+
+func (s *MongoStore) DeleteUser(username string, inactiveBefore time.Time) (bool, error) {
+	filter := bson.M{"username": username}
+	if !inactiveBefore.IsZero() {
+		filter["last_seen"] = bson.M{"$lt": inactiveBefore}
+	}
+	result, err := s.userCol.DeleteOne(context.TODO(), filter)
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
+
+func (s *MongoStore) DeleteClient(clientID string) error {
+	_, err := s.clientCol.DeleteOne(context.TODO(), bson.M{"client_id": clientID})
+	if err != nil {
+		return err
+	}
+	_, err = s.messageCol.DeleteMany(context.TODO(), bson.M{"recipient_id": clientID})
+	if err != nil {
+		return err
+	}
+	_, err = s.receiptCol.DeleteMany(context.TODO(), bson.M{"owner_id": clientID})
+	if err != nil {
+		return err
+	}
+	_, err = s.deliveryCol.DeleteMany(context.TODO(), bson.M{"recipient_id": clientID})
+	return err
+}
+
+func (s *MongoStore) Close() error {
+	return s.client.Disconnect(context.TODO())
+}
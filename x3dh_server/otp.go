@@ -0,0 +1,120 @@
+package x3dh_server
+
+import (
+	"bytes"
+	"sort"
+
+	"go.step.sm/crypto/x25519"
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+// Why an uploaded one time pre key was not stored
+const (
+	OTPRejectedMalformed = "malformed"
+	OTPRejectedDuplicate = "duplicate"
+	OTPRejectedReused    = "reused"
+	OTPRejectedLimit     = "limit"
+)
+
+type OTPRejection struct {
+	ID     int
+	Reason string
+}
+
+type OTPUploadResult struct {
+	Accepted []int
+	Rejected []OTPRejection
+}
+
+var zeroKey = make([]byte, x25519.PublicKeySize)
+
+// Checks that need no stored state: key size, non-negative IDs unique within
+// the upload. Valid keys are returned sorted by ID.
+func checkOTPs(otps []X3DHCore.X3DHPublicOTP) ([]X3DHCore.X3DHPublicOTP, []OTPRejection) {
+	valid := make([]X3DHCore.X3DHPublicOTP, 0, len(otps))
+	rejected := make([]OTPRejection, 0)
+	seen := make(map[int]bool, len(otps))
+	for _, otp := range otps {
+		if len(otp.OneTimePreKey) != x25519.PublicKeySize || bytes.Equal(otp.OneTimePreKey, zeroKey) || otp.OneTimePreKeyID < 0 {
+			rejected = append(rejected, OTPRejection{ID: otp.OneTimePreKeyID, Reason: OTPRejectedMalformed})
+			continue
+		}
+		if seen[otp.OneTimePreKeyID] {
+			rejected = append(rejected, OTPRejection{ID: otp.OneTimePreKeyID, Reason: OTPRejectedDuplicate})
+			continue
+		}
+		seen[otp.OneTimePreKeyID] = true
+		valid = append(valid, otp)
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].OneTimePreKeyID < valid[j].OneTimePreKeyID
+	})
+	return valid, rejected
+}
+
+// Whether all keys of an uploaded bundle pass checkOTPs and fit the limit
+func validBundleOTPs(otps []X3DHCore.X3DHPublicOTP, maxStored int) bool {
+	if maxStored > 0 && len(otps) > maxStored {
+		return false
+	}
+	_, rejected := checkOTPs(otps)
+	return len(rejected) == 0
+}
+
+// Lowest ID a new key may have: above every ID the client has stored so far
+func nextOTPID(clientData *ClientData) int {
+	next := clientData.NextOTPID
+	for _, otp := range clientData.Bundle.OtpSet {
+		if otp.OneTimePreKeyID >= next {
+			next = otp.OneTimePreKeyID + 1
+		}
+	}
+	return next
+}
+
+// Keys of an uploaded bundle that may be stored: IDs never used by the client,
+// or still stored and so never handed out. Claimed keys must not come back.
+// Also returns the IDs kept because they are still stored, stores that read
+// before they write must check these were not claimed in between.
+func bundleOTPs(clientData *ClientData, otps []X3DHCore.X3DHPublicOTP) ([]X3DHCore.X3DHPublicOTP, []int) {
+	stored := make(map[int]bool, len(clientData.Bundle.OtpSet))
+	for _, otp := range clientData.Bundle.OtpSet {
+		stored[otp.OneTimePreKeyID] = true
+	}
+	kept := make([]X3DHCore.X3DHPublicOTP, 0, len(otps))
+	unclaimed := make([]int, 0)
+	for _, otp := range otps {
+		if otp.OneTimePreKeyID >= clientData.NextOTPID {
+			kept = append(kept, otp)
+		} else if stored[otp.OneTimePreKeyID] {
+			kept = append(kept, otp)
+			unclaimed = append(unclaimed, otp.OneTimePreKeyID)
+		}
+	}
+	return kept, unclaimed
+}
+
+// Append keys that passed checkOTPs to a client document, enforcing that IDs
+// are never reused and the stored count stays within maxStored (zero for no limit)
+func appendOTPs(clientData *ClientData, otps []X3DHCore.X3DHPublicOTP, maxStored int) OTPUploadResult {
+	result := OTPUploadResult{
+		Accepted: make([]int, 0, len(otps)),
+		Rejected: make([]OTPRejection, 0),
+	}
+	next := nextOTPID(clientData)
+	for _, otp := range otps {
+		if otp.OneTimePreKeyID < next {
+			result.Rejected = append(result.Rejected, OTPRejection{ID: otp.OneTimePreKeyID, Reason: OTPRejectedReused})
+			continue
+		}
+		if maxStored > 0 && len(clientData.Bundle.OtpSet) >= maxStored {
+			result.Rejected = append(result.Rejected, OTPRejection{ID: otp.OneTimePreKeyID, Reason: OTPRejectedLimit})
+			continue
+		}
+		clientData.Bundle.OtpSet = append(clientData.Bundle.OtpSet, otp)
+		result.Accepted = append(result.Accepted, otp.OneTimePreKeyID)
+		next = otp.OneTimePreKeyID + 1
+	}
+	clientData.NextOTPID = next
+	return result
+}
@@ -1,253 +1,390 @@
 package x3dh_server
 
 import (
-	"context"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	X3DHCore "tux.tech/x3dh/core"
 )
 
 type MessageData struct {
-	SenderID string
-	Message  X3DHCore.InitialMessage
+	// Assigned by the server, sorts in arrival order
+	ID          string
+	RecipientID string
+	SenderID    string
+	Message     X3DHCore.InitialMessage
+	Timestamp   time.Time
 }
 
+// Receipt kept for the sender of a message until it fetches it
+type ReceiptData struct {
+	// Assigned by the server, sorts in arrival order
+	ID string
+	// Sender of the message, who the receipt is for
+	OwnerID string
+	// Recipient of the message
+	FromID string
+	// X3DHCore.ReceiptDelivered or ReceiptRead
+	Type string
+	// Acknowledged message (delivered receipts)
+	MessageID string
+	// Encrypted by the recipient, the server cannot read it (read receipts)
+	Signal    *X3DHCore.EphemeralSignal
+	Timestamp time.Time
+}
+
+// A message acknowledged by its recipient. The recipient may send one read
+// receipt for it.
+type DeliveryData struct {
+	// Assigned by the server, sorts in arrival order
+	ID string
+	// Recipient of the message, who may send the read receipt
+	RecipientID string
+	// Sender of the message, who the read receipt is for
+	SenderID  string
+	MessageID string
+	Timestamp time.Time
+}
+
+// Receipts kept for a user that is offline, and deliveries kept for a user
+// that has not sent read receipts. The oldest are dropped beyond it.
+const maxStoredReceipts = 1000
+
 type ClientData struct {
 	// Bundle
-	Bundle X3DHCore.X3DHClientBundle
-	// Queue
-	Queue []MessageData
+	Bundle X3DHCore.X3DHClientBundle `bson:"bundle"`
+	// Identity key changes, oldest first
+	Rotations []X3DHCore.X3DHIdentityRotation `bson:"rotations,omitempty"`
+	// One time pre key IDs below this were already used
+	NextOTPID int `bson:"next_otp_id"`
+	// Upload of the bundle and its signed pre key, zero if unknown
+	SPKUpdatedAt time.Time `bson:"spk_updated_at,omitempty"`
+}
+
+// Replace the bundle of a client, dropping one time pre keys already handed out
+func (c *ClientData) setBundle(bundle X3DHCore.X3DHClientBundle) {
+	bundle.OtpSet, _ = bundleOTPs(c, bundle.OtpSet)
+	c.Bundle = bundle
+	c.NextOTPID = nextOTPID(c)
+	c.SPKUpdatedAt = time.Now().UTC()
+}
+
+// State of a client for operators
+type ClientStats struct {
+	Registered     bool
+	OTPCount       int
+	SPKUpdatedAt   time.Time
+	QueuedMessages int
 }
 
 type Server struct {
-	db        *mongo.Database
-	clientCol *mongo.Collection
-	//clients map[string]*ClientData
+	store  Store
+	limits Limits
 }
 
-func NewServer() *Server {
-	// Create connection to mongo
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+// Create a server on the storage backend selected by config
+func NewServer(config Config) (*Server, error) {
+	store, err := NewStore(config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return NewServerWithStore(store, config.Limits), nil
+}
 
-	db := client.Database("x3dh")
-	clientCol := db.Collection("clients")
-
+func NewServerWithStore(store Store, limits Limits) *Server {
 	return &Server{
-		db:        db,
-		clientCol: clientCol,
-
-		//clients: make(map[string]*ClientData),
+		store:  store,
+		limits: limits,
 	}
 }
 
+func (s *Server) Limits() Limits {
+	return s.limits
+}
+
 func NewClientData(bundle X3DHCore.X3DHClientBundle) *ClientData {
 	return &ClientData{
 		Bundle: bundle,
-		Queue:  make([]MessageData, 0),
 	}
 }
 
-/*
-func (s *Server) RegisterClient(clientID string, bundle X3DHCore.X3DHClientBundle) {
-	s.clients[clientID] = NewClientData(bundle)
-}*/
+// Hex ObjectIDs start with a timestamp and end with a per-process counter,
+// so they sort in the order they were created
+func newMessageID() string {
+	return primitive.NewObjectID().Hex()
+}
 
-func (s *Server) RegisterClient(clientID string, bundle X3DHCore.X3DHClientBundle) error {
-	data := NewClientData(bundle)
-	_, err := s.clientCol.UpdateOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-		bson.M{"$set": data},
-		options.Update().SetUpsert(true),
-	)
-	return err
+func (s *Server) Close() error {
+	return s.store.Close()
 }
 
-/*func (s *Server) IsClientRegistered(clientID string) bool {
-	_, ok := s.clients[clientID]
-	return ok
-}*/
+// Register a client or refresh its bundle. The identity key of a registered
+// client can only be changed with RotateIdentity.
+func (s *Server) RegisterClient(clientID string, bundle X3DHCore.X3DHClientBundle) error {
+	if !bundle.Validate() || !validBundleOTPs(bundle.OtpSet, s.limits.MaxStoredOTPs) {
+		return ErrInvalidBundle
+	}
+	stored, err := s.store.PutBundleForIdentity(clientID, bundle)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return ErrIdentityTaken
+	}
+	return nil
+}
 
 func (s *Server) IsClientRegistered(clientID string) (bool, error) {
-	count, err := s.clientCol.CountDocuments(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-	)
-	return count > 0, err
+	_, ok, err := s.store.GetBundle(clientID)
+	return ok, err
 }
 
-/*func (s *Server) GetRemainingOTPCount(clientID string) int {
-	c, ok := s.clients[clientID]
-	if !ok {
-		return 0
+func (s *Server) GetIdentityKey(clientID string) (X3DHCore.X3DHPublicIK, bool, error) {
+	bundle, ok, err := s.store.GetBundle(clientID)
+	if err != nil || !ok {
+		return X3DHCore.X3DHPublicIK{}, false, err
 	}
-	return len(c.Bundle.OtpSet)
-}*/
+	return bundle.IK, true, nil
+}
 
 func (s *Server) GetRemainingOTPCount(clientID string) (int, error) {
-	var clientData ClientData
-	err := s.clientCol.FindOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-	).Decode(&clientData)
+	return s.store.CountOTPs(clientID)
+}
+
+// Store uploaded one time pre keys that are well formed, have an ID never used
+// before by the client and fit the limit. Returns which keys were stored.
+func (s *Server) ExpandOTPSet(clientID string, otps []X3DHCore.X3DHPublicOTP) (OTPUploadResult, error) {
+	valid, rejected := checkOTPs(otps)
+	result, err := s.store.AppendOTPs(clientID, valid, s.limits.MaxStoredOTPs)
 	if err != nil {
-		return 0, err
+		return OTPUploadResult{}, err
 	}
-	return len(clientData.Bundle.OtpSet), nil
+	result.Rejected = append(rejected, result.Rejected...)
+	return result, nil
 }
 
-/*func (s *Server) ExpandOTPSet(clientID string, otps []X3DHCore.X3DHPublicOTP) {
-	c, ok := s.clients[clientID]
-	if !ok {
-		return
-	}
-	c.Bundle.OtpSet = append(c.Bundle.OtpSet, otps...)
-}*/
+// Key bundle for a new conversation. Each one time pre key is handed out at most once.
+func (s *Server) GetClientBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error) {
+	return s.store.ClaimBundle(clientID)
+}
 
-func (s *Server) ExpandOTPSet(clientID string, otps []X3DHCore.X3DHPublicOTP) error {
-	var clientData ClientData
-	err := s.clientCol.FindOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-	).Decode(&clientData)
+// Queue a message for a recipient. The returned copy carries the assigned ID.
+func (s *Server) SendMessage(recipientID string, senderID string, msg X3DHCore.InitialMessage) (MessageData, error) {
+	if s.limits.MaxMessageSize > 0 && msg.Size() > s.limits.MaxMessageSize {
+		return MessageData{}, ErrMessageTooLarge
+	}
+	data := MessageData{
+		ID:          newMessageID(),
+		RecipientID: recipientID,
+		SenderID:    senderID,
+		Message:     msg,
+		Timestamp:   time.Now().UTC(),
+	}
+	err := s.store.PushMessage(recipientID, data, s.limits.MaxQueuedMessages)
 	if err != nil {
-		return err
+		return MessageData{}, err
+	}
+	return data, nil
+}
+
+// Oldest message not yet acknowledged. It is returned again until AckMessage is called.
+func (s *Server) GetMessage(clientID string) (MessageData, bool, error) {
+	messages, err := s.store.ListMessages(clientID, "", 1)
+	if err != nil || len(messages) == 0 {
+		return MessageData{}, false, err
 	}
+	return messages[0], true, nil
+}
 
-	clientData.Bundle.OtpSet = append(clientData.Bundle.OtpSet, otps...)
-	_, err = s.clientCol.UpdateOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-		bson.M{"$set": bson.M{"bundle.otpSet": clientData.Bundle.OtpSet}},
-	)
-	return err
-}
-
-/*func (s *Server) GetClientBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool) {
-	c, ok := s.clients[clientID]
-	if !ok {
-		return X3DHCore.X3DHKeyBundle{}, false
-	}
-	// Build the key bundle
-	// Identity Key
-	ik := c.Bundle.IK
-	// Signed Pre Key
-	spk := c.Bundle.SPK
-	// One Time Pre Key
-	if len(c.Bundle.OtpSet) == 0 {
-		return X3DHCore.X3DHKeyBundle{}, false
-	}
-	otp := c.Bundle.OtpSet[0]
-	c.Bundle.OtpSet = c.Bundle.OtpSet[1:]
-	// Return
-	return X3DHCore.X3DHKeyBundle{
-		IK:  ik,
-		SPK: spk,
-		OTP: otp,
-	}, true
-}*/
+// Queued messages after afterID (from the start if empty), oldest first
+func (s *Server) ListMessages(clientID string, afterID string, limit int) ([]MessageData, error) {
+	return s.store.ListMessages(clientID, afterID, limit)
+}
 
-func (s *Server) GetClientBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error) {
-	var clientData ClientData
-	err := s.clientCol.FindOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-	).Decode(&clientData)
+// Returns the acknowledged message, so its sender can be told
+func (s *Server) AckMessage(clientID string, messageID string) (MessageData, bool, error) {
+	return s.store.AckMessage(clientID, messageID)
+}
+
+// Keep a receipt until its owner fetches it with TakeReceipts. The returned
+// copy carries the assigned ID and timestamp.
+func (s *Server) KeepReceipt(receipt ReceiptData) (ReceiptData, error) {
+	receipt.ID = newMessageID()
+	receipt.Timestamp = time.Now().UTC()
+	err := s.store.PushReceipt(receipt, maxStoredReceipts)
 	if err != nil {
-		return X3DHCore.X3DHKeyBundle{}, false, err
+		return ReceiptData{}, err
 	}
+	return receipt, nil
+}
+
+// Receipts kept for a user, oldest first. They are removed from the store.
+func (s *Server) TakeReceipts(ownerID string) ([]ReceiptData, error) {
+	return s.store.TakeReceipts(ownerID)
+}
 
-	if len(clientData.Bundle.OtpSet) == 0 {
-		return X3DHCore.X3DHKeyBundle{}, false, nil
+// Remember an acknowledged message, so its recipient can send a read receipt
+func (s *Server) RecordDelivery(msg MessageData) error {
+	return s.store.PushDelivery(DeliveryData{
+		ID:          newMessageID(),
+		RecipientID: msg.RecipientID,
+		SenderID:    msg.SenderID,
+		MessageID:   msg.ID,
+		Timestamp:   time.Now().UTC(),
+	}, maxStoredReceipts)
+}
+
+// Whether recipientID was delivered the message of senderID, so it may send
+// a read receipt for it. Each delivery allows one read receipt.
+func (s *Server) TakeDelivery(recipientID string, senderID string, messageID string) (bool, error) {
+	return s.store.TakeDelivery(recipientID, senderID, messageID)
+}
+
+// Drop messages older than the TTL, returns what was dropped so senders can be told
+func (s *Server) PurgeExpiredMessages() ([]MessageData, error) {
+	if s.limits.MessageTTL <= 0 {
+		return nil, nil
 	}
+	return s.store.PurgeMessages(time.Now().UTC().Add(-s.limits.MessageTTL))
+}
 
-	otp := clientData.Bundle.OtpSet[0]
-	clientData.Bundle.OtpSet = clientData.Bundle.OtpSet[1:]
+// Drop receipts and deliveries older than the message TTL, returns how many
+// were dropped
+func (s *Server) PurgeExpiredReceipts() (int, error) {
+	if s.limits.MessageTTL <= 0 {
+		return 0, nil
+	}
+	return s.store.PurgeReceipts(time.Now().UTC().Add(-s.limits.MessageTTL))
+}
 
-	_, err = s.clientCol.UpdateOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-		bson.M{"$set": bson.M{"bundle.otpSet": clientData.Bundle.OtpSet}},
-	)
+// Replace the bundle of a client with one for a new identity key and record the
+// continuity statement. Unsigned statements (resets) are recorded as such.
+func (s *Server) RotateIdentity(clientID string, bundle X3DHCore.X3DHClientBundle, rotation X3DHCore.X3DHIdentityRotation) error {
+	if !bundle.Validate() || !validBundleOTPs(bundle.OtpSet, s.limits.MaxStoredOTPs) {
+		return ErrInvalidBundle
+	}
+	// Statement must link the stored key to the uploaded one
+	if !rotation.NewIdentityKey.Equal(bundle.IK.IdentityKey) {
+		return ErrIdentityMismatch
+	}
+	if rotation.IsSigned() && !rotation.Verify() {
+		return ErrInvalidRotation
+	}
+	// Only apply if the stored key is still the old one
+	replaced, err := s.store.ReplaceIdentity(clientID, rotation.OldIdentityKey, bundle, rotation)
 	if err != nil {
-		return X3DHCore.X3DHKeyBundle{}, false, err
+		return err
+	}
+	if !replaced {
+		registered, err := s.IsClientRegistered(clientID)
+		if err != nil {
+			return err
+		}
+		if !registered {
+			return ErrClientNotFound
+		}
+		return ErrIdentityMismatch
 	}
+	return nil
+}
+
+func (s *Server) GetIdentityRotations(clientID string) ([]X3DHCore.X3DHIdentityRotation, bool, error) {
+	return s.store.GetRotations(clientID)
+}
 
-	return X3DHCore.X3DHKeyBundle{
-		IK:  clientData.Bundle.IK,
-		SPK: clientData.Bundle.SPK,
-		OTP: otp,
-	}, true, nil
+func (s *Server) GetUser(username string) (UserRecord, bool, error) {
+	return s.store.GetUser(username)
 }
 
-/*func (s *Server) SendMessage(recipientID string, senderID string, msg X3DHCore.InitialMessage) bool {
-	c, ok := s.clients[recipientID]
-	if !ok {
-		return false
+func (s *Server) CreateUser(user UserRecord) (bool, error) {
+	if user.LastSeen.IsZero() {
+		user.LastSeen = time.Now().UTC()
 	}
-	c.Queue = append(c.Queue, MessageData{
-		SenderID: senderID,
-		Message:  msg,
-	})
-	return true
-}*/
+	return s.store.CreateUser(user)
+}
 
-func (s *Server) SendMessage(recipientID string, senderID string, msg X3DHCore.InitialMessage) bool {
-	_, err := s.clientCol.UpdateOne(
-		context.TODO(),
-		bson.M{"clientID": recipientID},
-		bson.M{"$push": bson.M{"queue": MessageData{
-			SenderID: senderID,
-			Message:  msg,
-		}}},
-	)
-	return err == nil
+func (s *Server) ListUsers() ([]UserRecord, error) {
+	return s.store.ListUsers()
 }
 
-/*func (s *Server) GetMessage(clientID string) (MessageData, bool) {
-	c, ok := s.clients[clientID]
-	if !ok {
-		return MessageData{}, false
-	}
-	if len(c.Queue) == 0 {
-		return MessageData{}, false
+func (s *Server) SetUserSuspended(username string, suspended bool) (bool, error) {
+	return s.store.SetUserSuspended(username, suspended)
+}
+
+// Returns false if the user does not exist
+func (s *Server) SetUserPresence(username string, presence PresenceSettings) (bool, error) {
+	if !presence.Valid() {
+		return false, ErrInvalidPresence
 	}
-	msg := c.Queue[0]
-	c.Queue = c.Queue[1:]
-	return msg, true
-}*/
+	return s.store.SetUserPresence(username, presence)
+}
 
-func (s *Server) GetMessage(clientID string) (MessageData, bool, error) {
-	var clientData ClientData
-	err := s.clientCol.FindOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-	).Decode(&clientData)
+func (s *Server) GetClientStats(clientID string) (ClientStats, error) {
+	clientData, ok, err := s.store.GetClient(clientID)
+	if err != nil || !ok {
+		return ClientStats{}, err
+	}
+	queued, err := s.store.CountMessages(clientID)
 	if err != nil {
-		return MessageData{}, false, err
+		return ClientStats{}, err
 	}
+	return ClientStats{
+		Registered:     true,
+		OTPCount:       len(clientData.Bundle.OtpSet),
+		SPKUpdatedAt:   clientData.SPKUpdatedAt,
+		QueuedMessages: queued,
+	}, nil
+}
 
-	if len(clientData.Queue) == 0 {
-		return MessageData{}, false, nil
-	}
+// Drop every message queued for a client, returns how many were dropped
+func (s *Server) ClearMessages(clientID string) (int, error) {
+	return s.store.ClearMessages(clientID)
+}
 
-	msg := clientData.Queue[0]
-	clientData.Queue = clientData.Queue[1:]
+func (s *Server) TouchUser(username string) error {
+	return s.store.TouchUser(username, time.Now().UTC())
+}
 
-	_, err = s.clientCol.UpdateOne(
-		context.TODO(),
-		bson.M{"clientID": clientID},
-		bson.M{"$set": bson.M{"queue": clientData.Queue}},
-	)
+// Remove everything stored for a user: account, bundle, rotations, queue and receipts.
+// Messages the user sent to others stay queued for them.
+func (s *Server) DeleteAccount(username string) (bool, error) {
+	deleted, err := s.store.DeleteUser(username, time.Time{})
 	if err != nil {
-		return MessageData{}, false, err
+		return false, err
+	}
+	// Also clean up a bundle left without an account
+	err = s.store.DeleteClient(username)
+	if err != nil {
+		return deleted, err
 	}
+	return deleted, nil
+}
 
-	return msg, true, nil
+// Delete accounts not seen within the inactivity TTL, returns their names
+func (s *Server) ExpireInactiveAccounts() ([]string, error) {
+	if s.limits.InactiveAccountTTL <= 0 {
+		return nil, nil
+	}
+	before := time.Now().UTC().Add(-s.limits.InactiveAccountTTL)
+	usernames, err := s.store.ListInactiveUsers(before)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		// Skip users that logged in since they were listed
+		deleted, err := s.store.DeleteUser(username, before)
+		if err != nil {
+			return expired, err
+		}
+		if !deleted {
+			continue
+		}
+		err = s.store.DeleteClient(username)
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, username)
+	}
+	return expired, nil
 }
@@ -0,0 +1,118 @@
+package x3dh_server
+
+import (
+	"fmt"
+	"testing"
+
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+func TestRegisterClient(t *testing.T) {
+	s := NewServerWithStore(NewMemoryStore(), DefaultLimits())
+	bundle, ik := testBundle(t, 0)
+
+	// Signed pre key signed by another identity key
+	forged := bundle
+	other, _ := testBundle(t)
+	forged.SPK = other.SPK
+	if err := s.RegisterClient("alice", forged); err != ErrInvalidBundle {
+		t.Fatalf("RegisterClient with forged signature = %v; want ErrInvalidBundle", err)
+	}
+	// Malformed keys must not panic
+	malformed := bundle
+	malformed.IK.IdentityKey = []byte{1, 2, 3}
+	if err := s.RegisterClient("alice", malformed); err != ErrInvalidBundle {
+		t.Fatalf("RegisterClient with malformed key = %v; want ErrInvalidBundle", err)
+	}
+	if registered, _ := s.IsClientRegistered("alice"); registered {
+		t.Fatalf("invalid bundle was registered")
+	}
+
+	if err := s.RegisterClient("alice", bundle); err != nil {
+		t.Fatalf("RegisterClient = %v; want nil", err)
+	}
+	// Re-upload with the same identity key
+	spk, err := X3DHCore.GenerateFullSPK(ik.IdentityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := bundle
+	refreshed.SPK = *spk.PublicSPK()
+	if err := s.RegisterClient("alice", refreshed); err != nil {
+		t.Fatalf("RegisterClient with same identity = %v; want nil", err)
+	}
+	// Takeover with a new identity key
+	if err := s.RegisterClient("alice", other); err != ErrIdentityTaken {
+		t.Fatalf("RegisterClient with other identity = %v; want ErrIdentityTaken", err)
+	}
+	key, _, _ := s.GetIdentityKey("alice")
+	if !key.IdentityKey.Equal(bundle.IK.IdentityKey) {
+		t.Fatalf("identity key was replaced")
+	}
+}
+
+func TestExpandOTPSet(t *testing.T) {
+	s := NewServerWithStore(NewMemoryStore(), DefaultLimits())
+	bundle, _ := testBundle(t, 0)
+	if err := s.RegisterClient("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	otps := testOTPs(t, 3, 1, 2, 2)
+	otps = append(otps,
+		X3DHCore.X3DHPublicOTP{OneTimePreKey: []byte{1, 2, 3}, OneTimePreKeyID: 4},
+		X3DHCore.X3DHPublicOTP{OneTimePreKey: make([]byte, 32), OneTimePreKeyID: 5},
+		X3DHCore.X3DHPublicOTP{OneTimePreKey: otps[0].OneTimePreKey, OneTimePreKeyID: -1},
+	)
+	result, err := s.ExpandOTPSet("alice", otps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored in ID order
+	if fmt.Sprint(result.Accepted) != "[1 2 3]" {
+		t.Fatalf("ExpandOTPSet accepted %v; want [1 2 3]", result.Accepted)
+	}
+	reasons := make(map[int]string)
+	for _, rejection := range result.Rejected {
+		reasons[rejection.ID] = rejection.Reason
+	}
+	want := map[int]string{
+		2:  OTPRejectedDuplicate,
+		4:  OTPRejectedMalformed,
+		5:  OTPRejectedMalformed,
+		-1: OTPRejectedMalformed,
+	}
+	if fmt.Sprint(reasons) != fmt.Sprint(want) {
+		t.Fatalf("ExpandOTPSet rejected %v; want %v", reasons, want)
+	}
+
+	if _, err := s.ExpandOTPSet("nobody", testOTPs(t, 1)); err != ErrClientNotFound {
+		t.Fatalf("ExpandOTPSet for unknown client = %v; want ErrClientNotFound", err)
+	}
+
+	// Bundles with bad keys are refused as a whole
+	bad, _ := testBundle(t, 0, 0)
+	if err := s.RegisterClient("bob", bad); err != ErrInvalidBundle {
+		t.Fatalf("RegisterClient with duplicate pre key IDs = %v; want ErrInvalidBundle", err)
+	}
+}
+
+func TestSendMessageSize(t *testing.T) {
+	limits := DefaultLimits()
+	limits.MaxMessageSize = 256
+	s := NewServerWithStore(NewMemoryStore(), limits)
+	bundle, _ := testBundle(t, 0)
+	if err := s.RegisterClient("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := X3DHCore.InitialMessage{Ciphertext: make([]byte, 128), AD: make([]byte, 64)}
+	if _, err := s.SendMessage("alice", "bob", msg); err != nil {
+		t.Fatalf("SendMessage within the limit = %v; want nil", err)
+	}
+	// Payload moved to the associated data counts as well
+	msg.AD = make([]byte, 1024)
+	if _, err := s.SendMessage("alice", "bob", msg); err != ErrMessageTooLarge {
+		t.Fatalf("SendMessage with large associated data = %v; want ErrMessageTooLarge", err)
+	}
+}
@@ -0,0 +1,250 @@
+package x3dh_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+var (
+	ErrClientNotFound   = errors.New("client not registered")
+	ErrIdentityMismatch = errors.New("rotation does not match the current identity key")
+	ErrInvalidRotation  = errors.New("invalid rotation signature")
+	ErrInvalidBundle    = errors.New("invalid signed pre key signature or one time pre keys")
+	ErrIdentityTaken    = errors.New("a different identity key is registered, a rotation is required")
+	ErrQueueFull        = errors.New("recipient queue is full")
+	ErrMessageTooLarge  = errors.New("message is too large")
+	ErrInvalidPresence  = errors.New("invalid presence settings")
+)
+
+type UserRecord struct {
+	Username     string `bson:"username" json:"username"`
+	PasswordHash string `bson:"password" json:"password"`
+	// Last login or logout, zero for accounts created before it was tracked
+	LastSeen time.Time `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
+	// Suspended accounts cannot log in
+	Suspended bool `bson:"suspended,omitempty" json:"suspended,omitempty"`
+	// Who may see whether the user is online
+	Presence PresenceSettings `bson:"presence,omitempty" json:"presence,omitempty"`
+}
+
+// Contacts a user can share presence with
+const maxPresenceContacts = 1000
+
+// Presence is hidden unless the user opts in
+type PresenceSettings struct {
+	// X3DHCore.PresenceNobody, PresenceContacts or PresenceEveryone
+	Visibility string `bson:"visibility,omitempty" json:"visibility,omitempty"`
+	// Also show when the user was last online
+	ShareLastSeen bool `bson:"share_last_seen,omitempty" json:"share_last_seen,omitempty"`
+	// Users that count as contacts for PresenceContacts
+	Contacts []string `bson:"contacts,omitempty" json:"contacts,omitempty"`
+}
+
+func (p PresenceSettings) Valid() bool {
+	switch p.Visibility {
+	case "", X3DHCore.PresenceNobody, X3DHCore.PresenceEveryone:
+		return len(p.Contacts) == 0
+	case X3DHCore.PresenceContacts:
+		return len(p.Contacts) <= maxPresenceContacts
+	default:
+		return false
+	}
+}
+
+// Whether viewer may see the presence of the user with these settings
+func (p PresenceSettings) VisibleTo(viewer string) bool {
+	switch p.Visibility {
+	case X3DHCore.PresenceEveryone:
+		return true
+	case X3DHCore.PresenceContacts:
+		return slices.Contains(p.Contacts, viewer)
+	default:
+		return false
+	}
+}
+
+// Accounts never seen are not considered inactive
+func isInactive(user UserRecord, before time.Time) bool {
+	return !user.LastSeen.IsZero() && user.LastSeen.Before(before)
+}
+
+// Persistence for bundles, prekeys, message queues and user accounts.
+// Every method must be safe for concurrent use.
+type Store interface {
+	// Create or replace the bundle of a client (queued messages are kept).
+	// One time pre keys with an ID already used are dropped unless they are
+	// still stored, so a claimed key is never handed out again.
+	PutBundle(clientID string, bundle X3DHCore.X3DHClientBundle) error
+	// Like PutBundle, but only if the client is new or already has the identity
+	// key of the bundle. Returns false if a different identity key is stored.
+	PutBundleForIdentity(clientID string, bundle X3DHCore.X3DHClientBundle) (bool, error)
+	// Bundle of a client, including all remaining one time pre keys
+	GetBundle(clientID string) (X3DHCore.X3DHClientBundle, bool, error)
+	// Replace the bundle and record the rotation, only if the stored identity key is oldKey.
+	// Returns false if the client is missing or has a different identity key.
+	ReplaceIdentity(clientID string, oldKey []byte, bundle X3DHCore.X3DHClientBundle, rotation X3DHCore.X3DHIdentityRotation) (bool, error)
+	// Identity key changes, oldest first
+	GetRotations(clientID string) ([]X3DHCore.X3DHIdentityRotation, bool, error)
+	// Everything stored for a client except its queued messages
+	GetClient(clientID string) (ClientData, bool, error)
+
+	// Add one time pre keys, sorted by ID and already checked with checkOTPs.
+	// Keys with an ID below the highest one ever stored for the client are
+	// rejected as reused, keys beyond maxStored (zero for no limit) as over the
+	// limit. ErrClientNotFound if the client is missing.
+	AppendOTPs(clientID string, otps []X3DHCore.X3DHPublicOTP, maxStored int) (OTPUploadResult, error)
+	// Key bundle built from the stored bundle and its oldest one time pre key.
+	// The key is removed in the same atomic operation, so concurrent callers
+	// never receive the same one. Returns false if no key is left.
+	ClaimBundle(clientID string) (X3DHCore.X3DHKeyBundle, bool, error)
+	CountOTPs(clientID string) (int, error)
+
+	// Queue a message (ErrClientNotFound if the recipient is missing, ErrQueueFull
+	// if maxQueued messages are already waiting, zero for no limit).
+	// The ID is assigned by the caller and orders the queue.
+	PushMessage(recipientID string, msg MessageData, maxQueued int) error
+	// Queued messages with an ID greater than afterID (all if empty), oldest first.
+	// Messages stay queued until acknowledged.
+	ListMessages(clientID string, afterID string, limit int) ([]MessageData, error)
+	// Remove a message from the queue and return it. Returns false if it was not queued.
+	AckMessage(clientID string, messageID string) (MessageData, bool, error)
+	// Remove messages queued before the given time and return them
+	PurgeMessages(before time.Time) ([]MessageData, error)
+	CountMessages(clientID string) (int, error)
+	// Remove every message queued for a client, returns how many were removed
+	ClearMessages(clientID string) (int, error)
+
+	// Keep a receipt for receipt.OwnerID (ErrClientNotFound if the owner is
+	// missing). If maxStored receipts are already kept the oldest is dropped,
+	// zero for no limit. The ID is assigned by the caller and orders the receipts.
+	PushReceipt(receipt ReceiptData, maxStored int) error
+	// Remove the receipts kept for a user and return them, oldest first
+	TakeReceipts(ownerID string) ([]ReceiptData, error)
+	// Keep a delivery for delivery.RecipientID. If maxStored deliveries are
+	// already kept the oldest is dropped, zero for no limit.
+	PushDelivery(delivery DeliveryData, maxStored int) error
+	// Remove a delivery, returns false if none matches
+	TakeDelivery(recipientID string, senderID string, messageID string) (bool, error)
+	// Remove receipts and deliveries kept before the given time, returns how
+	// many were removed
+	PurgeReceipts(before time.Time) (int, error)
+
+	GetUser(username string) (UserRecord, bool, error)
+	// Returns false if the user already exists
+	CreateUser(user UserRecord) (bool, error)
+	// All accounts, sorted by username
+	ListUsers() ([]UserRecord, error)
+	// Returns false if the user does not exist
+	SetUserSuspended(username string, suspended bool) (bool, error)
+	// Returns false if the user does not exist
+	SetUserPresence(username string, presence PresenceSettings) (bool, error)
+	// Record activity of an existing user
+	TouchUser(username string, at time.Time) error
+	// Users last seen before the given time. Users never seen are not listed.
+	ListInactiveUsers(before time.Time) ([]string, error)
+	// Remove a user account. With a non-zero inactiveBefore the account is only
+	// removed if it was last seen before that time. Returns false if nothing was removed.
+	DeleteUser(username string, inactiveBefore time.Time) (bool, error)
+	// Remove the bundle, rotations, queued messages, receipts and deliveries of
+	// a client
+	DeleteClient(clientID string) error
+
+	Close() error
+}
+
+const (
+	BackendMemory = "memory"
+	BackendMongo  = "mongo"
+	BackendBolt   = "bolt"
+)
+
+// Zero disables a limit
+type Limits struct {
+	// Messages waiting for one recipient
+	MaxQueuedMessages int
+	// Bytes per message, see InitialMessage.Size
+	MaxMessageSize int
+	// Unacknowledged messages older than this are purged
+	MessageTTL time.Duration
+	// One time pre keys stored per client
+	MaxStoredOTPs int
+	// Accounts without a login for this long are deleted
+	InactiveAccountTTL time.Duration
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxQueuedMessages: 1000,
+		MaxMessageSize:    64 * 1024,
+		MessageTTL:        30 * 24 * time.Hour,
+		MaxStoredOTPs:     100,
+	}
+}
+
+type Config struct {
+	// Storage backend: memory, mongo or bolt
+	Backend string
+	// Connection string (mongo) or database file (bolt)
+	URI string
+	// Database for bundles and queues (mongo)
+	Database string
+	// Database for user accounts (mongo)
+	AuthDatabase string
+	// Message queue limits
+	Limits Limits
+	// Apply pending schema migrations when the store is opened (mongo).
+	// Otherwise opening fails with ErrMigrationsPending until MigrateStore is run.
+	AutoMigrate bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Backend:      BackendMongo,
+		URI:          "mongodb://localhost:27017",
+		Database:     "x3dh",
+		AuthDatabase: "x3dh_auth",
+		Limits:       DefaultLimits(),
+		AutoMigrate:  true,
+	}
+}
+
+func NewStore(config Config) (Store, error) {
+	switch config.Backend {
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendMongo:
+		store, err := NewMongoStore(config.URI, config.Database, config.AuthDatabase)
+		if err != nil {
+			return nil, err
+		}
+		err = store.prepareSchema(config.AutoMigrate)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case BackendBolt:
+		return NewBoltStore(config.URI)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// Apply pending schema migrations and return their names. Only the mongo
+// backend has a schema, the others have nothing to migrate.
+func MigrateStore(config Config) ([]string, error) {
+	if config.Backend != BackendMongo {
+		return nil, nil
+	}
+	store, err := NewMongoStore(config.URI, config.Database, config.AuthDatabase)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return store.Migrate(context.TODO())
+}
@@ -0,0 +1,985 @@
+package x3dh_server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	X3DHCore "tux.tech/x3dh/core"
+)
+
+// Every backend runs the same conformance suite. MongoDB is only tested when
+// X3DH_TEST_MONGO_URI points at a server (a scratch database is used and dropped).
+
+func TestMemoryStore(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Store {
+		store, err := NewBoltStore(filepath.Join(t.TempDir(), "x3dh.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// Accounts stored before last_seen was tracked get one when the file is opened
+func TestBoltStoreBackfillsLastSeen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x3dh.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	store.CreateUser(UserRecord{Username: "alice"})
+	store.CreateUser(UserRecord{Username: "bob", LastSeen: seen})
+	store.Close()
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if alice, _, _ := store.GetUser("alice"); alice.LastSeen.IsZero() {
+		t.Fatalf("LastSeen of alice is still zero after reopening")
+	}
+	if bob, _, _ := store.GetUser("bob"); !bob.LastSeen.Equal(seen) {
+		t.Fatalf("LastSeen of bob = %v; want %v", bob.LastSeen, seen)
+	}
+}
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("X3DH_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("X3DH_TEST_MONGO_URI not set")
+	}
+	runStoreConformance(t, func(t *testing.T) Store {
+		suffix := fmt.Sprint(time.Now().UnixNano())
+		store, err := NewMongoStore(uri, "x3dh_test_"+suffix, "x3dh_auth_test_"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Migrate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			store.db.Drop(context.Background())
+			store.userCol.Database().Drop(context.Background())
+		})
+		return store
+	})
+}
+
+func runStoreConformance(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Store)
+	}{
+		{"Bundles", testStoreBundles},
+		{"PutBundleForIdentity", testStorePutBundleForIdentity},
+		{"OneTimePreKeys", testStoreOneTimePreKeys},
+		{"OneTimePreKeyReuseAndLimit", testStoreOTPReuseAndLimit},
+		{"BundleOneTimePreKeyReuse", testStoreBundleOTPReuse},
+		{"ConcurrentClaims", testStoreConcurrentClaims},
+		{"ConcurrentClaimsAndAppends", testStoreConcurrentClaimsAndAppends},
+		{"Messages", testStoreMessages},
+		{"QueueLimit", testStoreQueueLimit},
+		{"Receipts", testStoreReceipts},
+		{"Deliveries", testStoreDeliveries},
+		{"PurgeReceipts", testStorePurgeReceipts},
+		{"PurgeMessages", testStorePurgeMessages},
+		{"ReplaceIdentity", testStoreReplaceIdentity},
+		{"Users", testStoreUsers},
+		{"InactiveUsers", testStoreInactiveUsers},
+		{"DeleteClient", testStoreDeleteClient},
+		{"ClientStats", testStoreClientStats},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			tt.fn(t, s)
+		})
+	}
+}
+
+func testBundle(t *testing.T, otpIDs ...int) (X3DHCore.X3DHClientBundle, *X3DHCore.X3DHFullIK) {
+	t.Helper()
+	ik, err := X3DHCore.GenerateFullIK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := X3DHCore.GenerateFullSPK(ik.IdentityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return X3DHCore.X3DHClientBundle{
+		IK:     *ik.PublicIK(),
+		SPK:    *spk.PublicSPK(),
+		OtpSet: testOTPs(t, otpIDs...),
+	}, ik
+}
+
+func testOTPs(t *testing.T, ids ...int) []X3DHCore.X3DHPublicOTP {
+	t.Helper()
+	otps := make([]X3DHCore.X3DHPublicOTP, 0, len(ids))
+	for _, id := range ids {
+		otp, err := X3DHCore.GenerateFullOTP(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otps = append(otps, *otp.PublicOTP())
+	}
+	return otps
+}
+
+func testStoreBundles(t *testing.T, s Store) {
+	_, ok, err := s.GetBundle("alice")
+	if err != nil || ok {
+		t.Fatalf("GetBundle on empty store = %v, %v; want false, nil", ok, err)
+	}
+
+	bundle, _ := testBundle(t, 0, 1)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.GetBundle("alice")
+	if err != nil || !ok {
+		t.Fatalf("GetBundle = %v, %v; want true, nil", ok, err)
+	}
+	if !got.IK.IdentityKey.Equal(bundle.IK.IdentityKey) || len(got.OtpSet) != 2 {
+		t.Fatalf("GetBundle returned a different bundle")
+	}
+
+	// Replacing keeps queued messages
+	if err := s.PushMessage("alice", MessageData{ID: newMessageID(), SenderID: "bob"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	replacement, _ := testBundle(t, 5)
+	if err := s.PutBundle("alice", replacement); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _ = s.GetBundle("alice")
+	if !got.IK.IdentityKey.Equal(replacement.IK.IdentityKey) || len(got.OtpSet) != 1 {
+		t.Fatalf("PutBundle did not replace the bundle")
+	}
+	if messages, _ := s.ListMessages("alice", "", 0); len(messages) != 1 {
+		t.Fatalf("PutBundle dropped queued messages")
+	}
+}
+
+func testStorePutBundleForIdentity(t *testing.T, s Store) {
+	bundle, ik := testBundle(t, 0)
+	if stored, err := s.PutBundleForIdentity("alice", bundle); !stored || err != nil {
+		t.Fatalf("PutBundleForIdentity for new client = %v, %v; want true, nil", stored, err)
+	}
+	// Same identity key, new signed pre key
+	spk, err := X3DHCore.GenerateFullSPK(ik.IdentityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := bundle
+	refreshed.SPK = *spk.PublicSPK()
+	if stored, err := s.PutBundleForIdentity("alice", refreshed); !stored || err != nil {
+		t.Fatalf("PutBundleForIdentity with same identity = %v, %v; want true, nil", stored, err)
+	}
+	got, _, _ := s.GetBundle("alice")
+	if !got.SPK.SignedPreKey.Equal(refreshed.SPK.SignedPreKey) {
+		t.Fatalf("PutBundleForIdentity did not replace the signed pre key")
+	}
+	// Different identity key is refused and leaves the bundle alone
+	other, _ := testBundle(t, 1)
+	if stored, err := s.PutBundleForIdentity("alice", other); stored || err != nil {
+		t.Fatalf("PutBundleForIdentity with other identity = %v, %v; want false, nil", stored, err)
+	}
+	got, _, _ = s.GetBundle("alice")
+	if !got.IK.IdentityKey.Equal(bundle.IK.IdentityKey) {
+		t.Fatalf("PutBundleForIdentity replaced the identity key")
+	}
+}
+
+func testStoreOneTimePreKeys(t *testing.T, s Store) {
+	if _, err := s.AppendOTPs("nobody", testOTPs(t, 1), 0); err != ErrClientNotFound {
+		t.Fatalf("AppendOTPs for unknown client = %v; want ErrClientNotFound", err)
+	}
+	if _, err := s.CountOTPs("nobody"); err != ErrClientNotFound {
+		t.Fatalf("CountOTPs for unknown client = %v; want ErrClientNotFound", err)
+	}
+	if _, ok, err := s.ClaimBundle("nobody"); ok || err != nil {
+		t.Fatalf("ClaimBundle for unknown client = %v, %v; want false, nil", ok, err)
+	}
+
+	bundle, _ := testBundle(t, 0, 1)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AppendOTPs("alice", testOTPs(t, 2, 3), 0); err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.CountOTPs("alice")
+	if err != nil || count != 4 {
+		t.Fatalf("CountOTPs = %d, %v; want 4, nil", count, err)
+	}
+
+	// Claimed oldest first, each exactly once
+	for want := 0; want < 4; want++ {
+		keyBundle, ok, err := s.ClaimBundle("alice")
+		if err != nil || !ok {
+			t.Fatalf("ClaimBundle = %v, %v; want true, nil", ok, err)
+		}
+		if keyBundle.OTP.OneTimePreKeyID != want {
+			t.Fatalf("ClaimBundle returned id %d; want %d", keyBundle.OTP.OneTimePreKeyID, want)
+		}
+		if !keyBundle.IK.IdentityKey.Equal(bundle.IK.IdentityKey) || !keyBundle.Validate() {
+			t.Fatalf("ClaimBundle returned a bundle that does not match the stored one")
+		}
+	}
+	if _, ok, err := s.ClaimBundle("alice"); ok || err != nil {
+		t.Fatalf("ClaimBundle on empty set = %v, %v; want false, nil", ok, err)
+	}
+	count, _ = s.CountOTPs("alice")
+	if count != 0 {
+		t.Fatalf("CountOTPs after claiming all = %d; want 0", count)
+	}
+}
+
+// Claim every key from many goroutines at once and collect the IDs handed out
+func claimAllConcurrently(t *testing.T, s Store, clientID string, workers int, stop <-chan struct{}) []int {
+	t.Helper()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	claimed := make([]int, 0)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				keyBundle, ok, err := s.ClaimBundle(clientID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					// Keep trying while keys may still be appended
+					select {
+					case <-stop:
+						return
+					default:
+						continue
+					}
+				}
+				mu.Lock()
+				claimed = append(claimed, keyBundle.OTP.OneTimePreKeyID)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return claimed
+}
+
+func checkClaimedOnce(t *testing.T, claimed []int, total int) {
+	t.Helper()
+	seen := make(map[int]bool)
+	for _, id := range claimed {
+		if seen[id] {
+			t.Fatalf("one time pre key %d was handed out twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != total {
+		t.Fatalf("%d one time pre keys handed out; want %d", len(seen), total)
+	}
+}
+
+func testStoreOTPReuseAndLimit(t *testing.T, s Store) {
+	bundle, _ := testBundle(t, 0, 1)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.AppendOTPs("alice", testOTPs(t, 2, 3), 0)
+	if err != nil || len(result.Accepted) != 2 || len(result.Rejected) != 0 {
+		t.Fatalf("AppendOTPs = %+v, %v; want 2 accepted", result, err)
+	}
+	// Claimed keys keep their IDs used
+	for i := 0; i < 4; i++ {
+		if _, ok, err := s.ClaimBundle("alice"); !ok || err != nil {
+			t.Fatalf("ClaimBundle = %v, %v; want true, nil", ok, err)
+		}
+	}
+	result, err = s.AppendOTPs("alice", testOTPs(t, 1, 3, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Accepted) != 1 || result.Accepted[0] != 4 {
+		t.Fatalf("AppendOTPs accepted %v; want [4]", result.Accepted)
+	}
+	for _, rejection := range result.Rejected {
+		if rejection.Reason != OTPRejectedReused {
+			t.Fatalf("AppendOTPs rejected %d as %q; want %q", rejection.ID, rejection.Reason, OTPRejectedReused)
+		}
+	}
+	if len(result.Rejected) != 2 {
+		t.Fatalf("AppendOTPs rejected %d keys; want 2", len(result.Rejected))
+	}
+
+	// Stored count is capped
+	result, err = s.AppendOTPs("alice", testOTPs(t, 5, 6, 7), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Accepted) != 2 || len(result.Rejected) != 1 || result.Rejected[0].ID != 7 || result.Rejected[0].Reason != OTPRejectedLimit {
+		t.Fatalf("AppendOTPs with limit = %+v; want 5 and 6 accepted, 7 over the limit", result)
+	}
+	if count, _ := s.CountOTPs("alice"); count != 3 {
+		t.Fatalf("CountOTPs = %d; want 3", count)
+	}
+	// A key rejected for the limit may be uploaded again later
+	if _, ok, _ := s.ClaimBundle("alice"); !ok {
+		t.Fatalf("ClaimBundle returned no key")
+	}
+	result, _ = s.AppendOTPs("alice", testOTPs(t, 7), 3)
+	if len(result.Accepted) != 1 {
+		t.Fatalf("AppendOTPs after claim = %+v; want 7 accepted", result)
+	}
+
+	// A new bundle cannot bring back used IDs through later uploads
+	replacement, _ := testBundle(t, 20)
+	if err := s.PutBundle("alice", replacement); err != nil {
+		t.Fatal(err)
+	}
+	result, _ = s.AppendOTPs("alice", testOTPs(t, 8, 21), 0)
+	if len(result.Accepted) != 1 || result.Accepted[0] != 21 {
+		t.Fatalf("AppendOTPs after new bundle accepted %v; want [21]", result.Accepted)
+	}
+}
+
+// Claim every key left and return the IDs in the order handed out
+func claimAll(t *testing.T, s Store, clientID string) []int {
+	t.Helper()
+	claimed := make([]int, 0)
+	for {
+		keyBundle, ok, err := s.ClaimBundle(clientID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return claimed
+		}
+		claimed = append(claimed, keyBundle.OTP.OneTimePreKeyID)
+	}
+}
+
+func testStoreBundleOTPReuse(t *testing.T, s Store) {
+	bundle, ik := testBundle(t, 0, 1, 2)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if keyBundle, ok, err := s.ClaimBundle("alice"); !ok || err != nil || keyBundle.OTP.OneTimePreKeyID != 0 {
+		t.Fatalf("ClaimBundle = %d, %v, %v; want 0, true, nil", keyBundle.OTP.OneTimePreKeyID, ok, err)
+	}
+
+	// Uploading the same keys again keeps those not handed out yet
+	bundle.OtpSet = append(bundle.OtpSet, testOTPs(t, 3)...)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := s.PutBundleForIdentity("alice", bundle); !stored || err != nil {
+		t.Fatalf("PutBundleForIdentity = %v, %v; want true, nil", stored, err)
+	}
+	if claimed := claimAll(t, s, "alice"); fmt.Sprint(claimed) != "[1 2 3]" {
+		t.Fatalf("claimed %v after uploading the bundle again; want [1 2 3]", claimed)
+	}
+
+	// Nor can a re-registration or rotation bring back claimed keys
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := s.PutBundleForIdentity("alice", bundle); !stored || err != nil {
+		t.Fatalf("PutBundleForIdentity = %v, %v; want true, nil", stored, err)
+	}
+	if count, _ := s.CountOTPs("alice"); count != 0 {
+		t.Fatalf("CountOTPs = %d after uploading claimed keys; want 0", count)
+	}
+	newBundle, _ := testBundle(t, 0, 3, 4)
+	rotation, err := X3DHCore.SignIdentityRotation(ik.IdentityKey, newBundle.IK.IdentityKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced, err := s.ReplaceIdentity("alice", bundle.IK.IdentityKey, newBundle, *rotation); !replaced || err != nil {
+		t.Fatalf("ReplaceIdentity = %v, %v; want true, nil", replaced, err)
+	}
+	if claimed := claimAll(t, s, "alice"); fmt.Sprint(claimed) != "[4]" {
+		t.Fatalf("claimed %v after ReplaceIdentity; want [4]", claimed)
+	}
+	// Used IDs stay used for later uploads
+	result, err := s.AppendOTPs("alice", testOTPs(t, 4, 5), 0)
+	if err != nil || len(result.Accepted) != 1 || result.Accepted[0] != 5 {
+		t.Fatalf("AppendOTPs = %+v, %v; want 5 accepted", result, err)
+	}
+}
+
+func testStoreConcurrentClaims(t *testing.T, s Store) {
+	const total = 100
+	ids := make([]int, total)
+	for i := range ids {
+		ids[i] = i
+	}
+	bundle, _ := testBundle(t, ids...)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	claimed := claimAllConcurrently(t, s, "alice", 16, stop)
+	checkClaimedOnce(t, claimed, total)
+}
+
+func testStoreConcurrentClaimsAndAppends(t *testing.T, s Store) {
+	const batches = 20
+	const batchSize = 5
+	bundle, _ := testBundle(t)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appends must never undo claims and claims must never drop appended keys
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		for b := 0; b < batches; b++ {
+			ids := make([]int, batchSize)
+			for i := range ids {
+				ids[i] = b*batchSize + i
+			}
+			if _, err := s.AppendOTPs("alice", testOTPs(t, ids...), 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	claimed := claimAllConcurrently(t, s, "alice", 8, stop)
+	// Keys appended after the workers saw the stop signal
+	for {
+		keyBundle, ok, err := s.ClaimBundle("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		claimed = append(claimed, keyBundle.OTP.OneTimePreKeyID)
+	}
+	checkClaimedOnce(t, claimed, batches*batchSize)
+}
+
+func testStoreMessages(t *testing.T, s Store) {
+	if err := s.PushMessage("nobody", MessageData{ID: newMessageID(), SenderID: "bob"}, 0); err != ErrClientNotFound {
+		t.Fatalf("PushMessage to unknown client = %v; want ErrClientNotFound", err)
+	}
+
+	bundle, _ := testBundle(t, 0)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := s.ListMessages("alice", "", 0); len(messages) != 0 || err != nil {
+		t.Fatalf("ListMessages on empty queue = %d, %v; want 0, nil", len(messages), err)
+	}
+	senders := []string{"bob", "carol", "dave"}
+	ids := make([]string, 0, len(senders))
+	for _, sender := range senders {
+		msg := MessageData{
+			ID:        newMessageID(),
+			SenderID:  sender,
+			Message:   X3DHCore.InitialMessage{Ciphertext: []byte(sender)},
+			Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+		}
+		if err := s.PushMessage("alice", msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	// Oldest first, and listing does not remove anything
+	for i := 0; i < 2; i++ {
+		messages, err := s.ListMessages("alice", "", 0)
+		if err != nil || len(messages) != len(senders) {
+			t.Fatalf("ListMessages = %d, %v; want %d, nil", len(messages), err, len(senders))
+		}
+		for j, msg := range messages {
+			if msg.ID != ids[j] || msg.SenderID != senders[j] || string(msg.Message.Ciphertext) != senders[j] {
+				t.Fatalf("ListMessages[%d] is from %q; want %q", j, msg.SenderID, senders[j])
+			}
+			if msg.Timestamp.IsZero() {
+				t.Fatalf("ListMessages[%d] lost its timestamp", j)
+			}
+		}
+	}
+	// Cursor and limit
+	messages, err := s.ListMessages("alice", ids[0], 1)
+	if err != nil || len(messages) != 1 || messages[0].ID != ids[1] {
+		t.Fatalf("ListMessages after first with limit 1 did not return the second message")
+	}
+	if messages, _ := s.ListMessages("bob", "", 0); len(messages) != 0 {
+		t.Fatalf("ListMessages returned messages queued for another client")
+	}
+
+	// Acknowledged messages are gone, other clients cannot acknowledge them
+	if _, acked, err := s.AckMessage("bob", ids[1]); acked || err != nil {
+		t.Fatalf("AckMessage by another client = %v, %v; want false, nil", acked, err)
+	}
+	acked, ok, err := s.AckMessage("alice", ids[1])
+	if !ok || err != nil {
+		t.Fatalf("AckMessage = %v, %v; want true, nil", ok, err)
+	}
+	if acked.ID != ids[1] || acked.SenderID != senders[1] {
+		t.Fatalf("AckMessage returned message %q from %q; want %q from %q", acked.ID, acked.SenderID, ids[1], senders[1])
+	}
+	if _, acked, _ := s.AckMessage("alice", ids[1]); acked {
+		t.Fatalf("AckMessage acknowledged the same message twice")
+	}
+	messages, _ = s.ListMessages("alice", "", 0)
+	if len(messages) != 2 || messages[0].ID != ids[0] || messages[1].ID != ids[2] {
+		t.Fatalf("ListMessages after ack returned the wrong messages")
+	}
+}
+
+func testStoreQueueLimit(t *testing.T, s Store) {
+	bundle, _ := testBundle(t, 0)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.PushMessage("alice", MessageData{ID: newMessageID(), SenderID: "bob"}, 3); err != nil {
+			t.Fatalf("PushMessage %d = %v; want nil", i, err)
+		}
+	}
+	if err := s.PushMessage("alice", MessageData{ID: newMessageID(), SenderID: "bob"}, 3); err != ErrQueueFull {
+		t.Fatalf("PushMessage to full queue = %v; want ErrQueueFull", err)
+	}
+	// Acknowledging frees a slot
+	messages, _ := s.ListMessages("alice", "", 1)
+	if _, acked, err := s.AckMessage("alice", messages[0].ID); !acked || err != nil {
+		t.Fatalf("AckMessage = %v, %v; want true, nil", acked, err)
+	}
+	if err := s.PushMessage("alice", MessageData{ID: newMessageID(), SenderID: "bob"}, 3); err != nil {
+		t.Fatalf("PushMessage after ack = %v; want nil", err)
+	}
+}
+
+func testStoreReceipts(t *testing.T, s Store) {
+	receipt := ReceiptData{ID: newMessageID(), OwnerID: "alice", FromID: "bob", Type: X3DHCore.ReceiptDelivered, MessageID: "m1", Timestamp: time.Now().UTC()}
+	if err := s.PushReceipt(receipt, 0); err != ErrClientNotFound {
+		t.Fatalf("PushReceipt for unknown owner = %v; want ErrClientNotFound", err)
+	}
+	bundle, ik := testBundle(t, 0)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushReceipt(receipt, 2); err != nil {
+		t.Fatalf("PushReceipt = %v; want nil", err)
+	}
+	read := ReceiptData{
+		ID:        newMessageID(),
+		OwnerID:   "alice",
+		FromID:    "bob",
+		Type:      X3DHCore.ReceiptRead,
+		Signal:    &X3DHCore.EphemeralSignal{IdentityKey: ik.IdentityKey.PublicKey, Ciphertext: []byte("read")},
+		Timestamp: time.Now().UTC(),
+	}
+	if err := s.PushReceipt(read, 2); err != nil {
+		t.Fatalf("PushReceipt = %v; want nil", err)
+	}
+
+	// Oldest first, then gone
+	receipts, err := s.TakeReceipts("alice")
+	if err != nil || len(receipts) != 2 {
+		t.Fatalf("TakeReceipts = %d, %v; want 2, nil", len(receipts), err)
+	}
+	if receipts[0].ID != receipt.ID || receipts[0].Type != X3DHCore.ReceiptDelivered || receipts[0].MessageID != "m1" || receipts[0].FromID != "bob" {
+		t.Fatalf("TakeReceipts[0] = %+v; want the delivered receipt", receipts[0])
+	}
+	if receipts[1].Type != X3DHCore.ReceiptRead || receipts[1].Signal == nil || string(receipts[1].Signal.Ciphertext) != "read" {
+		t.Fatalf("TakeReceipts[1] = %+v; want the read receipt with its signal", receipts[1])
+	}
+	if !receipts[1].Signal.IdentityKey.Equal(ik.IdentityKey.PublicKey) {
+		t.Fatalf("TakeReceipts lost the identity key of the signal")
+	}
+	if receipts, err := s.TakeReceipts("alice"); len(receipts) != 0 || err != nil {
+		t.Fatalf("TakeReceipts twice = %d, %v; want 0, nil", len(receipts), err)
+	}
+
+	// Over the limit the oldest are dropped
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		receipt := ReceiptData{ID: newMessageID(), OwnerID: "alice", FromID: "bob", Type: X3DHCore.ReceiptDelivered, Timestamp: time.Now().UTC()}
+		if err := s.PushReceipt(receipt, 2); err != nil {
+			t.Fatalf("PushReceipt %d with limit 2 = %v; want nil", i, err)
+		}
+		ids = append(ids, receipt.ID)
+	}
+	receipts, err = s.TakeReceipts("alice")
+	if err != nil || len(receipts) != 2 || receipts[0].ID != ids[1] || receipts[1].ID != ids[2] {
+		t.Fatalf("TakeReceipts over the limit = %+v, %v; want the 2 newest", receipts, err)
+	}
+}
+
+func testStoreDeliveries(t *testing.T, s Store) {
+	delivery := DeliveryData{ID: newMessageID(), RecipientID: "bob", SenderID: "alice", MessageID: "m1", Timestamp: time.Now().UTC()}
+	if err := s.PushDelivery(delivery, 2); err != nil {
+		t.Fatalf("PushDelivery = %v; want nil", err)
+	}
+	// Only the recipient, for the message of its sender
+	for _, tt := range []struct{ recipientID, senderID, messageID string }{
+		{"alice", "alice", "m1"},
+		{"alice", "bob", "m1"},
+		{"bob", "carol", "m1"},
+		{"bob", "alice", "m2"},
+	} {
+		if ok, err := s.TakeDelivery(tt.recipientID, tt.senderID, tt.messageID); ok || err != nil {
+			t.Fatalf("TakeDelivery(%q, %q, %q) = %v, %v; want false, nil", tt.recipientID, tt.senderID, tt.messageID, ok, err)
+		}
+	}
+	if ok, err := s.TakeDelivery("bob", "alice", "m1"); !ok || err != nil {
+		t.Fatalf("TakeDelivery = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := s.TakeDelivery("bob", "alice", "m1"); ok || err != nil {
+		t.Fatalf("TakeDelivery twice = %v, %v; want false, nil", ok, err)
+	}
+
+	// Over the limit the oldest are dropped
+	for _, messageID := range []string{"m2", "m3", "m4"} {
+		delivery := DeliveryData{ID: newMessageID(), RecipientID: "bob", SenderID: "alice", MessageID: messageID, Timestamp: time.Now().UTC()}
+		if err := s.PushDelivery(delivery, 2); err != nil {
+			t.Fatalf("PushDelivery %s with limit 2 = %v; want nil", messageID, err)
+		}
+	}
+	for messageID, want := range map[string]bool{"m2": false, "m3": true, "m4": true} {
+		if ok, err := s.TakeDelivery("bob", "alice", messageID); ok != want || err != nil {
+			t.Fatalf("TakeDelivery %s over the limit = %v, %v; want %v, nil", messageID, ok, err, want)
+		}
+	}
+}
+
+func testStorePurgeReceipts(t *testing.T, s Store) {
+	bundle, _ := testBundle(t, 0)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, age := range []time.Duration{2 * time.Hour, time.Minute} {
+		receipt := ReceiptData{ID: newMessageID(), OwnerID: "alice", FromID: "bob", Type: X3DHCore.ReceiptDelivered, MessageID: age.String(), Timestamp: now.Add(-age)}
+		if err := s.PushReceipt(receipt, 0); err != nil {
+			t.Fatal(err)
+		}
+		delivery := DeliveryData{ID: newMessageID(), RecipientID: "bob", SenderID: "alice", MessageID: age.String(), Timestamp: now.Add(-age)}
+		if err := s.PushDelivery(delivery, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := s.PurgeReceipts(now.Add(-time.Hour))
+	if purged != 2 || err != nil {
+		t.Fatalf("PurgeReceipts = %d, %v; want 2, nil", purged, err)
+	}
+	receipts, err := s.TakeReceipts("alice")
+	if err != nil || len(receipts) != 1 || receipts[0].MessageID != time.Minute.String() {
+		t.Fatalf("TakeReceipts after PurgeReceipts = %+v, %v; want the fresh receipt", receipts, err)
+	}
+	if ok, _ := s.TakeDelivery("bob", "alice", (2 * time.Hour).String()); ok {
+		t.Fatalf("PurgeReceipts kept an expired delivery")
+	}
+	if ok, _ := s.TakeDelivery("bob", "alice", time.Minute.String()); !ok {
+		t.Fatalf("PurgeReceipts removed a delivery newer than the cutoff")
+	}
+}
+
+func testStorePurgeMessages(t *testing.T, s Store) {
+	for _, clientID := range []string{"alice", "bob"} {
+		bundle, _ := testBundle(t, 0)
+		if err := s.PutBundle(clientID, bundle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	push := func(recipientID string, age time.Duration) string {
+		msg := MessageData{
+			ID:          newMessageID(),
+			RecipientID: recipientID,
+			SenderID:    "carol",
+			Timestamp:   now.Add(-age),
+		}
+		if err := s.PushMessage(recipientID, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		return msg.ID
+	}
+	old := map[string]bool{
+		push("alice", 2*time.Hour): true,
+		push("bob", 3*time.Hour):   true,
+	}
+	fresh := push("alice", time.Minute)
+
+	purged, err := s.PurgeMessages(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != len(old) {
+		t.Fatalf("PurgeMessages removed %d messages; want %d", len(purged), len(old))
+	}
+	for _, msg := range purged {
+		if !old[msg.ID] || msg.SenderID != "carol" || msg.RecipientID == "" {
+			t.Fatalf("PurgeMessages returned unexpected message %+v", msg)
+		}
+	}
+	messages, _ := s.ListMessages("alice", "", 0)
+	if len(messages) != 1 || messages[0].ID != fresh {
+		t.Fatalf("PurgeMessages removed a message newer than the cutoff")
+	}
+	if messages, _ := s.ListMessages("bob", "", 0); len(messages) != 0 {
+		t.Fatalf("PurgeMessages kept an expired message")
+	}
+}
+
+func testStoreReplaceIdentity(t *testing.T, s Store) {
+	bundle, ik := testBundle(t, 0)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	newBundle, _ := testBundle(t, 1)
+	rotation, err := X3DHCore.SignIdentityRotation(ik.IdentityKey, newBundle.IK.IdentityKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong old key is refused
+	replaced, err := s.ReplaceIdentity("alice", newBundle.IK.IdentityKey, newBundle, *rotation)
+	if err != nil || replaced {
+		t.Fatalf("ReplaceIdentity with wrong old key = %v, %v; want false, nil", replaced, err)
+	}
+	replaced, err = s.ReplaceIdentity("nobody", bundle.IK.IdentityKey, newBundle, *rotation)
+	if err != nil || replaced {
+		t.Fatalf("ReplaceIdentity for unknown client = %v, %v; want false, nil", replaced, err)
+	}
+
+	replaced, err = s.ReplaceIdentity("alice", bundle.IK.IdentityKey, newBundle, *rotation)
+	if err != nil || !replaced {
+		t.Fatalf("ReplaceIdentity = %v, %v; want true, nil", replaced, err)
+	}
+	got, _, _ := s.GetBundle("alice")
+	if !got.IK.IdentityKey.Equal(newBundle.IK.IdentityKey) {
+		t.Fatalf("ReplaceIdentity did not store the new bundle")
+	}
+	rotations, ok, err := s.GetRotations("alice")
+	if err != nil || !ok || len(rotations) != 1 {
+		t.Fatalf("GetRotations = %d, %v, %v; want 1, true, nil", len(rotations), ok, err)
+	}
+	if !rotations[0].Verify() {
+		t.Fatalf("stored rotation no longer verifies")
+	}
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	if _, ok, err := s.GetUser("alice"); ok || err != nil {
+		t.Fatalf("GetUser on empty store = %v, %v; want false, nil", ok, err)
+	}
+	created, err := s.CreateUser(UserRecord{Username: "alice", PasswordHash: "first"})
+	if err != nil || !created {
+		t.Fatalf("CreateUser = %v, %v; want true, nil", created, err)
+	}
+	// Existing accounts are never overwritten
+	created, err = s.CreateUser(UserRecord{Username: "alice", PasswordHash: "second"})
+	if err != nil || created {
+		t.Fatalf("CreateUser for existing user = %v, %v; want false, nil", created, err)
+	}
+	user, ok, err := s.GetUser("alice")
+	if err != nil || !ok || user.PasswordHash != "first" {
+		t.Fatalf("GetUser = %+v, %v, %v; want first password", user, ok, err)
+	}
+
+	if _, err := s.CreateUser(UserRecord{Username: "aaron", PasswordHash: "third"}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := s.ListUsers()
+	if err != nil || len(users) != 2 || users[0].Username != "aaron" || users[1].Username != "alice" {
+		t.Fatalf("ListUsers = %+v, %v; want aaron and alice", users, err)
+	}
+	found, err := s.SetUserSuspended("alice", true)
+	if err != nil || !found {
+		t.Fatalf("SetUserSuspended = %v, %v; want true, nil", found, err)
+	}
+	if user, _, err := s.GetUser("alice"); err != nil || !user.Suspended || user.PasswordHash != "first" {
+		t.Fatalf("GetUser after SetUserSuspended = %+v, %v; want suspended", user, err)
+	}
+	if found, err := s.SetUserSuspended("nobody", true); err != nil || found {
+		t.Fatalf("SetUserSuspended for unknown user = %v, %v; want false, nil", found, err)
+	}
+
+	// Presence is hidden until set
+	if user, _, _ := s.GetUser("aaron"); user.Presence.VisibleTo("alice") {
+		t.Fatalf("default presence of aaron = %+v; want hidden", user.Presence)
+	}
+	presence := PresenceSettings{Visibility: X3DHCore.PresenceContacts, ShareLastSeen: true, Contacts: []string{"alice"}}
+	if found, err := s.SetUserPresence("aaron", presence); err != nil || !found {
+		t.Fatalf("SetUserPresence = %v, %v; want true, nil", found, err)
+	}
+	if user, _, err := s.GetUser("aaron"); err != nil || !user.Presence.ShareLastSeen || !user.Presence.VisibleTo("alice") || user.Presence.VisibleTo("bob") {
+		t.Fatalf("GetUser after SetUserPresence = %+v, %v; want visible to alice only", user.Presence, err)
+	}
+	if found, err := s.SetUserPresence("nobody", presence); err != nil || found {
+		t.Fatalf("SetUserPresence for unknown user = %v, %v; want false, nil", found, err)
+	}
+}
+
+func testStoreInactiveUsers(t *testing.T, s Store) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	users := []UserRecord{
+		{Username: "alice", PasswordHash: "a", LastSeen: now.Add(-48 * time.Hour)},
+		{Username: "bob", PasswordHash: "b", LastSeen: now},
+		// Accounts from before activity was tracked are never expired
+		{Username: "carol", PasswordHash: "c"},
+	}
+	for _, user := range users {
+		if _, err := s.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := now.Add(-24 * time.Hour)
+	inactive, err := s.ListInactiveUsers(before)
+	if err != nil || len(inactive) != 1 || inactive[0] != "alice" {
+		t.Fatalf("ListInactiveUsers = %v, %v; want [alice], nil", inactive, err)
+	}
+
+	// Activity since the listing keeps the account
+	if err := s.TouchUser("alice", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TouchUser("nobody", now); err != nil {
+		t.Fatalf("TouchUser for unknown user = %v; want nil", err)
+	}
+	deleted, err := s.DeleteUser("alice", before)
+	if err != nil || deleted {
+		t.Fatalf("DeleteUser for active user = %v, %v; want false, nil", deleted, err)
+	}
+	if inactive, err := s.ListInactiveUsers(before); err != nil || len(inactive) != 0 {
+		t.Fatalf("ListInactiveUsers after TouchUser = %v, %v; want none", inactive, err)
+	}
+	deleted, err = s.DeleteUser("carol", before)
+	if err != nil || deleted {
+		t.Fatalf("DeleteUser for never seen user = %v, %v; want false, nil", deleted, err)
+	}
+
+	// Without a time the account is always removed
+	deleted, err = s.DeleteUser("alice", time.Time{})
+	if err != nil || !deleted {
+		t.Fatalf("DeleteUser = %v, %v; want true, nil", deleted, err)
+	}
+	if _, ok, err := s.GetUser("alice"); ok || err != nil {
+		t.Fatalf("GetUser after DeleteUser = %v, %v; want false, nil", ok, err)
+	}
+	deleted, err = s.DeleteUser("alice", time.Time{})
+	if err != nil || deleted {
+		t.Fatalf("DeleteUser for deleted user = %v, %v; want false, nil", deleted, err)
+	}
+}
+
+func testStoreDeleteClient(t *testing.T, s Store) {
+	messageIDs := make(map[string]string)
+	for _, clientID := range []string{"alice", "bob"} {
+		bundle, _ := testBundle(t, 0, 1)
+		if err := s.PutBundle(clientID, bundle); err != nil {
+			t.Fatal(err)
+		}
+		msg := MessageData{ID: newMessageID(), RecipientID: clientID, SenderID: "carol", Timestamp: time.Now().UTC()}
+		if err := s.PushMessage(clientID, msg, 0); err != nil {
+			t.Fatal(err)
+		}
+		receipt := ReceiptData{ID: newMessageID(), OwnerID: clientID, FromID: "carol", Type: X3DHCore.ReceiptDelivered, MessageID: msg.ID}
+		if err := s.PushReceipt(receipt, 0); err != nil {
+			t.Fatal(err)
+		}
+		delivery := DeliveryData{ID: newMessageID(), RecipientID: clientID, SenderID: "carol", MessageID: msg.ID, Timestamp: time.Now().UTC()}
+		if err := s.PushDelivery(delivery, 0); err != nil {
+			t.Fatal(err)
+		}
+		messageIDs[clientID] = msg.ID
+	}
+	if err := s.DeleteClient("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.GetBundle("alice"); ok || err != nil {
+		t.Fatalf("GetBundle after DeleteClient = %v, %v; want false, nil", ok, err)
+	}
+	if messages, err := s.ListMessages("alice", "", 0); len(messages) != 0 || err != nil {
+		t.Fatalf("ListMessages after DeleteClient = %d, %v; want 0, nil", len(messages), err)
+	}
+	if receipts, err := s.TakeReceipts("alice"); len(receipts) != 0 || err != nil {
+		t.Fatalf("TakeReceipts after DeleteClient = %d, %v; want 0, nil", len(receipts), err)
+	}
+	if ok, err := s.TakeDelivery("alice", "carol", messageIDs["alice"]); ok || err != nil {
+		t.Fatalf("TakeDelivery after DeleteClient = %v, %v; want false, nil", ok, err)
+	}
+	// Other clients are untouched
+	if messages, err := s.ListMessages("bob", "", 0); len(messages) != 1 || err != nil {
+		t.Fatalf("ListMessages for other client = %d, %v; want 1, nil", len(messages), err)
+	}
+	if receipts, err := s.TakeReceipts("bob"); len(receipts) != 1 || err != nil {
+		t.Fatalf("TakeReceipts for other client = %d, %v; want 1, nil", len(receipts), err)
+	}
+	if ok, err := s.TakeDelivery("bob", "carol", messageIDs["bob"]); !ok || err != nil {
+		t.Fatalf("TakeDelivery for other client = %v, %v; want true, nil", ok, err)
+	}
+	if err := s.DeleteClient("alice"); err != nil {
+		t.Fatalf("DeleteClient for unknown client = %v; want nil", err)
+	}
+}
+
+func testStoreClientStats(t *testing.T, s Store) {
+	if _, ok, err := s.GetClient("alice"); ok || err != nil {
+		t.Fatalf("GetClient on empty store = %v, %v; want false, nil", ok, err)
+	}
+	before := time.Now().UTC().Add(-time.Second)
+	bundle, _ := testBundle(t, 0, 1)
+	if err := s.PutBundle("alice", bundle); err != nil {
+		t.Fatal(err)
+	}
+	clientData, ok, err := s.GetClient("alice")
+	if err != nil || !ok || len(clientData.Bundle.OtpSet) != 2 {
+		t.Fatalf("GetClient = %v, %v; want the bundle with 2 OTPs", ok, err)
+	}
+	if clientData.SPKUpdatedAt.Before(before) {
+		t.Fatalf("SPKUpdatedAt = %v; want the time of PutBundle", clientData.SPKUpdatedAt)
+	}
+
+	for i := 0; i < 3; i++ {
+		msg := MessageData{ID: newMessageID(), RecipientID: "alice", SenderID: "bob", Timestamp: time.Now().UTC()}
+		if err := s.PushMessage("alice", msg, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := s.CountMessages("alice"); count != 3 || err != nil {
+		t.Fatalf("CountMessages = %d, %v; want 3, nil", count, err)
+	}
+	if cleared, err := s.ClearMessages("alice"); cleared != 3 || err != nil {
+		t.Fatalf("ClearMessages = %d, %v; want 3, nil", cleared, err)
+	}
+	if count, err := s.CountMessages("alice"); count != 0 || err != nil {
+		t.Fatalf("CountMessages after ClearMessages = %d, %v; want 0, nil", count, err)
+	}
+	if cleared, err := s.ClearMessages("nobody"); cleared != 0 || err != nil {
+		t.Fatalf("ClearMessages for unknown client = %d, %v; want 0, nil", cleared, err)
+	}
+	// The bundle is kept
+	if _, ok, err := s.GetBundle("alice"); !ok || err != nil {
+		t.Fatalf("GetBundle after ClearMessages = %v, %v; want true, nil", ok, err)
+	}
+}